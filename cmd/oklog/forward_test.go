@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/forward"
+	"github.com/1046102779/oklog/pkg/fs"
+	"github.com/1046102779/oklog/pkg/ingest"
+)
+
+func TestForwardDurableAcrossIngesterRestart(t *testing.T) {
+	t.Parallel()
+
+	ingestLog, err := ingest.NewFileLog(fs.NewVirtualFilesystem(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingestLog.Close()
+
+	// Start an ingester, and forward to it.
+	addr, stop := startDurableIngester(t, ingestLog, "127.0.0.1:0")
+	var (
+		source = newChanSource()
+		urls   = &staticIngesters{urls: []*url.URL{{Scheme: "tcp", Host: addr}}}
+		errc   = make(chan error, 1)
+	)
+	go func() {
+		errc <- forwardRecords(source, urls, "", true, newForwardMetrics(), log.NewNopLogger())
+	}()
+	const n = 100
+	for i := 0; i < n/2; i++ {
+		source.records <- fmt.Sprintf("record-%d", i)
+	}
+	if !within(5*time.Second, func() bool { return source.ackCount() == n/2 }) {
+		t.Fatalf("first half: want %d acks, have %d", n/2, source.ackCount())
+	}
+
+	// Restart the ingester while records keep coming.
+	stop()
+	go func() {
+		for i := n / 2; i < n; i++ {
+			source.records <- fmt.Sprintf("record-%d", i)
+		}
+		close(source.records)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, stop = startDurableIngester(t, ingestLog, addr)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("forwarder didn't finish; %d acks", source.ackCount())
+	}
+	stop()
+
+	// Every record made it to the ingest log at least once.
+	var buf []byte
+	for {
+		segment, err := ingestLog.Oldest()
+		if err == ingest.ErrNoSegmentsAvailable {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, b...)
+		segment.Commit()
+	}
+	have := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		if fields := strings.SplitN(line, " ", 2); len(fields) == 2 {
+			have[fields[1]] = true
+		}
+	}
+	for i := 0; i < n; i++ {
+		if record := fmt.Sprintf("record-%d", i); !have[record] {
+			t.Errorf("%s was lost", record)
+		}
+	}
+	if want, have := n, source.ackCount(); want != have {
+		t.Errorf("acks: want %d, have %d", want, have)
+	}
+}
+
+func TestForwardFastSkipsOverloadedIngester(t *testing.T) {
+	t.Parallel()
+
+	// The first ingester has a backlog over its limit, so it refuses us.
+	overloadedLog, err := ingest.NewFileLog(fs.NewVirtualFilesystem(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overloadedLog.Close()
+	segment, err := overloadedLog.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(segment, "backlog")
+	load := ingest.NewLoadMonitor(overloadedLog, 1, func(cluster.Load) {}, prometheus.NewCounter(prometheus.CounterOpts{}))
+	go load.Run(10 * time.Millisecond)
+	defer load.Stop()
+	if !within(time.Second, load.Overloaded) {
+		t.Fatal("ingester isn't overloaded")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overloaded, stopOverloaded := serveIngester(load.Listener(ln, true), ingest.HandleFastWriter, overloadedLog)
+	defer stopOverloaded()
+
+	// The second one takes the records.
+	ingestLog, err := ingest.NewFileLog(fs.NewVirtualFilesystem(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingestLog.Close()
+	if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	healthy, stopHealthy := serveIngester(ln, ingest.HandleFastWriter, ingestLog)
+
+	var (
+		source = newChanSource()
+		urls   = &staticIngesters{urls: []*url.URL{{Scheme: "tcp", Host: overloaded}, {Scheme: "tcp", Host: healthy}}}
+		errc   = make(chan error, 1)
+	)
+	go func() {
+		errc <- forwardRecords(source, urls, "", false, newForwardMetrics(), log.NewNopLogger())
+	}()
+	const n = 10
+	for i := 0; i < n; i++ {
+		source.records <- fmt.Sprintf("record-%d", i)
+	}
+	close(source.records)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("forwarder didn't finish; %d acks", source.ackCount())
+	}
+	// Let the ingester read what it was sent, before we stop it to flush.
+	want := int64(n * len("01BB6RQR190000000000000000 record-0\n"))
+	if !within(time.Second, func() bool {
+		stats, err := ingestLog.Stats()
+		return err == nil && stats.ActiveBytes+stats.FlushedBytes >= want
+	}) {
+		t.Fatal("timeout waiting for the ingester to write the records")
+	}
+	stopHealthy()
+
+	// Every acked record made it to the healthy ingester.
+	flushed, err := ingestLog.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(flushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := n, strings.Count(string(buf), "\n"); want != have {
+		t.Errorf("want %d records, have %d: %q", want, have, buf)
+	}
+	if want, have := n, source.ackCount(); want != have {
+		t.Errorf("acks: want %d, have %d", want, have)
+	}
+}
+
+func TestClusterIngesters(t *testing.T) {
+	t.Parallel()
+
+	var (
+		current []string
+		loads   map[string]cluster.Load
+	)
+	c := newClusterIngesters(
+		func() []string { return current },
+		func() map[string]cluster.Load { return loads },
+		7651,
+	)
+	if _, ok := c.next(); ok {
+		t.Fatal("want no ingester from an empty cluster")
+	}
+
+	c.last = "10.0.0.1:7651"
+	for _, testcase := range []struct {
+		name    string
+		current []string
+		loads   map[string]cluster.Load
+		want    string
+	}{
+		{"rotate", []string{"10.0.0.2:7650", "10.0.0.1:7650", "10.0.0.1:7650"}, nil, "10.0.0.2:7651"},
+		{"rotate again", []string{"10.0.0.2:7650", "10.0.0.1:7650", "10.0.0.1:7650"}, nil, "10.0.0.1:7651"},
+		{"one leaves", []string{"10.0.0.3:7650", "10.0.0.2:7650"}, nil, "10.0.0.2:7651"},
+		{"one joins", []string{"10.0.0.3:7650", "10.0.0.2:7650", "10.0.0.4:7650"}, nil, "10.0.0.3:7651"},
+		{"fewest clients", []string{"10.0.0.3:7650", "10.0.0.2:7650", "10.0.0.4:7650"}, map[string]cluster.Load{
+			"10.0.0.2:7650": {ConnectedClients: 3},
+			"10.0.0.3:7650": {ConnectedClients: 1},
+			"10.0.0.4:7650": {ConnectedClients: 2},
+		}, "10.0.0.4:7651"}, // 10.0.0.3 was last
+		{"smallest backlog", []string{"10.0.0.3:7650", "10.0.0.2:7650", "10.0.0.4:7650"}, map[string]cluster.Load{
+			"10.0.0.2:7650": {ConnectedClients: 1, FlushedBytes: 100},
+			"10.0.0.3:7650": {ConnectedClients: 1, PendingBytes: 10},
+			"10.0.0.4:7650": {ConnectedClients: 1, ActiveBytes: 1000},
+		}, "10.0.0.3:7651"},
+		{"only the last", []string{"10.0.0.3:7650"}, nil, "10.0.0.3:7651"},
+	} {
+		current, loads = testcase.current, testcase.loads
+		u, ok := c.next()
+		if !ok {
+			t.Fatalf("%s: no ingester", testcase.name)
+		}
+		if want, have := "tcp://"+testcase.want, u.String(); want != have {
+			t.Errorf("%s: want %s, have %s", testcase.name, want, have)
+		}
+	}
+}
+
+// startDurableIngester runs a durable listener on addr, writing to the log.
+// It returns the bound address, and a function that stops the listener and
+// closes its connections.
+func startDurableIngester(t *testing.T, ingestLog ingest.Log, addr string) (string, func()) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveIngester(ln, ingest.HandleDurableWriter, ingestLog)
+}
+
+// serveIngester handles the listener's connections, writing to the log. It
+// returns the listener's address, and a function that stops the listener and
+// closes its connections.
+func serveIngester(ln net.Listener, h ingest.ConnectionHandler, ingestLog ingest.Log) (string, func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingest.HandleConnections(
+			ln,
+			h,
+			ingestLog,
+			time.Minute, 1024*1024,
+			prometheus.NewGauge(prometheus.GaugeOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewHistogram(prometheus.HistogramOpts{}),
+			prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		)
+	}()
+	return ln.Addr().String(), func() {
+		ln.Close()
+		<-done
+	}
+}
+
+// chanSource is an in-process stand-in for a message queue. Nacked records
+// are redelivered, and acks are counted.
+type chanSource struct {
+	records  chan string
+	mtx      sync.Mutex
+	requeued []string
+	acks     int
+}
+
+func newChanSource() *chanSource {
+	return &chanSource{records: make(chan string)}
+}
+
+func (s *chanSource) Next() (forward.Record, error) {
+	if data, ok := s.pop(); ok {
+		return s.record(data), nil
+	}
+	data, ok := <-s.records
+	if !ok {
+		if data, ok := s.pop(); ok {
+			return s.record(data), nil
+		}
+		return nil, io.EOF
+	}
+	return s.record(data), nil
+}
+
+func (s *chanSource) Close() error { return nil }
+
+func (s *chanSource) pop() (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.requeued) <= 0 {
+		return "", false
+	}
+	data := s.requeued[0]
+	s.requeued = s.requeued[1:]
+	return data, true
+}
+
+func (s *chanSource) ackCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.acks
+}
+
+func (s *chanSource) record(data string) forward.Record {
+	return chanRecord{s, data}
+}
+
+type chanRecord struct {
+	s    *chanSource
+	data string
+}
+
+func (r chanRecord) Data() []byte { return []byte(r.data) }
+
+func (r chanRecord) Ack() error {
+	r.s.mtx.Lock()
+	defer r.s.mtx.Unlock()
+	r.s.acks++
+	return nil
+}
+
+func (r chanRecord) Nack() error {
+	r.s.mtx.Lock()
+	defer r.s.mtx.Unlock()
+	r.s.requeued = append(r.s.requeued, r.data)
+	return nil
+}
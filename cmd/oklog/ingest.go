@@ -22,26 +22,34 @@ import (
 
 const (
 	defaultFastPort                    = 7651
+	defaultDurablePort                 = 7652
+	defaultBulkPort                    = 7653
 	defaultIngestSegmentFlushSize      = 16 * 1024 * 1024
 	defaultIngestSegmentFlushAge       = 3 * time.Second
 	defaultIngestSegmentPendingTimeout = time.Minute
+	defaultLoadReportInterval          = time.Second
 )
 
 var (
-	defaultFastAddr   = fmt.Sprintf("tcp://0.0.0.0:%d", defaultFastPort)
-	defaultIngestPath = filepath.Join("data", "ingest")
+	defaultFastAddr    = fmt.Sprintf("tcp://0.0.0.0:%d", defaultFastPort)
+	defaultDurableAddr = fmt.Sprintf("tcp://0.0.0.0:%d", defaultDurablePort)
+	defaultBulkAddr    = fmt.Sprintf("tcp://0.0.0.0:%d", defaultBulkPort)
+	defaultIngestPath  = filepath.Join("data", "ingest")
 )
 
 type IngestConfig struct {
 	Debug                 *bool          `json:"debug"`
 	MonitorApiAddr        *string        `json:"api_addr"`
 	FastAddr              *string        `json:"fast_addr"`
+	DurableAddr           *string        `json:"durable_addr"`
+	BulkAddr              *string        `json:"bulk_addr"`
 	ClusterBindAddr       *string        `json:"cluster_bind_addr"`
 	ClusterAdvertiseAddr  *string        `json:"cluster_advertise_addr"`
 	IngestPath            *string        `json:"ingest_path"`
 	SegmentFlushSize      *int           `json:"segment_flush_size"`
 	SegmentFlushAge       *time.Duration `json:"segment_flush_age"`
 	SegmentPendingTimeout *time.Duration `json:"segment_pending_timeout"`
+	MaxBacklog            *int64         `json:"max_backlog"`
 	ClusterPeers          stringslice    `json:"cluster_peers"`
 }
 
@@ -51,11 +59,14 @@ func parseIngestParams(args []string) (config *IngestConfig, err error) {
 		Debug:                 flagset.Bool("debug", false, "debug logging"),
 		MonitorApiAddr:        flagset.String("api", defaultAPIAddr, "listen address for ingest API"),
 		FastAddr:              flagset.String("ingest.fast", defaultFastAddr, "listen address for fast (async) writes"),
+		DurableAddr:           flagset.String("ingest.durable", "", fmt.Sprintf("listen address for durable (sync) writes, e.g. %s (empty to disable)", defaultDurableAddr)),
+		BulkAddr:              flagset.String("ingest.bulk", "", fmt.Sprintf("listen address for bulk (whole-segment) writes, e.g. %s (empty to disable)", defaultBulkAddr)),
 		ClusterBindAddr:       flagset.String("cluster", defaultClusterAddr, "listen address for cluster"),
 		IngestPath:            flagset.String("ingest.path", defaultIngestPath, "path holding segment files for ingest tier"),
 		SegmentFlushSize:      flagset.Int("ingest.segment-flush-size", defaultIngestSegmentFlushSize, "flush segments after they grow to this size"),
 		SegmentFlushAge:       flagset.Duration("ingest.segment-flush-age", defaultIngestSegmentFlushAge, "flush segments after they are active for this long"),
 		SegmentPendingTimeout: flagset.Duration("ingest.segment-pending-timeout", defaultIngestSegmentPendingTimeout, "claimed but uncommitted pending segments are failed after this long"),
+		MaxBacklog:            flagset.Int64("ingest.max-backlog", 0, "refuse new fast and bulk connections, and API writes, while this many bytes await the store tier (0 for no limit)"),
 	}
 	flagset.Var(&config.ClusterPeers, "peer", "cluster peer host:port (repeatable)")
 	flagset.Usage = usageFor(flagset, "oklog ingest [flags]")
@@ -76,10 +87,18 @@ type IngestMetrics struct {
 	FailedSegments        prometheus.Counter
 	CommittedSegments     prometheus.Counter
 	CommittedBytes        prometheus.Counter
+	RefusedConnections    prometheus.Counter
 	ApiDuration           *prometheus.HistogramVec
 }
 
 func registerIngestMetrics() (metrics *IngestMetrics) {
+	metrics = newIngestMetrics()
+	prometheus.MustRegister(metrics.collectors()...)
+	return
+}
+
+// newIngestMetrics constructs, but doesn't register, the ingest metrics.
+func newIngestMetrics() (metrics *IngestMetrics) {
 	// Instrumentation.
 	metrics = new(IngestMetrics)
 	metrics.ConnectedClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -134,13 +153,22 @@ func registerIngestMetrics() (metrics *IngestMetrics) {
 		Name:      "ingest_committed_bytes",
 		Help:      "Bytes successfully consumed and committed.",
 	})
+	metrics.RefusedConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "ingest_refused_connections_total",
+		Help:      "Connections and writes refused because the ingester was overloaded.",
+	})
 	metrics.ApiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "oklog",
 		Name:      "api_request_duration_seconds",
 		Help:      "API request duration in seconds.",
 		Buckets:   prometheus.DefBuckets,
 	}, []string{"method", "path", "status_code"})
-	prometheus.MustRegister(
+	return
+}
+
+func (metrics *IngestMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
 		metrics.ConnectedClients,
 		metrics.IngestWriterBytes,
 		metrics.IngestWriterRecords,
@@ -151,9 +179,9 @@ func registerIngestMetrics() (metrics *IngestMetrics) {
 		metrics.FailedSegments,
 		metrics.CommittedSegments,
 		metrics.CommittedBytes,
+		metrics.RefusedConnections,
 		metrics.ApiDuration,
-	)
-	return
+	}
 }
 
 func runIngest(args []string) (err error) {
@@ -193,7 +221,7 @@ func runIngest(args []string) (err error) {
 
 	metrics = registerIngestMetrics()
 	// Parse listener addresses.
-	fastListener, apiListener,
+	fastListener, durableListener, bulkListener, apiListener,
 		apiPort,
 		ingestLog,
 		err := parseListeners(config, logger)
@@ -212,6 +240,7 @@ func runIngest(args []string) (err error) {
 		clusterBindHost, clusterBindPort, // instead of clusterAdvertiseHost, clusterAdvertisePort,
 		config.ClusterPeers,
 		cluster.PeerTypeIngest, apiPort,
+		"", // ingesters hold no replicas, so their zone doesn't matter
 		log.With(logger, "component", "cluster"),
 	); err != nil {
 		return err
@@ -223,11 +252,11 @@ func runIngest(args []string) (err error) {
 	}, func() float64 { return float64(peer.ClusterSize()) }))
 
 	// Execution group.
-	return startIngestGroup(peer, ingestLog, config, metrics, fastListener, apiListener)
+	return startIngestGroup(peer, ingestLog, config, metrics, fastListener, durableListener, bulkListener, apiListener)
 }
 
 func parseListeners(config *IngestConfig, logger log.Logger) (
-	fastListener, apiListener net.Listener,
+	fastListener, durableListener, bulkListener, apiListener net.Listener,
 	apiPort int,
 	ingestLog ingest.Log,
 	err error) {
@@ -242,11 +271,17 @@ func parseListeners(config *IngestConfig, logger log.Logger) (
 		return
 	}
 
-	// Bind listeners.
+	// Bind listeners. The durable and bulk ones are optional.
 	if fastListener, err = net.Listen(fastNetwork, fastAddress); err != nil {
 		return
 	}
 	level.Info(logger).Log("fast", fmt.Sprintf("%s://%s", fastNetwork, fastAddress))
+	if durableListener, err = listenIfSet(*config.DurableAddr, defaultDurablePort, "durable", logger); err != nil {
+		return
+	}
+	if bulkListener, err = listenIfSet(*config.BulkAddr, defaultBulkPort, "bulk", logger); err != nil {
+		return
+	}
 	if apiListener, err = net.Listen(apiNetwork, apiAddress); err != nil {
 		return
 	}
@@ -265,11 +300,30 @@ func parseListeners(config *IngestConfig, logger log.Logger) (
 	return
 }
 
+// listenIfSet binds a listener for the address, or returns nil if it's empty,
+// for listeners that are disabled by default.
+func listenIfSet(addr string, defaultPort int, name string, logger log.Logger) (net.Listener, error) {
+	if addr == "" {
+		level.Info(logger).Log(name, "disabled")
+		return nil, nil
+	}
+	network, address, _, _, err := parseAddr(addr, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	level.Info(logger).Log(name, fmt.Sprintf("%s://%s", network, address))
+	return ln, nil
+}
+
 // manage goroutine lifecycle
 func startIngestGroup(peer *cluster.Peer,
 	ingestLog ingest.Log,
 	config *IngestConfig, metrics *IngestMetrics,
-	fastListener, apiListener net.Listener,
+	fastListener, durableListener, bulkListener, apiListener net.Listener,
 ) (err error) {
 	var g group.Group
 	{
@@ -281,6 +335,22 @@ func startIngestGroup(peer *cluster.Peer,
 			close(cancel)
 		})
 	}
+	load := ingest.NewLoadMonitor(ingestLog, *config.MaxBacklog, peer.SetLoad, metrics.RefusedConnections)
+	{
+		fastListener = load.Listener(fastListener, true)
+		if durableListener != nil {
+			durableListener = load.Listener(durableListener, false)
+		}
+		if bulkListener != nil {
+			bulkListener = load.Listener(bulkListener, true)
+		}
+		g.Add(func() error {
+			load.Run(defaultLoadReportInterval)
+			return nil
+		}, func(error) {
+			load.Stop()
+		})
+	}
 	{
 		g.Add(func() error {
 			return ingest.HandleConnections(
@@ -295,17 +365,50 @@ func startIngestGroup(peer *cluster.Peer,
 		}, func(error) {
 			fastListener.Close()
 		})
+		if durableListener != nil {
+			g.Add(func() error {
+				return ingest.HandleConnections(
+					durableListener,
+					ingest.HandleDurableWriter,
+					ingestLog,
+					*config.SegmentFlushAge, *config.SegmentFlushSize,
+					metrics.ConnectedClients.WithLabelValues("durable"),
+					metrics.IngestWriterBytes, metrics.IngestWriterRecords, metrics.IngestWriterSyncs,
+					metrics.FlushedSegmentAge, metrics.FlushedSegmentSize,
+				)
+			}, func(error) {
+				durableListener.Close()
+			})
+		}
+		if bulkListener != nil {
+			g.Add(func() error {
+				return ingest.HandleConnections(
+					bulkListener,
+					ingest.HandleBulkWriter,
+					ingestLog,
+					*config.SegmentFlushAge, *config.SegmentFlushSize,
+					metrics.ConnectedClients.WithLabelValues("bulk"),
+					metrics.IngestWriterBytes, metrics.IngestWriterRecords, metrics.IngestWriterSyncs,
+					metrics.FlushedSegmentAge, metrics.FlushedSegmentSize,
+				)
+			}, func(error) {
+				bulkListener.Close()
+			})
+		}
 		g.Add(func() error {
 			mux := http.NewServeMux()
-			mux.Handle("/ingest/", http.StripPrefix("/ingest", ingest.NewAPI(
+			mux.Handle("/ingest/", http.StripPrefix("/ingest", load.Handler(ingest.NewAPI(
 				peer,
 				ingestLog,
 				*config.SegmentPendingTimeout,
+				*config.SegmentFlushAge, *config.SegmentFlushSize,
 				metrics.FailedSegments,
 				metrics.CommittedSegments,
 				metrics.CommittedBytes,
+				metrics.IngestWriterBytes, metrics.IngestWriterRecords, metrics.IngestWriterSyncs,
+				metrics.FlushedSegmentAge, metrics.FlushedSegmentSize,
 				metrics.ApiDuration,
-			)))
+			))))
 			registerMetrics(mux)
 			registerProfile(mux)
 			return http.Serve(apiListener, cors.Default().Handler(mux))
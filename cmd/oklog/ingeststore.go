@@ -0,0 +1,507 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/cors"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/fs"
+	"github.com/1046102779/oklog/pkg/group"
+	"github.com/1046102779/oklog/pkg/ingest"
+	"github.com/1046102779/oklog/pkg/store"
+	"github.com/1046102779/oklog/pkg/ui"
+)
+
+// +-1----------------+   +-2----------+   +-1----------+ +-1---------+ +-1----+
+// | Fast listener    |<--| Write      |-->| ingest.Log | | store.Log | | Peer |
+// +------------------+   | handler    |   +------------+ +-----------+ +------+
+// +-1----------------+   |            |
+// | Durable listener |<--|            |
+// +------------------+   |            |
+// +-1----------------+   |            |
+// | Bulk listener    |<--|            |
+// +------------------+   +------------+
+// +-1----------------+
+// | API listener     |   +-2----------+
+// |                  |<--| Ingest API |
+// |                  |   +------------+
+// |                  |   +-2----------+
+// |                  |<--| Store API  |
+// +------------------+   +------------+
+//                        +-2----------+
+//                        | Compacter  |
+//                        +------------+
+//                        +-2----------+
+//                        | Consumer   |
+//                        +------------+
+//                        +-2----------+
+//                        | Scrubber   |
+//                        +------------+
+//                        +-2----------+
+//                        | Repairer   |
+//                        +------------+
+
+// IngestStoreConfig is the union of the ingest and store configuration.
+type IngestStoreConfig struct {
+	Debug                    *bool          `json:"debug"`
+	MonitorApiAddr           *string        `json:"api_addr"`
+	FastAddr                 *string        `json:"fast_addr"`
+	DurableAddr              *string        `json:"durable_addr"`
+	BulkAddr                 *string        `json:"bulk_addr"`
+	ClusterBindAddr          *string        `json:"cluster_bind_addr"`
+	Zone                     *string        `json:"zone"`
+	Filesystem               *string        `json:"filesystem"`
+	IngestPath               *string        `json:"ingest_path"`
+	SegmentFlushSize         *int           `json:"segment_flush_size"`
+	SegmentFlushAge          *time.Duration `json:"segment_flush_age"`
+	SegmentPendingTimeout    *time.Duration `json:"segment_pending_timeout"`
+	MaxBacklog               *int64         `json:"max_backlog"`
+	StorePath                *string        `json:"store_path"`
+	SegmentConsumers         *int           `json:"segment_consumers"`
+	SegmentTargetSize        *int64         `json:"segment_target_size"`
+	SegmentTargetAge         *time.Duration `json:"segment_target_age"`
+	SegmentBufferSize        *int64         `json:"segment_buffer_size"`
+	SegmentReplicationFactor *int           `json:"segment_replication_factor"`
+	ReplicationTimeout       *time.Duration `json:"segment_replication_timeout"`
+	SegmentRetain            *time.Duration `json:"segment_retain"`
+	SegmentPurge             *time.Duration `json:"segment_purge"`
+	SegmentCompress          *bool          `json:"segment_compress"`
+	ScrubRate                *int64         `json:"scrub_rate"`
+	ScrubInterval            *time.Duration `json:"scrub_interval"`
+	ScrubQuarantine          *bool          `json:"scrub_quarantine"`
+	ScrubSort                *bool          `json:"scrub_sort"`
+	RepairInterval           *time.Duration `json:"repair_interval"`
+	RingBucket               *time.Duration `json:"ring_bucket"`
+	UiLocal                  *bool          `json:"ui_local"`
+	ClusterPeers             stringslice    `json:"cluster_peers"`
+}
+
+func parseIngestStoreParams(args []string) (config *IngestStoreConfig, err error) {
+	flagset := flag.NewFlagSet("ingeststore", flag.ExitOnError)
+	config = &IngestStoreConfig{
+		Debug:                    flagset.Bool("debug", false, "debug logging"),
+		MonitorApiAddr:           flagset.String("api", defaultAPIAddr, "listen address for ingest and store APIs"),
+		FastAddr:                 flagset.String("ingest.fast", defaultFastAddr, "listen address for fast (async) writes"),
+		DurableAddr:              flagset.String("ingest.durable", "", fmt.Sprintf("listen address for durable (sync) writes, e.g. %s (empty to disable)", defaultDurableAddr)),
+		BulkAddr:                 flagset.String("ingest.bulk", "", fmt.Sprintf("listen address for bulk (whole-segment) writes, e.g. %s (empty to disable)", defaultBulkAddr)),
+		ClusterBindAddr:          flagset.String("cluster", defaultClusterAddr, "listen address for cluster"),
+		Zone:                     flagset.String("zone", "", "failure domain of this node, like a rack or availability zone; replicas are spread across zones"),
+		Filesystem:               flagset.String("filesystem", defaultFilesystem, "real, virtual, nop"),
+		IngestPath:               flagset.String("ingest.path", defaultIngestPath, "path holding segment files for ingest tier"),
+		SegmentFlushSize:         flagset.Int("ingest.segment-flush-size", defaultIngestSegmentFlushSize, "flush segments after they grow to this size"),
+		SegmentFlushAge:          flagset.Duration("ingest.segment-flush-age", defaultIngestSegmentFlushAge, "flush segments after they are active for this long"),
+		SegmentPendingTimeout:    flagset.Duration("ingest.segment-pending-timeout", defaultIngestSegmentPendingTimeout, "claimed but uncommitted pending segments are failed after this long"),
+		MaxBacklog:               flagset.Int64("ingest.max-backlog", 0, "refuse new fast and bulk connections, and API writes, while this many bytes await the store tier (0 for no limit)"),
+		StorePath:                flagset.String("store.path", defaultStorePath, "path holding segment files for storage tier"),
+		SegmentConsumers:         flagset.Int("store.segment-consumers", defaultStoreSegmentConsumers, "concurrent segment consumers"),
+		SegmentTargetSize:        flagset.Int64("store.segment-target-size", defaultStoreSegmentTargetSize, "try to keep store segments about this size"),
+		SegmentTargetAge:         flagset.Duration("store.segment-target-age", defaultStoreSegmentTargetAge, "replicate once the aggregate segment is this old"),
+		SegmentBufferSize:        flagset.Int64("store.segment-buffer-size", defaultStoreSegmentBufferSize, "per-segment in-memory read buffer during queries"),
+		SegmentReplicationFactor: flagset.Int("store.segment-replication-factor", defaultStoreSegmentReplicationFactor, "how many copies of each segment to replicate"),
+		ReplicationTimeout:       flagset.Duration("store.segment-replication-timeout", defaultStoreReplicationTimeout, "give up replicating a segment to a store after this long (0 for no timeout)"),
+		SegmentRetain:            flagset.Duration("store.segment-retain", defaultStoreSegmentRetain, "retention period for segment files"),
+		SegmentPurge:             flagset.Duration("store.segment-purge", defaultStoreSegmentPurge, "purge deleted segment files after this long"),
+		SegmentCompress:          flagset.Bool("store.segment-compress", false, "compress the segments written by compaction"),
+		ScrubRate:                flagset.Int64("store.scrub-rate", defaultStoreScrubRate, "scrub segments at this many bytes per second (0 to disable scrubbing)"),
+		ScrubInterval:            flagset.Duration("store.scrub-interval", defaultStoreScrubInterval, "wait this long between scrubbing passes over all segments"),
+		ScrubQuarantine:          flagset.Bool("store.scrub-quarantine", true, "quarantine the segments that fail scrubbing, rather than only reporting them"),
+		ScrubSort:                flagset.Bool("store.scrub-sort", false, "rewrite segments whose records are out of order, which older versions wrote, rather than only reporting them"),
+		RepairInterval:           flagset.Duration("store.repair-interval", defaultStoreRepairInterval, "re-replicate under-replicated records this often (0 to disable repair)"),
+		RingBucket:               flagset.Duration("store.ring-bucket", 0, "place records on stores by a consistent-hash ring over time buckets this wide, and query only their owners (0 to place them anywhere, and query every store)"),
+		UiLocal:                  flagset.Bool("ui.local", false, "ignore embedded files and go straight to the filesystem"),
+	}
+	flagset.Var(&config.ClusterPeers, "peer", "cluster peer host:port (repeatable)")
+	flagset.Usage = usageFor(flagset, "oklog ingeststore [flags]")
+	if err = flagset.Parse(args); err != nil {
+		return
+	}
+	return
+}
+
+// registerIngestStoreMetrics registers the union of the ingest and store
+// metrics. Both tiers share a single API duration histogram.
+func registerIngestStoreMetrics() (ingestMetrics *IngestMetrics, storeMetrics *StoreMetrics) {
+	ingestMetrics, storeMetrics = newIngestMetrics(), newStoreMetrics()
+	storeMetrics.ApiDuration = ingestMetrics.ApiDuration
+	prometheus.MustRegister(ingestMetrics.collectors()...)
+	for _, c := range storeMetrics.collectors() {
+		if c == prometheus.Collector(storeMetrics.ApiDuration) {
+			continue // already registered
+		}
+		prometheus.MustRegister(c)
+	}
+	return
+}
+
+func runIngestStore(args []string) (err error) {
+	var (
+		config        *IngestStoreConfig
+		ingestMetrics *IngestMetrics
+		storeMetrics  *StoreMetrics
+	)
+	if config, err = parseIngestStoreParams(args); err != nil {
+		return
+	}
+
+	// Logging.
+	var logger log.Logger
+	{
+		logLevel := level.AllowInfo()
+		if *config.Debug {
+			logLevel = level.AllowAll()
+		}
+		logger = log.NewLogfmtLogger(os.Stderr)
+		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = level.NewFilter(logger, logLevel)
+	}
+
+	ingestMetrics, storeMetrics = registerIngestStoreMetrics()
+
+	// Parse URLs for listeners.
+	fastNetwork, fastAddress, _, _, err := parseAddr(*config.FastAddr, defaultFastPort)
+	if err != nil {
+		return err
+	}
+	apiNetwork, apiAddress, _, apiPort, err := parseAddr(*config.MonitorApiAddr, defaultAPIPort)
+	if err != nil {
+		return err
+	}
+	_, _, clusterBindHost, clusterBindPort, err := parseAddr(*config.ClusterBindAddr, defaultClusterPort)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("cluster_bind", fmt.Sprintf("%s:%d", clusterBindHost, clusterBindPort))
+
+	// Bind listeners. The durable and bulk ones are optional.
+	fastListener, err := net.Listen(fastNetwork, fastAddress)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("fast", fmt.Sprintf("%s://%s", fastNetwork, fastAddress))
+	durableListener, err := listenIfSet(*config.DurableAddr, defaultDurablePort, "durable", logger)
+	if err != nil {
+		return err
+	}
+	bulkListener, err := listenIfSet(*config.BulkAddr, defaultBulkPort, "bulk", logger)
+	if err != nil {
+		return err
+	}
+	apiListener, err := net.Listen(apiNetwork, apiAddress)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("API", fmt.Sprintf("%s://%s", apiNetwork, apiAddress))
+
+	// Create ingest and store logs.
+	filesys, err := newFilesystem(*config.Filesystem)
+	if err != nil {
+		return err
+	}
+	ingestLog, err := ingest.NewFileLog(filesys, *config.IngestPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := ingestLog.Close(); err != nil {
+			level.Error(logger).Log("err", err)
+		}
+	}()
+	level.Info(logger).Log("ingest_path", *config.IngestPath)
+	storeLog, err := store.NewFileLog(
+		filesys,
+		*config.StorePath,
+		*config.SegmentTargetSize, *config.SegmentBufferSize,
+		store.LogReporter{Logger: log.With(logger, "component", "FileLog")},
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := storeLog.Close(); err != nil {
+			level.Error(logger).Log("err", err)
+		}
+	}()
+	level.Info(logger).Log("store_path", *config.StorePath)
+
+	// Create peer.
+	peer, err := cluster.NewPeer(
+		clusterBindHost, clusterBindPort,
+		clusterBindHost, clusterBindPort,
+		config.ClusterPeers,
+		cluster.PeerTypeIngestStore, apiPort,
+		*config.Zone,
+		log.With(logger, "component", "cluster"),
+	)
+	if err != nil {
+		return err
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "oklog",
+		Name:      "cluster_size",
+		Help:      "Number of peers in the cluster from this node's perspective.",
+	}, func() float64 { return float64(peer.ClusterSize()) }))
+
+	return startIngestStoreGroup(peer, filesys, ingestLog, storeLog, config, ingestMetrics, storeMetrics, fastListener, durableListener, bulkListener, apiListener, logger)
+}
+
+func startIngestStoreGroup(peer *cluster.Peer,
+	filesys fs.Filesystem,
+	ingestLog ingest.Log, storeLog store.Log,
+	config *IngestStoreConfig,
+	ingestMetrics *IngestMetrics, storeMetrics *StoreMetrics,
+	fastListener, durableListener, bulkListener, apiListener net.Listener,
+	logger log.Logger,
+) error {
+	g := ingestStoreGroup(peer, filesys, ingestLog, storeLog, config, ingestMetrics, storeMetrics, fastListener, durableListener, bulkListener, apiListener, logger)
+	{
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			return interrupt(cancel)
+		}, func(error) {
+			close(cancel)
+		})
+	}
+	return g.Run()
+}
+
+// ingestStoreGroup wires every ingest and store component into one execution
+// group. The caller decides how the group is interrupted.
+func ingestStoreGroup(peer *cluster.Peer,
+	filesys fs.Filesystem,
+	ingestLog ingest.Log, storeLog store.Log,
+	config *IngestStoreConfig,
+	ingestMetrics *IngestMetrics, storeMetrics *StoreMetrics,
+	fastListener, durableListener, bulkListener, apiListener net.Listener,
+	logger log.Logger,
+) *group.Group {
+	// Create the HTTP clients we'll use for various purposes.
+	unlimitedClient := http.DefaultClient // no timeouts, be careful
+	timeoutClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 5 * time.Second,
+			Dial: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			DisableKeepAlives:   false,
+			MaxIdleConnsPerHost: 1,
+		},
+	}
+
+	// Execution group.
+	var g group.Group
+	{
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			<-cancel
+			return peer.Leave(time.Second)
+		}, func(error) {
+			close(cancel)
+		})
+	}
+	load := ingest.NewLoadMonitor(ingestLog, *config.MaxBacklog, peer.SetLoad, ingestMetrics.RefusedConnections)
+	{
+		fastListener = load.Listener(fastListener, true)
+		if durableListener != nil {
+			durableListener = load.Listener(durableListener, false)
+		}
+		if bulkListener != nil {
+			bulkListener = load.Listener(bulkListener, true)
+		}
+		g.Add(func() error {
+			load.Run(defaultLoadReportInterval)
+			return nil
+		}, func(error) {
+			load.Stop()
+		})
+	}
+	{
+		g.Add(func() error {
+			return ingest.HandleConnections(
+				fastListener,
+				ingest.HandleFastWriter,
+				ingestLog,
+				*config.SegmentFlushAge, *config.SegmentFlushSize,
+				ingestMetrics.ConnectedClients.WithLabelValues("fast"),
+				ingestMetrics.IngestWriterBytes, ingestMetrics.IngestWriterRecords, ingestMetrics.IngestWriterSyncs,
+				ingestMetrics.FlushedSegmentAge, ingestMetrics.FlushedSegmentSize,
+			)
+		}, func(error) {
+			fastListener.Close()
+		})
+		if durableListener != nil {
+			g.Add(func() error {
+				return ingest.HandleConnections(
+					durableListener,
+					ingest.HandleDurableWriter,
+					ingestLog,
+					*config.SegmentFlushAge, *config.SegmentFlushSize,
+					ingestMetrics.ConnectedClients.WithLabelValues("durable"),
+					ingestMetrics.IngestWriterBytes, ingestMetrics.IngestWriterRecords, ingestMetrics.IngestWriterSyncs,
+					ingestMetrics.FlushedSegmentAge, ingestMetrics.FlushedSegmentSize,
+				)
+			}, func(error) {
+				durableListener.Close()
+			})
+		}
+		if bulkListener != nil {
+			g.Add(func() error {
+				return ingest.HandleConnections(
+					bulkListener,
+					ingest.HandleBulkWriter,
+					ingestLog,
+					*config.SegmentFlushAge, *config.SegmentFlushSize,
+					ingestMetrics.ConnectedClients.WithLabelValues("bulk"),
+					ingestMetrics.IngestWriterBytes, ingestMetrics.IngestWriterRecords, ingestMetrics.IngestWriterSyncs,
+					ingestMetrics.FlushedSegmentAge, ingestMetrics.FlushedSegmentSize,
+				)
+			}, func(error) {
+				bulkListener.Close()
+			})
+		}
+	}
+	var ring *store.Ring // nil places records anywhere
+	if *config.RingBucket > 0 {
+		ring = store.NewRing(*config.RingBucket, *config.SegmentReplicationFactor)
+	}
+	peer.SetRingBucket(ring.Width()) // so the others can check that we agree
+	for i := 0; i < *config.SegmentConsumers; i++ {
+		c := store.NewConsumer(
+			peer,
+			timeoutClient,
+			filesys,
+			filepath.Join(*config.StorePath, fmt.Sprintf("consumer-%d.spool", i)),
+			*config.SegmentTargetSize,
+			*config.SegmentTargetAge,
+			*config.SegmentReplicationFactor,
+			*config.ReplicationTimeout,
+			ring,
+			storeMetrics.ConsumedSegments,
+			storeMetrics.ConsumedBytes,
+			storeMetrics.ReplicatedSegments.WithLabelValues("egress"),
+			storeMetrics.ReplicatedBytes.WithLabelValues("egress"),
+			storeMetrics.ReplicationDuration,
+			storeMetrics.ReplicationRetries,
+			store.LogReporter{Logger: log.With(logger, "component", "Consumer")},
+		)
+		g.Add(func() error {
+			c.Run()
+			return nil
+		}, func(error) {
+			c.Stop()
+		})
+	}
+	{
+		c := store.NewCompacter(
+			storeLog,
+			*config.SegmentTargetSize,
+			*config.SegmentRetain,
+			*config.SegmentPurge,
+			*config.SegmentCompress,
+			storeMetrics.CompactDuration,
+			storeMetrics.TrashedSegments,
+			storeMetrics.PurgedSegments,
+			store.LogReporter{Logger: log.With(logger, "component", "Compacter")},
+		)
+		g.Add(func() error {
+			c.Run()
+			return nil
+		}, func(error) {
+			c.Stop()
+		})
+	}
+	if *config.ScrubRate > 0 {
+		s := store.NewScrubber(
+			storeLog,
+			*config.ScrubRate,
+			*config.ScrubInterval,
+			*config.ScrubQuarantine,
+			*config.ScrubSort,
+			storeMetrics.ScrubbedSegments,
+			storeMetrics.ScrubFailedSegments,
+			store.LogReporter{Logger: log.With(logger, "component", "Scrubber")},
+		)
+		g.Add(func() error {
+			s.Run()
+			return nil
+		}, func(error) {
+			s.Stop()
+		})
+	}
+	if *config.RepairInterval > 0 {
+		r := store.NewRepairer(
+			peer,
+			storeLog,
+			timeoutClient,
+			*config.SegmentTargetSize,
+			*config.SegmentReplicationFactor,
+			ring,
+			*config.RepairInterval,
+			*config.SegmentRetain,
+			storeMetrics.ReplicatedSegments.WithLabelValues("repair"),
+			storeMetrics.ReplicatedBytes.WithLabelValues("repair"),
+			store.LogReporter{Logger: log.With(logger, "component", "Repairer")},
+		)
+		g.Add(func() error {
+			r.Run()
+			return nil
+		}, func(error) {
+			r.Stop()
+		})
+	}
+	{
+		g.Add(func() error {
+			mux := http.NewServeMux()
+			ingestAPI := ingest.NewAPI(
+				peer,
+				ingestLog,
+				*config.SegmentPendingTimeout,
+				*config.SegmentFlushAge, *config.SegmentFlushSize,
+				ingestMetrics.FailedSegments,
+				ingestMetrics.CommittedSegments,
+				ingestMetrics.CommittedBytes,
+				ingestMetrics.IngestWriterBytes, ingestMetrics.IngestWriterRecords, ingestMetrics.IngestWriterSyncs,
+				ingestMetrics.FlushedSegmentAge, ingestMetrics.FlushedSegmentSize,
+				ingestMetrics.ApiDuration,
+			)
+			defer ingestAPI.Stop()
+			storeAPI := store.NewAPI(
+				peer,
+				storeLog,
+				timeoutClient,
+				unlimitedClient,
+				ring,
+				storeMetrics.ReplicatedSegments.WithLabelValues("ingress"),
+				storeMetrics.ReplicatedBytes.WithLabelValues("ingress"),
+				storeMetrics.ApiDuration,
+				store.LogReporter{Logger: log.With(logger, "component", "API")},
+			)
+			defer func() {
+				if err := storeAPI.Close(); err != nil {
+					level.Warn(logger).Log("err", err)
+				}
+			}()
+			mux.Handle("/ingest/", http.StripPrefix("/ingest", load.Handler(ingestAPI)))
+			mux.Handle("/store/", http.StripPrefix("/store", storeAPI))
+			mux.Handle("/ui/", ui.NewAPI(logger, *config.UiLocal))
+			registerMetrics(mux)
+			registerProfile(mux)
+			return http.Serve(apiListener, cors.Default().Handler(mux))
+		}, func(error) {
+			apiListener.Close()
+		})
+	}
+	return &g
+}
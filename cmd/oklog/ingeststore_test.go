@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/ingest"
+	"github.com/1046102779/oklog/pkg/store"
+)
+
+func TestIngestStore(t *testing.T) {
+	config, err := parseIngestStoreParams([]string{
+		"-filesystem", "virtual",
+		"-ingest.segment-flush-age", "100ms",
+		"-store.segment-target-age", "100ms",
+		"-store.segment-replication-factor", "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything lives in memory, on loopback.
+	logger := log.NewNopLogger()
+	filesys, err := newFilesystem(*config.Filesystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingestLog, err := ingest.NewFileLog(filesys, *config.IngestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingestLog.Close()
+	storeLog, err := store.NewFileLog(filesys, *config.StorePath, *config.SegmentTargetSize, *config.SegmentBufferSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storeLog.Close()
+	fastListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	durableListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulkListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterPort := freePort(t)
+	peer, err := cluster.NewPeer(
+		"127.0.0.1", clusterPort,
+		"127.0.0.1", clusterPort,
+		nil,
+		cluster.PeerTypeIngestStore, apiListener.Addr().(*net.TCPAddr).Port,
+		"",
+		logger,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the node until we cancel it.
+	g := ingestStoreGroup(
+		peer, filesys, ingestLog, storeLog, config,
+		newIngestMetrics(), newStoreMetrics(),
+		fastListener, durableListener, bulkListener, apiListener, logger,
+	)
+	var (
+		stop   = make(chan struct{})
+		cancel = make(chan struct{})
+	)
+	g.Add(func() error {
+		select {
+		case <-stop:
+		case <-cancel:
+		}
+		return nil
+	}, func(error) {
+		close(cancel)
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- g.Run() }()
+
+	// Write some records to the fast listener.
+	from := time.Now().Add(-time.Minute)
+	conn, err := net.Dial("tcp", fastListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []string{"alpha", "beta", "gamma"}
+	for _, record := range records {
+		if _, err := fmt.Fprintln(conn, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	// And one more to the durable listener, which should be acknowledged.
+	conn, err = net.Dial("tcp", durableListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = append(records, "delta")
+	fmt.Fprintln(conn, "delta")
+	if ack, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("durable ack: %v", err)
+	} else if _, err := ulid.Parse(strings.TrimSpace(ack)); err != nil {
+		t.Fatalf("durable ack %q: %v", ack, err)
+	}
+	conn.Close()
+
+	// And a batch to the bulk listener, acknowledged as a whole.
+	conn, err = net.Dial("tcp", bulkListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = append(records, "epsilon", "zeta")
+	fmt.Fprint(conn, "epsilon\nzeta\n")
+	conn.(*net.TCPConn).CloseWrite()
+	if ack, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("bulk ack: %v", err)
+	} else if !strings.HasPrefix(ack, "OK 2 ") {
+		t.Fatalf("bulk ack %q", ack)
+	}
+	conn.Close()
+
+	// And one over HTTP.
+	resp, err := http.Post(
+		fmt.Sprintf("http://%s/ingest%s", apiListener.Addr().String(), ingest.APIPathWrite),
+		"text/plain", strings.NewReader("eta\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HTTP write: %s", resp.Status)
+	}
+	records = append(records, "eta")
+
+	// They should flow through the consumer and become queryable.
+	var have string
+	if !within(10*time.Second, func() bool {
+		resp, err := http.Get(fmt.Sprintf(
+			"http://%s/store%s?from=%s&to=%s",
+			apiListener.Addr().String(),
+			store.APIPathUserQuery,
+			url.QueryEscape(from.Format(time.RFC3339)),
+			url.QueryEscape(time.Now().Add(time.Minute).Format(time.RFC3339)),
+		))
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return false
+		}
+		have = string(buf)
+		return strings.Count(have, "\n") >= len(records)
+	}) {
+		t.Fatalf("records never became queryable; have %q", have)
+	}
+	for _, record := range records {
+		if !strings.Contains(have, " "+record+"\n") {
+			t.Errorf("record %q missing from query result %q", record, have)
+		}
+	}
+
+	// Shut it down.
+	close(stop)
+	select {
+	case err := <-errc:
+		t.Logf("ingeststore group terminated (%v)", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for shutdown")
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func within(d time.Duration, f func() bool) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if f() {
+			return true
+		}
+		time.Sleep(d / 50)
+	}
+	return false
+}
@@ -17,6 +17,8 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/1046102779/oklog/pkg/fs"
 )
 
 var version = "dev" // set by release script
@@ -53,6 +55,8 @@ func main() {
 		run = runIngest
 	case "store":
 		run = runStore
+	case "ingeststore":
+		run = runIngestStore
 	case "query":
 		run = runQuery
 	case "stream":
@@ -140,6 +144,19 @@ func parseAddr(addr string, defaultPort int) (network, address, host string, por
 	return u.Scheme, u.Host, host, port, nil
 }
 
+func newFilesystem(name string) (fs.Filesystem, error) {
+	switch strings.ToLower(name) {
+	case "real":
+		return fs.NewRealFilesystem(), nil
+	case "virtual":
+		return fs.NewVirtualFilesystem(), nil
+	case "nop":
+		return fs.NewNopFilesystem(), nil
+	default:
+		return nil, errors.Errorf("invalid -filesystem %q", name)
+	}
+}
+
 func registerMetrics(mux *http.ServeMux) {
 	mux.Handle("/metrics", promhttp.Handler())
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"strings"
 	"testing"
+
+	"github.com/go-kit/kit/log"
 )
 
 func TestStringSlice(t *testing.T) {
@@ -158,3 +160,26 @@ func TestIsUnroutable(t *testing.T) {
 		})
 	}
 }
+
+func TestListenIfSet(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	// Optional listeners are disabled by an empty address.
+	ln, err := listenIfSet("", defaultDurablePort, "durable", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln != nil {
+		ln.Close()
+		t.Fatalf("want no listener, have one on %s", ln.Addr())
+	}
+
+	ln, err = listenIfSet("tcp://127.0.0.1:0", defaultDurablePort, "durable", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln == nil {
+		t.Fatal("want a listener, have none")
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/errors"
@@ -25,11 +27,23 @@ func runQuery(args []string) error {
 		to        = flagset.String("to", "now", "to, as RFC3339 timestamp or duration ago")
 		q         = flagset.String("q", "", "query expression")
 		regex     = flagset.Bool("regex", false, "parse -q as regular expression")
+		lang      = flagset.String("lang", "", "parse -q in this query language: expr (boolean expression)")
+		fields    = flagset.String("fields", "", "comma-separated logfmt or JSON fields to return, instead of whole records")
+		agg       = flagset.String("agg", "", "aggregate instead of returning records: count (per -step)")
+		step      = flagset.Duration("step", time.Minute, "time series step, with -agg count")
+		groupby   = flagset.String("groupby", "", "count records per value of this field, json:field, or regex:capture, and print the most common (implies -agg top)")
+		top       = flagset.Int("top", 20, "how many values to print, with -groupby")
+		limit     = flagset.Int("limit", 0, "return at most this many records; 0 is no limit (-v prints the next page's cursor)")
+		order     = flagset.String("order", "asc", "asc (oldest first) or desc (newest first)")
+		after     = flagset.String("after", "", "return records after this ULID cursor")
+		before    = flagset.String("before", "", "return records before this ULID cursor")
 		stats     = flagset.Bool("stats", false, "statistics only, no records (implies -v)")
 		nocopy    = flagset.Bool("nocopy", false, "don't read the response body")
 		withulid  = flagset.Bool("ulid", false, "include ULID prefix with each record")
 		verbose   = flagset.Bool("v", false, "verbose output to stderr")
 	)
+	var where stringslice
+	flagset.Var(&where, "where", "field predicate, e.g. level=error or json:status>=500 (repeatable)")
 	flagset.Usage = usageFor(flagset, "oklog query [flags]")
 	if err := flagset.Parse(args); err != nil {
 		return err
@@ -84,9 +98,45 @@ func runQuery(args []string) error {
 		method = "HEAD"
 	}
 
-	var asRegex string
+	var extraParams string
 	if *regex {
-		asRegex = "&regex=true"
+		extraParams = "&regex=true"
+	}
+	if *lang != "" {
+		extraParams += "&lang=" + url.QueryEscape(*lang)
+	}
+	for _, w := range where {
+		extraParams += "&where=" + url.QueryEscape(w)
+	}
+	if *fields != "" {
+		extraParams += "&fields=" + url.QueryEscape(*fields)
+	}
+	if *limit > 0 {
+		extraParams += "&limit=" + strconv.Itoa(*limit)
+	}
+	if *order != "asc" {
+		extraParams += "&order=" + url.QueryEscape(*order)
+	}
+	if *after != "" {
+		extraParams += "&after=" + url.QueryEscape(*after)
+	}
+	if *before != "" {
+		extraParams += "&before=" + url.QueryEscape(*before)
+	}
+	if *groupby != "" {
+		if *agg != "" && *agg != store.QueryAggTop {
+			return errors.Errorf("-groupby can't be used with -agg %s", *agg)
+		}
+		*agg = store.QueryAggTop
+	}
+	switch *agg {
+	case "":
+	case store.QueryAggCount:
+		extraParams += "&agg=" + url.QueryEscape(*agg) + "&step=" + url.QueryEscape(step.String())
+	case store.QueryAggTop:
+		extraParams += "&agg=" + url.QueryEscape(*agg) + "&by=" + url.QueryEscape(*groupby) + "&n=" + strconv.Itoa(*top)
+	default:
+		extraParams += "&agg=" + url.QueryEscape(*agg)
 	}
 
 	req, err := http.NewRequest(method, fmt.Sprintf(
@@ -96,7 +146,7 @@ func runQuery(args []string) error {
 		url.QueryEscape(fromStr),
 		url.QueryEscape(toStr),
 		url.QueryEscape(*q),
-		asRegex,
+		extraParams,
 	), nil)
 	if err != nil {
 		return err
@@ -117,7 +167,10 @@ func runQuery(args []string) error {
 	}
 
 	qtype := "normal string"
-	if result.Params.Regex {
+	switch {
+	case result.Params.Lang == store.QueryLangExpr:
+		qtype = "boolean expression"
+	case result.Params.Regex:
 		qtype = "regular expression"
 	}
 
@@ -125,15 +178,43 @@ func runQuery(args []string) error {
 	verbosePrintf("Queried from %s\n", result.Params.From)
 	verbosePrintf("Queried to %s\n", result.Params.To)
 	verbosePrintf("Queried %s %q\n", qtype, result.Params.Q)
+	switch result.Params.Agg {
+	case store.QueryAggCount:
+		verbosePrintf("Aggregated %s per %s\n", result.Params.Agg, result.Params.Step)
+	case store.QueryAggTop:
+		verbosePrintf("Aggregated %s %d by %s\n", result.Params.Agg, result.Params.N, result.Params.By)
+	}
 	verbosePrintf("%d node(s) queried\n", result.NodesQueried)
 	verbosePrintf("%d segment(s) queried\n", result.SegmentsQueried)
+	verbosePrintf("%d segment(s) skipped by bloom filter\n", result.SegmentsSkipped)
 	verbosePrintf("%dB (%dMiB) maximum data set size\n", result.MaxDataSetSize, result.MaxDataSetSize/(1024*1024))
 	verbosePrintf("%d error(s)\n", result.ErrorCount)
 	verbosePrintf("%s server-reported duration\n", result.Duration)
+	if result.Next != "" {
+		cursor := "after"
+		if result.Params.Order == store.QueryOrderDesc {
+			cursor = "before"
+		}
+		verbosePrintf("Next page with -%s %s\n", cursor, result.Next)
+	}
 
 	switch {
 	case *nocopy:
 		break
+	case result.Aggregate != nil && result.Params.Agg == store.QueryAggTop:
+		w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		fmt.Fprintf(w, "VALUE\tCOUNT\n")
+		for _, g := range result.Aggregate.Groups {
+			fmt.Fprintf(w, "%s\t%d\n", g.Value, g.Count)
+		}
+		if result.Aggregate.Other > 0 {
+			fmt.Fprintf(w, "(other)\t%d\n", result.Aggregate.Other)
+		}
+		w.Flush()
+	case result.Aggregate != nil:
+		for _, b := range result.Aggregate.Buckets {
+			fmt.Fprintf(os.Stdout, "%s %d\n", b.From.Format(time.RFC3339), b.Count)
+		}
 	case *withulid:
 		io.Copy(os.Stdout, result.Records)
 	default:
@@ -24,16 +24,23 @@ import (
 //                                    +-1---------+ +-1----+
 //                                    | store.Log | | Peer |
 //                                    +-----------+ +------+
-// +-1------------+   +-2---------+      ^ ^ ^        ^ ^
-// | API listener |<--| Store API |------' | |        | |
-// |              |   |           |-------------------' |
-// +--------------+   +-----------+        | |          |
-//                    +-2---------+        | |          |
-//                    | Compacter |--------' |          |
-//                    +-----------+          |          |
-//                    +-2---------+          |          |
-//                    | Consumer  |----------'          |
-//                    |           |---------------------'
+// +-1------------+   +-2---------+      ^ ^ ^ ^ ^    ^ ^ ^
+// | API listener |<--| Store API |------' | | | |    | | |
+// |              |   |           |-------------------' | |
+// +--------------+   +-----------+        | | | |      | |
+//                    +-2---------+        | | | |      | |
+//                    | Compacter |--------' | | |      | |
+//                    +-----------+          | | |      | |
+//                    +-2---------+          | | |      | |
+//                    | Consumer  |----------' | |      | |
+//                    |           |---------------------' |
+//                    +-----------+            | |        |
+//                    +-2---------+            | |        |
+//                    | Scrubber  |------------' |        |
+//                    +-----------+              |        |
+//                    +-2---------+              |        |
+//                    | Repairer  |--------------'        |
+//                    |           |-----------------------'
 //                    +-----------+
 const (
 	defaultStoreSegmentConsumers         = 1
@@ -41,8 +48,12 @@ const (
 	defaultStoreSegmentTargetAge         = 3 * time.Second
 	defaultStoreSegmentBufferSize        = 1024 * 1024
 	defaultStoreSegmentReplicationFactor = 2
+	defaultStoreReplicationTimeout       = 10 * time.Second
 	defaultStoreSegmentRetain            = 7 * 24 * time.Hour
 	defaultStoreSegmentPurge             = 24 * time.Hour
+	defaultStoreScrubRate                = 4 * 1024 * 1024
+	defaultStoreScrubInterval            = 24 * time.Hour
+	defaultStoreRepairInterval           = 10 * time.Minute
 )
 
 var (
@@ -53,15 +64,24 @@ type StoreConfig struct {
 	Debug                    *bool          `json:"debug"`
 	MonitorApiAddr           *string        `json:"api_addr"`
 	ClusterBindAddr          *string        `json:"cluster_bind_addr"`
+	Zone                     *string        `json:"zone"`
 	StorePath                *string        `json:"store_path"`
 	SegmentConsumers         *int           `json:"segment_consumers"`
 	SegmentTargetSize        *int64         `json:"segment_target_size"`
 	SegmentTargetAge         *time.Duration `json:"segment_target_age"`
 	SegmentBufferSize        *int64         `json:"segment_buffer_size"`
 	SegmentReplicationFactor *int           `json:"segment_replication_tactor"`
+	ReplicationTimeout       *time.Duration `json:"segment_replication_timeout"`
 	SegmentRetain            *time.Duration `json:"segment_retain"`
 	SegmentPurge             *time.Duration `json:"segment_purge"`
-	UiLocal                  *bool          `json:"segment_purge"`
+	SegmentCompress          *bool          `json:"segment_compress"`
+	ScrubRate                *int64         `json:"scrub_rate"`
+	ScrubInterval            *time.Duration `json:"scrub_interval"`
+	ScrubQuarantine          *bool          `json:"scrub_quarantine"`
+	ScrubSort                *bool          `json:"scrub_sort"`
+	RepairInterval           *time.Duration `json:"repair_interval"`
+	RingBucket               *time.Duration `json:"ring_bucket"`
+	UiLocal                  *bool          `json:"ui_local"`
 	ClusterPeers             stringslice    `json:"cluster_peers"`
 }
 
@@ -71,14 +91,23 @@ func parseStoreInputParams(args []string) (config *StoreConfig, err error) {
 		Debug:                    flagset.Bool("debug", false, "debug logging"),
 		MonitorApiAddr:           flagset.String("api", defaultAPIAddr, "listen address for store API"),
 		ClusterBindAddr:          flagset.String("cluster", defaultClusterAddr, "listen address for cluster"),
+		Zone:                     flagset.String("zone", "", "failure domain of this node, like a rack or availability zone; replicas are spread across zones"),
 		StorePath:                flagset.String("store.path", defaultStorePath, "path holding segment files for storage tier"),
 		SegmentConsumers:         flagset.Int("store.segment-consumers", defaultStoreSegmentConsumers, "concurrent segment consumers"),
 		SegmentTargetSize:        flagset.Int64("store.segment-target-size", defaultStoreSegmentTargetSize, "try to keep store segments about this size"),
 		SegmentTargetAge:         flagset.Duration("store.segment-target-age", defaultStoreSegmentTargetAge, "replicate once the aggregate segment is this old"),
 		SegmentBufferSize:        flagset.Int64("store.segment-buffer-size", defaultStoreSegmentBufferSize, "per-segment in-memory read buffer during queries"),
 		SegmentReplicationFactor: flagset.Int("store.segment-replication-factor", defaultStoreSegmentReplicationFactor, "how many copies of each segment to replicate"),
+		ReplicationTimeout:       flagset.Duration("store.segment-replication-timeout", defaultStoreReplicationTimeout, "give up replicating a segment to a store after this long (0 for no timeout)"),
 		SegmentRetain:            flagset.Duration("store.segment-retain", defaultStoreSegmentRetain, "retention period for segment files"),
 		SegmentPurge:             flagset.Duration("store.segment-purge", defaultStoreSegmentPurge, "purge deleted segment files after this long"),
+		SegmentCompress:          flagset.Bool("store.segment-compress", false, "compress the segments written by compaction"),
+		ScrubRate:                flagset.Int64("store.scrub-rate", defaultStoreScrubRate, "scrub segments at this many bytes per second (0 to disable scrubbing)"),
+		ScrubInterval:            flagset.Duration("store.scrub-interval", defaultStoreScrubInterval, "wait this long between scrubbing passes over all segments"),
+		ScrubQuarantine:          flagset.Bool("store.scrub-quarantine", true, "quarantine the segments that fail scrubbing, rather than only reporting them"),
+		ScrubSort:                flagset.Bool("store.scrub-sort", false, "rewrite segments whose records are out of order, which older versions wrote, rather than only reporting them"),
+		RepairInterval:           flagset.Duration("store.repair-interval", defaultStoreRepairInterval, "re-replicate under-replicated records this often (0 to disable repair)"),
+		RingBucket:               flagset.Duration("store.ring-bucket", 0, "place records on stores by a consistent-hash ring over time buckets this wide, and query only their owners (0 to place them anywhere, and query every store)"),
 		UiLocal:                  flagset.Bool("ui.local", false, "ignore embedded files and go straight to the filesystem"),
 	}
 	flagset.Var(&config.ClusterPeers, "peer", "cluster peer host:port (repeatable)")
@@ -90,17 +119,28 @@ func parseStoreInputParams(args []string) (config *StoreConfig, err error) {
 }
 
 type StoreMetrics struct {
-	ApiDuration        *prometheus.HistogramVec
-	CompactDuration    *prometheus.HistogramVec
-	ConsumedSegments   prometheus.Counter
-	ConsumedBytes      prometheus.Counter
-	ReplicatedSegments *prometheus.CounterVec
-	ReplicatedBytes    *prometheus.CounterVec
-	TrashedSegments    *prometheus.CounterVec
-	PurgedSegments     *prometheus.CounterVec
+	ApiDuration         *prometheus.HistogramVec
+	CompactDuration     *prometheus.HistogramVec
+	ConsumedSegments    prometheus.Counter
+	ConsumedBytes       prometheus.Counter
+	ReplicatedSegments  *prometheus.CounterVec
+	ReplicatedBytes     *prometheus.CounterVec
+	ReplicationDuration *prometheus.HistogramVec
+	ReplicationRetries  prometheus.Counter
+	TrashedSegments     *prometheus.CounterVec
+	PurgedSegments      *prometheus.CounterVec
+	ScrubbedSegments    prometheus.Counter
+	ScrubFailedSegments prometheus.Counter
 }
 
 func registerStoreMetrics() (metrics *StoreMetrics) {
+	metrics = newStoreMetrics()
+	prometheus.MustRegister(metrics.collectors()...)
+	return
+}
+
+// newStoreMetrics constructs, but doesn't register, the store metrics.
+func newStoreMetrics() (metrics *StoreMetrics) {
 	metrics = new(StoreMetrics)
 	// Instrumentation.
 	metrics.ApiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -128,13 +168,24 @@ func registerStoreMetrics() (metrics *StoreMetrics) {
 	metrics.ReplicatedSegments = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "oklog",
 		Name:      "store_replicated_segments",
-		Help:      "Segments replicated, by direction i.e. ingress or egress.",
+		Help:      "Segments replicated, by direction i.e. ingress, egress, or repair.",
 	}, []string{"direction"})
 	metrics.ReplicatedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "oklog",
 		Name:      "store_replicated_bytes",
-		Help:      "Segments replicated, by direction i.e. ingress or egress.",
+		Help:      "Bytes replicated, by direction i.e. ingress, egress, or repair.",
 	}, []string{"direction"})
+	metrics.ReplicationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oklog",
+		Name:      "store_replication_duration_seconds",
+		Help:      "Duration of each replication of a segment to a store in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+	metrics.ReplicationRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "store_replication_retries",
+		Help:      "Retries of replications that reached too few stores.",
+	})
 	metrics.TrashedSegments = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "oklog",
 		Name:      "store_trashed_segments",
@@ -145,17 +196,34 @@ func registerStoreMetrics() (metrics *StoreMetrics) {
 		Name:      "store_purged_segments",
 		Help:      "Segments purged from trash.",
 	}, []string{"success"})
-	prometheus.MustRegister(
+	metrics.ScrubbedSegments = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "store_scrubbed_segments",
+		Help:      "Segments scrubbed, i.e. read whole and checked.",
+	})
+	metrics.ScrubFailedSegments = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oklog",
+		Name:      "store_scrub_failed_segments",
+		Help:      "Segments found corrupt by scrubbing.",
+	})
+	return
+}
+
+func (metrics *StoreMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
 		metrics.ApiDuration,
 		metrics.CompactDuration,
 		metrics.ConsumedSegments,
 		metrics.ConsumedBytes,
 		metrics.ReplicatedSegments,
 		metrics.ReplicatedBytes,
+		metrics.ReplicationDuration,
+		metrics.ReplicationRetries,
 		metrics.TrashedSegments,
 		metrics.PurgedSegments,
-	)
-	return
+		metrics.ScrubbedSegments,
+		metrics.ScrubFailedSegments,
+	}
 }
 
 func runStore(args []string) (err error) {
@@ -220,6 +288,7 @@ func runStore(args []string) (err error) {
 		clusterBindHost, clusterBindPort, // instead of clusterAdvertiserHost&Port
 		config.ClusterPeers,
 		cluster.PeerTypeStore, apiPort,
+		*config.Zone,
 		log.With(logger, "component", "cluster"),
 	)
 	if err != nil {
@@ -266,17 +335,28 @@ func startStoreGroup(peer *cluster.Peer,
 			close(cancel)
 		})
 	}
+	var ring *store.Ring // nil places records anywhere
+	if *config.RingBucket > 0 {
+		ring = store.NewRing(*config.RingBucket, *config.SegmentReplicationFactor)
+	}
+	peer.SetRingBucket(ring.Width()) // so the others can check that we agree
 	for i := 0; i < *config.SegmentConsumers; i++ {
 		c := store.NewConsumer(
 			peer,
 			timeoutClient,
+			fs.NewRealFilesystem(),
+			filepath.Join(*config.StorePath, fmt.Sprintf("consumer-%d.spool", i)),
 			*config.SegmentTargetSize,
 			*config.SegmentTargetAge,
 			*config.SegmentReplicationFactor,
+			*config.ReplicationTimeout,
+			ring,
 			metrics.ConsumedSegments,
 			metrics.ConsumedBytes,
 			metrics.ReplicatedSegments.WithLabelValues("egress"),
 			metrics.ReplicatedBytes.WithLabelValues("egress"),
+			metrics.ReplicationDuration,
+			metrics.ReplicationRetries,
 			store.LogReporter{Logger: log.With(logger, "component", "Consumer")},
 		)
 		g.Add(func() error {
@@ -292,6 +372,7 @@ func startStoreGroup(peer *cluster.Peer,
 			*config.SegmentTargetSize,
 			*config.SegmentRetain,
 			*config.SegmentPurge,
+			*config.SegmentCompress,
 			metrics.CompactDuration,
 			metrics.TrashedSegments,
 			metrics.PurgedSegments,
@@ -304,6 +385,45 @@ func startStoreGroup(peer *cluster.Peer,
 			c.Stop()
 		})
 	}
+	if *config.ScrubRate > 0 {
+		s := store.NewScrubber(
+			storeLog,
+			*config.ScrubRate,
+			*config.ScrubInterval,
+			*config.ScrubQuarantine,
+			*config.ScrubSort,
+			metrics.ScrubbedSegments,
+			metrics.ScrubFailedSegments,
+			store.LogReporter{Logger: log.With(logger, "component", "Scrubber")},
+		)
+		g.Add(func() error {
+			s.Run()
+			return nil
+		}, func(error) {
+			s.Stop()
+		})
+	}
+	if *config.RepairInterval > 0 {
+		r := store.NewRepairer(
+			peer,
+			storeLog,
+			timeoutClient,
+			*config.SegmentTargetSize,
+			*config.SegmentReplicationFactor,
+			ring,
+			*config.RepairInterval,
+			*config.SegmentRetain,
+			metrics.ReplicatedSegments.WithLabelValues("repair"),
+			metrics.ReplicatedBytes.WithLabelValues("repair"),
+			store.LogReporter{Logger: log.With(logger, "component", "Repairer")},
+		)
+		g.Add(func() error {
+			r.Run()
+			return nil
+		}, func(error) {
+			r.Stop()
+		})
+	}
 	{
 		g.Add(func() error {
 			mux := http.NewServeMux()
@@ -312,6 +432,7 @@ func startStoreGroup(peer *cluster.Peer,
 				storeLog,
 				timeoutClient,
 				unlimitedClient,
+				ring,
 				metrics.ReplicatedSegments.WithLabelValues("ingress"),
 				metrics.ReplicatedBytes.WithLabelValues("ingress"),
 				metrics.ApiDuration,
@@ -21,9 +21,12 @@ func runStream(args []string) error {
 		storeAddr = flagset.String("store", "localhost:7650", "address of store instance to query")
 		q         = flagset.String("q", "", "query expression")
 		regex     = flagset.Bool("regex", false, "parse -q as regular expression")
+		lang      = flagset.String("lang", "", "parse -q in this query language: expr (boolean expression)")
 		window    = flagset.Duration("window", 3*time.Second, "deduplication window")
 		withulid  = flagset.Bool("ulid", false, "include ULID prefix with each record")
 	)
+	var where stringslice
+	flagset.Var(&where, "where", "field predicate, e.g. level=error or json:status>=500 (repeatable)")
 	flagset.Usage = usageFor(flagset, "oklog stream [flags]")
 	if err := flagset.Parse(args); err != nil {
 		return err
@@ -34,9 +37,15 @@ func runStream(args []string) error {
 		return errors.Wrap(err, "couldn't parse -store")
 	}
 
-	var asRegex string
+	var extraParams string
 	if *regex {
-		asRegex = "&regex=true"
+		extraParams = "&regex=true"
+	}
+	if *lang != "" {
+		extraParams += "&lang=" + url.QueryEscape(*lang)
+	}
+	for _, w := range where {
+		extraParams += "&where=" + url.QueryEscape(w)
 	}
 
 	var offset = ulid.EncodedSize + 1
@@ -50,7 +59,7 @@ func runStream(args []string) error {
 		store.APIPathUserStream,
 		url.QueryEscape(*q),
 		url.QueryEscape(window.String()),
-		asRegex,
+		extraParams,
 	), nil)
 	if err != nil {
 		return err
@@ -2,8 +2,8 @@
 //
 // Ingest and store instances join the same cluster and know about each other.
 // Store instances consume segments from each ingest instance, and broadcast
-// queries to each store instance. In the future, ingest instances will share
-// load information to potentially refuse connections and balance writes.
+// queries to each store instance. Ingest instances share load information, so
+// forwarders can balance writes among them.
 package cluster
 
 import (
@@ -26,6 +26,9 @@ import (
 type Peer struct {
 	ml *memberlist.Memberlist
 	d  *delegate
+
+	mtx       sync.RWMutex
+	placement *Placement // the most recent
 }
 
 // PeerType enumerates the types of nodes in the cluster.
@@ -40,11 +43,16 @@ const (
 
 	// PeerTypeIngestStore serves both ingest and store APIs.
 	PeerTypeIngestStore = "ingeststore"
+
+	// PeerTypeForward serves no API. Forwarders join the cluster only to
+	// discover the current set of ingest nodes.
+	PeerTypeForward = "forward"
 )
 
 // NewPeer creates or joins a cluster with the existing peers.
 // We will listen for cluster communications on the bind addr:port.
-// We advertise a PeerType HTTP API, reachable on apiPort.
+// We advertise a PeerType HTTP API, reachable on apiPort, in the given zone,
+// which may be empty.
 //
 // If advertiseAddr is not empty, we will advertise ourself as reachable for
 // cluster communications on that address; otherwise, memberlist will extract
@@ -54,6 +62,7 @@ func NewPeer(
 	advertiseAddr string, advertisePort int,
 	existing []string,
 	t PeerType, apiPort int,
+	zone string,
 	logger log.Logger,
 ) (*Peer, error) {
 	level.Debug(logger).Log("bind_addr", bindAddr, "bind_port", bindPort, "ParseIP", net.ParseIP(bindAddr).String())
@@ -78,7 +87,7 @@ func NewPeer(
 		return nil, err
 	}
 
-	d.init(config.Name, t, ml.LocalNode().Addr.String(), apiPort, ml.NumMembers)
+	d.init(config.Name, t, ml.LocalNode().Addr.String(), apiPort, zone, ml.NumMembers)
 	n, _ := ml.Join(existing)
 	level.Debug(logger).Log("Join", n)
 
@@ -109,6 +118,51 @@ func (p *Peer) Current(t PeerType) []string {
 	return p.d.current(t)
 }
 
+// SetLoad records the load on this node, and gossips it to the cluster.
+func (p *Peer) SetLoad(load Load) {
+	p.d.setLoad(p.Name(), load)
+}
+
+// Loads returns the most recent load reported by each node of the given type,
+// keyed by API host:port. Nodes that haven't reported a load are omitted.
+func (p *Peer) Loads(t PeerType) map[string]Load {
+	return p.d.loads(t)
+}
+
+// Zones returns the zone of each node of the given type, keyed by API
+// host:port. Nodes without a zone have an empty one.
+func (p *Peer) Zones(t PeerType) map[string]string {
+	return p.d.zones(t)
+}
+
+// SetRingBucket records the width of the time buckets of the ring this node
+// places records by, or zero without one, and gossips it to the cluster.
+func (p *Peer) SetRingBucket(width time.Duration) {
+	p.d.update(p.Name(), func(info *peerInfo) { info.RingBucket = width })
+}
+
+// RingBuckets returns the ring bucket width of each node of the given type,
+// keyed by API host:port. Nodes without a ring, or that haven't said yet, have
+// zero.
+func (p *Peer) RingBuckets(t PeerType) map[string]time.Duration {
+	return p.d.ringBuckets(t)
+}
+
+// Placement describes where the replicas of a segment were placed.
+type Placement struct {
+	Time   time.Time         `json:"time"`
+	Stores map[string]string `json:"stores"` // API host:port: zone
+	Zones  int               `json:"zones"`  // distinct, among the stores
+	Spread bool              `json:"spread"` // across as many zones as possible
+}
+
+// SetPlacement records the most recent placement of replicas, for State.
+func (p *Peer) SetPlacement(placement Placement) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.placement = &placement
+}
+
 // Name returns the unique ID of this peer in the cluster.
 func (p *Peer) Name() string {
 	return p.ml.LocalNode().Name
@@ -122,11 +176,15 @@ func (p *Peer) ClusterSize() int {
 // State returns a JSON-serializable dump of cluster state.
 // Useful for debug.
 func (p *Peer) State() map[string]interface{} {
+	p.mtx.RLock()
+	placement := p.placement
+	p.mtx.RUnlock()
 	return map[string]interface{}{
-		"self":     p.ml.LocalNode(),
-		"members":  p.ml.Members(),
-		"n":        p.ml.NumMembers(),
-		"delegate": p.d.state(),
+		"self":      p.ml.LocalNode(),
+		"members":   p.ml.Members(),
+		"n":         p.ml.NumMembers(),
+		"delegate":  p.d.state(),
+		"placement": placement,
 	}
 }
 
@@ -141,9 +199,26 @@ type delegate struct {
 }
 
 type peerInfo struct {
-	Type    PeerType `json:"type"`
-	APIAddr string   `json:"api_addr"`
-	APIPort int      `json:"api_port"`
+	Type       PeerType      `json:"type"`
+	APIAddr    string        `json:"api_addr"`
+	APIPort    int           `json:"api_port"`
+	Zone       string        `json:"zone,omitempty"`
+	Load       *Load         `json:"load,omitempty"`
+	RingBucket time.Duration `json:"ring_bucket,omitempty"`
+	Version    uint64        `json:"version,omitempty"` // incremented by the peer on each update
+}
+
+// Load describes how busy an ingest node is.
+type Load struct {
+	ConnectedClients int64 `json:"connected_clients"`
+	ActiveBytes      int64 `json:"active_bytes"`
+	FlushedBytes     int64 `json:"flushed_bytes"`
+	PendingBytes     int64 `json:"pending_bytes"`
+}
+
+// Backlog is the number of bytes written to the node, but not yet consumed.
+func (l Load) Backlog() int64 {
+	return l.ActiveBytes + l.FlushedBytes + l.PendingBytes
 }
 
 func newDelegate(logger log.Logger) *delegate {
@@ -154,7 +229,7 @@ func newDelegate(logger log.Logger) *delegate {
 	}
 }
 
-func (d *delegate) init(myName string, myType PeerType, apiAddr string, apiPort int, numNodes func() int) {
+func (d *delegate) init(myName string, myType PeerType, apiAddr string, apiPort int, zone string, numNodes func() int) {
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
 	// As far as I can tell, it is only luck which ensures the d.bcast isn't
@@ -165,23 +240,90 @@ func (d *delegate) init(myName string, myType PeerType, apiAddr string, apiPort
 		NumNodes:       numNodes,
 		RetransmitMult: 3,
 	}
-	d.data[myName] = peerInfo{myType, apiAddr, apiPort}
+	d.data[myName] = peerInfo{Type: myType, APIAddr: apiAddr, APIPort: apiPort, Zone: zone}
 }
 
 func (d *delegate) current(t PeerType) (res []string) {
 	for _, info := range d.state() {
-		var (
-			matchIngest      = t == PeerTypeIngest && (info.Type == PeerTypeIngest || info.Type == PeerTypeIngestStore)
-			matchStore       = t == PeerTypeStore && (info.Type == PeerTypeStore || info.Type == PeerTypeIngestStore)
-			matchIngestStore = t == PeerTypeIngestStore && info.Type == PeerTypeIngestStore
-		)
-		if matchIngest || matchStore || matchIngestStore {
+		if info.is(t) {
 			res = append(res, net.JoinHostPort(info.APIAddr, strconv.Itoa(info.APIPort)))
 		}
 	}
 	return res
 }
 
+func (d *delegate) loads(t PeerType) map[string]Load {
+	res := map[string]Load{}
+	for _, info := range d.state() {
+		if info.is(t) && info.Load != nil {
+			res[net.JoinHostPort(info.APIAddr, strconv.Itoa(info.APIPort))] = *info.Load
+		}
+	}
+	return res
+}
+
+func (d *delegate) zones(t PeerType) map[string]string {
+	res := map[string]string{}
+	for _, info := range d.state() {
+		if info.is(t) {
+			res[net.JoinHostPort(info.APIAddr, strconv.Itoa(info.APIPort))] = info.Zone
+		}
+	}
+	return res
+}
+
+func (d *delegate) ringBuckets(t PeerType) map[string]time.Duration {
+	res := map[string]time.Duration{}
+	for _, info := range d.state() {
+		if info.is(t) {
+			res[net.JoinHostPort(info.APIAddr, strconv.Itoa(info.APIPort))] = info.RingBucket
+		}
+	}
+	return res
+}
+
+// is reports whether the peer serves the APIs of the given type.
+func (info peerInfo) is(t PeerType) bool {
+	var (
+		matchIngest      = t == PeerTypeIngest && (info.Type == PeerTypeIngest || info.Type == PeerTypeIngestStore)
+		matchStore       = t == PeerTypeStore && (info.Type == PeerTypeStore || info.Type == PeerTypeIngestStore)
+		matchIngestStore = t == PeerTypeIngestStore && info.Type == PeerTypeIngestStore
+	)
+	return matchIngest || matchStore || matchIngestStore
+}
+
+// setLoad updates our own load, and queues it for broadcast.
+func (d *delegate) setLoad(myName string, load Load) {
+	d.update(myName, func(info *peerInfo) { info.Load = &load })
+}
+
+// update our own info, and queue it for broadcast.
+func (d *delegate) update(myName string, f func(*peerInfo)) {
+	d.mtx.Lock()
+	info := d.data[myName]
+	f(&info)
+	info.Version++
+	d.data[myName] = info
+	buf, err := json.Marshal(map[string]peerInfo{myName: info})
+	bcast := d.bcast
+	d.mtx.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	bcast.QueueBroadcast(infoBroadcast(buf))
+}
+
+// merge takes peer info from elsewhere, unless ours is more recent.
+// Clients must hold the write lock.
+func (d *delegate) merge(data map[string]peerInfo) {
+	for k, v := range data {
+		if cur, ok := d.data[k]; ok && cur.Version > v.Version {
+			continue
+		}
+		d.data[k] = v
+	}
+}
+
 func (d *delegate) state() map[string]peerInfo {
 	d.mtx.RLock()
 	defer d.mtx.RUnlock()
@@ -218,10 +360,7 @@ func (d *delegate) NotifyMsg(b []byte) {
 	}
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
-	for k, v := range data {
-		// Removing data is handled by NotifyLeave
-		d.data[k] = v
-	}
+	d.merge(data) // removing data is handled by NotifyLeave
 }
 
 // GetBroadcasts is called when user data messages can be broadcast.
@@ -272,9 +411,7 @@ func (d *delegate) MergeRemoteState(buf []byte, join bool) {
 	}
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
-	for k, v := range data {
-		d.data[k] = v
-	}
+	d.merge(data)
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
@@ -300,3 +437,16 @@ func (d *delegate) NotifyLeave(n *memberlist.Node) {
 	defer d.mtx.Unlock()
 	delete(d.data, n.Name)
 }
+
+// infoBroadcast carries our most recent info, e.g. our load, superseding any
+// earlier one. Implements memberlist.Broadcast.
+type infoBroadcast []byte
+
+func (b infoBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	_, ok := other.(infoBroadcast)
+	return ok
+}
+
+func (b infoBroadcast) Message() []byte { return b }
+
+func (b infoBroadcast) Finished() {}
@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDelegateLoads(t *testing.T) {
+	a, b := newDelegate(log.NewNopLogger()), newDelegate(log.NewNopLogger())
+	a.init("a", PeerTypeIngest, "10.0.0.1", 7650, "", func() int { return 2 })
+	b.init("b", PeerTypeStore, "10.0.0.2", 7650, "", func() int { return 2 })
+	stale := a.LocalState(false)
+
+	// Only the latest load is broadcast.
+	a.setLoad("a", Load{ConnectedClients: 1})
+	a.setLoad("a", Load{ConnectedClients: 2})
+	bcasts := a.GetBroadcasts(0, 1<<16)
+	if want, have := 1, len(bcasts); want != have {
+		t.Fatalf("broadcasts: want %d, have %d", want, have)
+	}
+	b.NotifyMsg(bcasts[0])
+	want := map[string]Load{"10.0.0.1:7650": {ConnectedClients: 2}}
+	if have := b.loads(PeerTypeIngest); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Older state doesn't overwrite newer.
+	b.MergeRemoteState(stale, false)
+	if have := b.loads(PeerTypeIngest); !reflect.DeepEqual(want, have) {
+		t.Errorf("after stale merge: want %v, have %v", want, have)
+	}
+
+	// Nodes that don't report load aren't included.
+	if have := b.loads(PeerTypeStore); len(have) != 0 {
+		t.Errorf("store loads: want none, have %v", have)
+	}
+}
+
+func TestDelegateZones(t *testing.T) {
+	a, b := newDelegate(log.NewNopLogger()), newDelegate(log.NewNopLogger())
+	a.init("a", PeerTypeStore, "10.0.0.1", 7650, "us-east-1a", func() int { return 2 })
+	b.init("b", PeerTypeIngestStore, "10.0.0.2", 7650, "", func() int { return 2 })
+
+	// Zones are gossiped with the rest of the peer info.
+	b.MergeRemoteState(a.LocalState(true), true)
+	want := map[string]string{"10.0.0.1:7650": "us-east-1a", "10.0.0.2:7650": ""}
+	if have := b.zones(PeerTypeStore); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if have := b.zones(PeerTypeIngest); len(have) != 1 {
+		t.Errorf("ingest zones: want 1, have %v", have)
+	}
+}
+
+func TestDelegateRingBuckets(t *testing.T) {
+	a, b := newDelegate(log.NewNopLogger()), newDelegate(log.NewNopLogger())
+	a.init("a", PeerTypeStore, "10.0.0.1", 7650, "", func() int { return 2 })
+	b.init("b", PeerTypeStore, "10.0.0.2", 7650, "", func() int { return 2 })
+
+	// Ring bucket widths are broadcast like loads.
+	a.update("a", func(info *peerInfo) { info.RingBucket = time.Hour })
+	bcasts := a.GetBroadcasts(0, 1<<16)
+	if want, have := 1, len(bcasts); want != have {
+		t.Fatalf("broadcasts: want %d, have %d", want, have)
+	}
+	b.NotifyMsg(bcasts[0])
+	want := map[string]time.Duration{"10.0.0.1:7650": time.Hour, "10.0.0.2:7650": 0}
+	if have := b.ringBuckets(PeerTypeStore); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
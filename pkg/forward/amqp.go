@@ -0,0 +1,129 @@
+package forward
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// AMQPChannel models *amqp.Channel.
+type AMQPChannel interface {
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+}
+
+// NewAMQPSource returns a Source that consumes deliveries from the queue.
+// If exchange is non-empty, the queue is first bound to it with routingKey.
+// Each line of a delivery's body is a separate Record. A delivery is acked only
+// once all of its records are. If any of them is nacked, the whole delivery is
+// requeued by the server, which will deliver it again; records of it that were
+// already forwarded are then forwarded twice.
+func NewAMQPSource(ch AMQPChannel, queue, exchange, routingKey, consumer string) (Source, error) {
+	if exchange != "" {
+		if err := ch.QueueBind(queue, routingKey, exchange, false, nil); err != nil {
+			return nil, err
+		}
+	}
+	deliveries, err := ch.Consume(queue, consumer, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpSource{
+		ch:         ch,
+		consumer:   consumer,
+		deliveries: deliveries,
+		done:       make(chan struct{}),
+	}, nil
+}
+
+type amqpSource struct {
+	ch         AMQPChannel
+	consumer   string
+	deliveries <-chan amqp.Delivery
+	pending    []amqpLine // remaining lines of the last delivery
+	once       sync.Once
+	done       chan struct{}
+}
+
+type amqpLine struct {
+	delivery *amqpDelivery
+	data     []byte
+}
+
+// amqpDelivery tracks the records made from a single delivery.
+type amqpDelivery struct {
+	mtx       sync.Mutex
+	d         amqp.Delivery
+	remaining int  // records not yet acked
+	settled   bool // acked or nacked upstream
+}
+
+func (d *amqpDelivery) ack() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.settled {
+		return nil
+	}
+	if d.remaining--; d.remaining > 0 {
+		return nil
+	}
+	d.settled = true
+	return d.d.Ack(false)
+}
+
+func (d *amqpDelivery) nack() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.settled {
+		return nil // already requeued, or forwarded in full
+	}
+	d.settled = true
+	return d.d.Nack(false, true)
+}
+
+func (d *amqpDelivery) isSettled() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.settled
+}
+
+func (as *amqpSource) Next() (Record, error) {
+	for {
+		for len(as.pending) > 0 {
+			line := as.pending[0]
+			as.pending = as.pending[1:]
+			if line.delivery.isSettled() {
+				continue // the delivery was requeued; its lines will come again
+			}
+			return record{
+				data: line.data,
+				ack:  line.delivery.ack,
+				nack: line.delivery.nack,
+			}, nil
+		}
+		select {
+		case d, ok := <-as.deliveries:
+			if !ok {
+				return nil, ErrSourceClosed // channel or connection closed
+			}
+			lines := bytes.Split(bytes.TrimSuffix(d.Body, []byte("\n")), []byte("\n"))
+			delivery := &amqpDelivery{d: d, remaining: len(lines)}
+			for _, data := range lines {
+				as.pending = append(as.pending, amqpLine{delivery, data})
+			}
+		case <-as.done:
+			return nil, ErrSourceClosed
+		}
+	}
+}
+
+func (as *amqpSource) Close() error {
+	var err error
+	as.once.Do(func() {
+		close(as.done)
+		err = as.ch.Cancel(as.consumer, false)
+	})
+	return err
+}
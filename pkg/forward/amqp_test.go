@@ -0,0 +1,220 @@
+package forward
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAMQPSource(t *testing.T) {
+	t.Parallel()
+
+	ch := newMockChannel()
+	s, err := NewAMQPSource(ch, "q.logs", "ex.logs", "rk.logs", "oklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "q.logs rk.logs ex.logs", ch.bound; want != have {
+		t.Errorf("bind: want %q, have %q", want, have)
+	}
+
+	// Deliveries are only acked or nacked once their records are.
+	var records []Record
+	for _, body := range []string{"foo", "bar"} {
+		ch.publish(body)
+		r, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := body, string(r.Data()); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+		records = append(records, r)
+	}
+	if have := ch.acked(); len(have) != 0 {
+		t.Errorf("acked before the records were: %v", have)
+	}
+	records[1].Ack()
+	records[0].Nack()
+	if want, have := []uint64{2}, ch.acked(); !equalTags(want, have) {
+		t.Errorf("acked: want %v, have %v", want, have)
+	}
+	if want, have := []uint64{1}, ch.requeued(); !equalTags(want, have) {
+		t.Errorf("requeued: want %v, have %v", want, have)
+	}
+
+	// Close cancels the consumer, and unblocks a waiting Next.
+	errc := make(chan error, 1)
+	go func() { _, err := s.Next(); errc <- err }()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrSourceClosed {
+			t.Errorf("want %v, have %v", ErrSourceClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next didn't return after Close")
+	}
+	if !ch.canceled {
+		t.Error("consumer wasn't canceled")
+	}
+}
+
+func TestAMQPSourceMultiLine(t *testing.T) {
+	t.Parallel()
+
+	ch := newMockChannel()
+	s, err := NewAMQPSource(ch, "q.logs", "", "", "oklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Each line is a record, and the delivery is acked after all of them.
+	ch.publish("foo\nbar\nbaz\n")
+	ch.publish("qux")
+	var records []Record
+	for _, want := range []string{"foo", "bar", "baz", "qux"} {
+		r, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(r.Data()); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+		records = append(records, r)
+	}
+	records[0].Ack()
+	records[1].Ack()
+	if have := ch.acked(); len(have) != 0 {
+		t.Errorf("acked before all lines were: %v", have)
+	}
+	records[2].Ack()
+	records[3].Ack()
+	if want, have := []uint64{1, 2}, ch.acked(); !equalTags(want, have) {
+		t.Errorf("acked: want %v, have %v", want, have)
+	}
+
+	// A nacked line requeues its delivery once, and the rest of its lines
+	// aren't produced, as the server will deliver them again.
+	ch.publish("a\nb\nc")
+	ch.publish("d")
+	r, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Nack()
+	r.Nack()
+	if want, have := []uint64{3}, ch.requeued(); !equalTags(want, have) {
+		t.Errorf("requeued: want %v, have %v", want, have)
+	}
+	if r, err = s.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "d", string(r.Data()); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestAMQPSourceNoExchange(t *testing.T) {
+	t.Parallel()
+
+	ch := newMockChannel()
+	s, err := NewAMQPSource(ch, "q.logs", "", "", "oklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ch.bound != "" {
+		t.Errorf("queue was bound without an exchange: %q", ch.bound)
+	}
+
+	// A closed delivery channel means the server went away.
+	close(ch.deliveries)
+	if _, err := s.Next(); err != ErrSourceClosed {
+		t.Errorf("want %v, have %v", ErrSourceClosed, err)
+	}
+}
+
+// mockChannel is an in-process stand-in for an AMQP server's channel.
+type mockChannel struct {
+	mtx        sync.Mutex
+	deliveries chan amqp.Delivery
+	tag        uint64
+	acks       []uint64
+	requeues   []uint64
+	bound      string
+	canceled   bool
+}
+
+func newMockChannel() *mockChannel {
+	return &mockChannel{deliveries: make(chan amqp.Delivery, 16)}
+}
+
+func (c *mockChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.bound = name + " " + key + " " + exchange
+	return nil
+}
+
+func (c *mockChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return c.deliveries, nil
+}
+
+func (c *mockChannel) Cancel(consumer string, noWait bool) error {
+	c.canceled = true
+	return nil
+}
+
+func (c *mockChannel) publish(body string) {
+	c.mtx.Lock()
+	c.tag++
+	tag := c.tag
+	c.mtx.Unlock()
+	c.deliveries <- amqp.Delivery{Acknowledger: c, DeliveryTag: tag, Body: []byte(body)}
+}
+
+func (c *mockChannel) acked() []uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]uint64(nil), c.acks...)
+}
+
+func (c *mockChannel) requeued() []uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]uint64(nil), c.requeues...)
+}
+
+func (c *mockChannel) Ack(tag uint64, multiple bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.acks = append(c.acks, tag)
+	return nil
+}
+
+func (c *mockChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if requeue {
+		c.requeues = append(c.requeues, tag)
+	}
+	return nil
+}
+
+func (c *mockChannel) Reject(tag uint64, requeue bool) error { return nil }
+
+func equalTags(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewFileSource returns a Source that follows the file at path, like tail -F.
+// Reading starts at the end of the file, unless fromStart is true. At the end
+// of the file, it checks for new data every poll interval. If the file is
+// truncated, it's read again from the beginning. If it's replaced, e.g. by log
+// rotation, the remainder of the old file is read, and then the new file is
+// read from the beginning.
+func NewFileSource(path string, fromStart bool, poll time.Duration) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var off int64
+	if !fromStart {
+		if off, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &fileSource{
+		path: path,
+		poll: poll,
+		f:    f,
+		r:    bufio.NewReader(f),
+		off:  off,
+		done: make(chan struct{}),
+	}, nil
+}
+
+type fileSource struct {
+	path string
+	poll time.Duration
+
+	mtx     sync.Mutex
+	f       *os.File
+	r       *bufio.Reader
+	off     int64  // bytes consumed from f
+	partial []byte // current line, until we see its newline
+	q       requeue
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (fs *fileSource) Next() (Record, error) {
+	for {
+		select {
+		case <-fs.done:
+			return nil, ErrSourceClosed
+		default:
+		}
+
+		if r, ok := fs.q.pop(); ok {
+			return r, nil
+		}
+		line, err := fs.read()
+		if err != nil {
+			return nil, err
+		}
+		if line != nil {
+			return fs.q.record(line), nil
+		}
+
+		select {
+		case <-fs.done:
+			return nil, ErrSourceClosed
+		case <-time.After(fs.poll):
+		}
+	}
+}
+
+// read returns the next complete line, or nil if we need to wait for more.
+func (fs *fileSource) read() ([]byte, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	for {
+		chunk, err := fs.r.ReadSlice('\n')
+		fs.off += int64(len(chunk))
+		fs.partial = append(fs.partial, chunk...)
+		switch {
+		case err == nil:
+			line := append([]byte{}, fs.partial[:len(fs.partial)-1]...)
+			fs.partial = fs.partial[:0]
+			return line, nil
+		case err == bufio.ErrBufferFull && len(fs.partial) < maxRecordSize:
+			continue
+		case err == bufio.ErrBufferFull:
+			line := append([]byte{}, fs.partial...) // too long; emit what we have
+			fs.partial = fs.partial[:0]
+			return line, nil
+		case err != io.EOF:
+			return nil, err
+		}
+
+		// We're at the end of the file. Check if it's been rotated or truncated.
+		more, err := fs.follow()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return nil, nil
+		}
+	}
+}
+
+// follow reports whether there's more to read from the current or a new file.
+func (fs *fileSource) follow() (more bool, err error) {
+	cur, err := fs.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if cur.Size() > fs.off {
+		return true, nil // written since we hit EOF
+	}
+	if cur.Size() < fs.off {
+		// Truncated. Start again from the beginning.
+		if _, err := fs.f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		fs.r.Reset(fs.f)
+		fs.off, fs.partial = 0, fs.partial[:0]
+		return true, nil
+	}
+
+	fi, err := os.Stat(fs.path)
+	if os.IsNotExist(err) {
+		return false, nil // mid-rotation; wait for the new file
+	}
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(cur, fi) {
+		return false, nil // nothing new
+	}
+
+	// Rotated, and we've read all of the old file. Switch to the new one.
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return false, err
+	}
+	fs.f.Close()
+	fs.f = f
+	fs.r.Reset(f)
+	fs.off = 0
+	return true, nil
+}
+
+func (fs *fileSource) Close() error {
+	fs.once.Do(func() { close(fs.done) })
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return fs.f.Close()
+}
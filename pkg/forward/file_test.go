@@ -0,0 +1,120 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "oklog_forward_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+
+	// Existing records are skipped, by default.
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "old")
+	s, err := NewFileSource(path, false, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Appended records are followed, including partial writes.
+	fmt.Fprintln(f, "alpha")
+	fmt.Fprint(f, "be")
+	if want, have := "alpha", next(t, s); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	fmt.Fprintln(f, "ta")
+	r, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "beta", string(r.Data()); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	// Nacked records are produced again.
+	r.Nack()
+	if want, have := "beta", next(t, s); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	// Truncation restarts from the beginning.
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "gamma")
+	if want, have := "gamma", next(t, s); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	// Rotation reads the rest of the old file, and then the new one.
+	fmt.Fprintln(f, "delta")
+	f.Close()
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = os.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintln(f, "epsilon")
+	for _, want := range []string{"delta", "epsilon"} {
+		if have := next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestFileSourceFromStart(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "oklog_forward_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fmt.Fprint(f, "foo\nbar\n")
+
+	s, err := NewFileSource(f.Name(), true, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"foo", "bar"} {
+		if have := next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+
+	// Close unblocks a waiting Next.
+	errc := make(chan error, 1)
+	go func() { _, err := s.Next(); errc <- err }()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-errc:
+		if err != ErrSourceClosed {
+			t.Errorf("want %v, have %v", ErrSourceClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next didn't return after Close")
+	}
+}
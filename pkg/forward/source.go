@@ -0,0 +1,125 @@
+// Package forward provides the input sources for the forwarding agent.
+package forward
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ErrSourceClosed is returned by Next after the Source is closed.
+var ErrSourceClosed = errors.New("source closed")
+
+// Source produces records for the forwarder.
+// Next blocks until a record is available. Records that were returned with
+// Nack are produced again, in order, before any new records.
+// Next returns io.EOF when the source is exhausted.
+type Source interface {
+	Next() (Record, error)
+	Close() error
+}
+
+// Record is a single record produced by a Source, without its trailing
+// newline. Once the record has been forwarded, the forwarder calls Ack. If it
+// couldn't be forwarded, the forwarder calls Nack, returning it to the Source.
+type Record interface {
+	Data() []byte
+	Ack() error
+	Nack() error
+}
+
+type record struct {
+	data      []byte
+	ack, nack func() error
+}
+
+func (r record) Data() []byte { return r.data }
+func (r record) Ack() error   { return r.ack() }
+func (r record) Nack() error  { return r.nack() }
+
+// requeue holds nacked records for sources that can't return them upstream.
+// Records are numbered as they're produced, and requeued in that order, so a
+// record nacked more than once still comes back before later ones.
+type requeue struct {
+	mtx     sync.Mutex
+	seq     uint64
+	records []requeued
+}
+
+type requeued struct {
+	seq  uint64
+	data []byte
+}
+
+// record wraps data in a Record which is requeued when nacked.
+func (q *requeue) record(data []byte) Record {
+	q.mtx.Lock()
+	seq := q.seq
+	q.seq++
+	q.mtx.Unlock()
+	return q.wrap(seq, data)
+}
+
+func (q *requeue) wrap(seq uint64, data []byte) Record {
+	return record{
+		data: data,
+		ack:  func() error { return nil },
+		nack: func() error { q.push(seq, data); return nil },
+	}
+}
+
+// push requeues data, produced as the seq'th record, before any produced later.
+func (q *requeue) push(seq uint64, data []byte) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	i := sort.Search(len(q.records), func(i int) bool { return q.records[i].seq > seq })
+	q.records = append(q.records, requeued{})
+	copy(q.records[i+1:], q.records[i:])
+	q.records[i] = requeued{seq, data}
+}
+
+func (q *requeue) pop() (Record, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.records) <= 0 {
+		return nil, false
+	}
+	r := q.records[0]
+	q.records = q.records[1:]
+	return q.wrap(r.seq, r.data), true
+}
+
+// NewReaderSource returns a Source that produces each line read from r.
+// It's used to forward stdin.
+func NewReaderSource(r io.Reader) Source {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxRecordSize)
+	return &readerSource{s: s}
+}
+
+// maxRecordSize is the longest line a line-oriented Source will produce.
+const maxRecordSize = 1024 * 1024
+
+type readerSource struct {
+	s *bufio.Scanner
+	q requeue
+}
+
+func (rs *readerSource) Next() (Record, error) {
+	if r, ok := rs.q.pop(); ok {
+		return r, nil
+	}
+	if !rs.s.Scan() {
+		if err := rs.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return rs.q.record(append([]byte(nil), rs.s.Bytes()...)), nil
+}
+
+func (rs *readerSource) Close() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package forward
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderSource(t *testing.T) {
+	t.Parallel()
+
+	s := NewReaderSource(strings.NewReader("foo\nbar\n\nbaz"))
+	defer s.Close()
+	for _, want := range []string{"foo", "bar", "", "baz"} {
+		if have := next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+}
+
+func TestReaderSourceNack(t *testing.T) {
+	t.Parallel()
+
+	s := NewReaderSource(strings.NewReader("foo\nbar\nbaz\n"))
+	defer s.Close()
+	foo, _ := s.Next()
+	bar, _ := s.Next()
+	foo.Ack()
+	bar.Nack()
+
+	// Nacked records come back first, even after the reader is exhausted.
+	for _, want := range []string{"bar", "baz"} {
+		if have := next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+	foo.Nack()
+	if want, have := "foo", next(t, s); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestReaderSourceNackTwice(t *testing.T) {
+	t.Parallel()
+
+	s := NewReaderSource(strings.NewReader("foo\nbar\nbaz\n"))
+	defer s.Close()
+	foo, _ := s.Next()
+	bar, _ := s.Next()
+	foo.Nack()
+	bar.Nack()
+
+	// foo is nacked again after bar, but still comes back before it.
+	foo, _ = s.Next()
+	foo.Nack()
+	for _, want := range []string{"foo", "bar", "baz"} {
+		if have := next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+// next reads a record from the source, failing the test if it takes too long.
+func next(t *testing.T, s Source) string {
+	type result struct {
+		r   Record
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		r, err := s.Next()
+		c <- result{r, err}
+	}()
+	select {
+	case res := <-c:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return string(res.r.Data())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for record")
+		return ""
+	}
+}
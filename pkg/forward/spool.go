@@ -0,0 +1,586 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+// SpoolPolicy says what a full spool does with new records.
+type SpoolPolicy int
+
+const (
+	// SpoolBlock stops reading from the upstream source until there's room.
+	SpoolBlock SpoolPolicy = iota
+
+	// SpoolDropOldest discards the oldest unread spooled records to make room.
+	SpoolDropOldest
+)
+
+const (
+	extSpool = ".spool"
+
+	// spoolSegments is roughly how many files the spool is split into.
+	// Records are dropped a file at a time.
+	spoolSegments = 16
+
+	// spoolHandoff is how many records may wait in memory for the forwarder
+	// before they're written to disk.
+	spoolHandoff = 1024
+
+	// spoolSyncBatch is how many spooled records may be synced to disk, and
+	// acked upstream, at once. As many are read ahead from the upstream.
+	spoolSyncBatch = 64
+)
+
+// NewSpool wraps the upstream source with a bounded disk spool in dir. Records
+// are handed to the forwarder directly while it keeps up with the upstream.
+// When it doesn't, e.g. because every ingester is down, records are written to
+// the spool and acknowledged upstream, and the forwarder receives them from
+// the spool, in order, once it's back. Spooled records that weren't acked
+// survive restarts, and are produced first by the next spool in dir.
+func NewSpool(
+	upstream Source,
+	filesys fs.Filesystem,
+	dir string,
+	maxBytes int64,
+	policy SpoolPolicy,
+	spoolBytes, spoolRecords prometheus.Gauge,
+	droppedRecords prometheus.Counter,
+) (Source, error) {
+	if err := filesys.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		upstream:       upstream,
+		filesys:        filesys,
+		dir:            dir,
+		maxBytes:       maxBytes,
+		segmentSize:    maxBytes / spoolSegments,
+		policy:         policy,
+		handoff:        make(chan Record, spoolHandoff),
+		notify:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		spoolBytes:     spoolBytes,
+		spoolRecords:   spoolRecords,
+		droppedRecords: droppedRecords,
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	go s.pump()
+	return s, nil
+}
+
+type spool struct {
+	upstream    Source
+	filesys     fs.Filesystem
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	policy      SpoolPolicy
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	segments []*spoolSegment // oldest first
+	active   fs.File         // the newest segment, while it's being written
+	seq      uint64          // for naming segments
+	bytes    int64           // on disk
+	records  int             // on disk, and not yet acked
+	produced uint64          // records produced, numbering them
+	requeued []spoolRequeued // nacked, in the order produced, to be produced first
+	err      error           // from the upstream, once it's drained
+	closed   bool
+
+	handoff chan Record
+	notify  chan struct{}
+	once    sync.Once
+	done    chan struct{}
+
+	spoolBytes     prometheus.Gauge
+	spoolRecords   prometheus.Gauge
+	droppedRecords prometheus.Counter
+}
+
+// spoolSegment is a file of spooled records. Once the forwarder starts to
+// read it, its records are loaded, and it's removed when they're all acked.
+type spoolSegment struct {
+	path    string
+	size    int64
+	records int
+	loaded  [][]byte // records not yet produced, once reading
+	reading bool
+	acked   int
+}
+
+type spoolRecord struct {
+	segment *spoolSegment
+	data    []byte
+}
+
+type spoolRequeued struct {
+	seq    uint64
+	record Record
+}
+
+// recover picks up the segments left behind by a previous spool.
+func (s *spool) recover() error {
+	var paths []string
+	if err := s.filesys.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == extSpool {
+			paths = append(paths, path)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Strings(paths) // names are zero-padded sequence numbers
+
+	for _, path := range paths {
+		buf, err := s.readFile(path)
+		if err != nil {
+			return err
+		}
+		var seq uint64
+		fmt.Sscanf(filepath.Base(path), "%d", &seq)
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+		if torn := len(buf) - (bytes.LastIndexByte(buf, '\n') + 1); torn > 0 {
+			// The last record was cut short when we stopped, so it was never
+			// synced or acked upstream, which will produce it again.
+			buf = buf[:len(buf)-torn]
+			if err := s.rewrite(path, buf); err != nil {
+				return err
+			}
+		}
+		if len(buf) == 0 {
+			s.filesys.Remove(path)
+			continue
+		}
+		records := countRecords(buf)
+		s.segments = append(s.segments, &spoolSegment{path: path, size: int64(len(buf)), records: records})
+		s.bytes += int64(len(buf))
+		s.records += records
+	}
+	s.updateMetrics()
+	return nil
+}
+
+// rewrite the file at path with buf.
+func (s *spool) rewrite(path string, buf []byte) error {
+	f, err := s.filesys.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// countRecords counts the records in buf the way nextSpooled splits them.
+func countRecords(buf []byte) int {
+	return bytes.Count(buf, []byte{'\n'})
+}
+
+// pump moves records from the upstream to the forwarder, via the spool when
+// the forwarder isn't keeping up. Spooled records are synced, and acked
+// upstream, in batches: whenever the upstream has no more records for us
+// straight away, or after spoolSyncBatch of them.
+func (s *spool) pump() {
+	var (
+		next = make(chan Record, spoolSyncBatch)
+		errc = make(chan error, 1)
+	)
+	go func() {
+		for {
+			r, err := s.upstream.Next()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case next <- r:
+			case <-s.done:
+				r.Nack()
+				return
+			}
+		}
+	}()
+
+	var unsynced []Record // spooled, but not yet synced and acked upstream
+	for {
+		var r Record
+		select {
+		case r = <-next:
+		default:
+			if err := s.sync(unsynced); err != nil {
+				s.fail(err)
+				return
+			}
+			unsynced = unsynced[:0]
+			select {
+			case r = <-next:
+			case err := <-errc:
+				s.fail(err)
+				return
+			case <-s.done:
+				s.sync(unsynced) // Close synced them with the active segment
+				for {
+					select {
+					case r := <-next:
+						r.Nack()
+					default:
+						return
+					}
+				}
+			}
+		}
+
+		// While nothing is spooled, try to hand the record over directly.
+		s.mtx.Lock()
+		unread := s.unread()
+		s.mtx.Unlock()
+		if !unread {
+			select {
+			case s.handoff <- s.passthrough(r):
+				continue
+			default:
+			}
+		}
+
+		// Otherwise, spool it. Once it's synced, it's our responsibility.
+		if err := s.write(r.Data()); err != nil {
+			r.Nack()
+			for _, r := range unsynced {
+				r.Nack()
+			}
+			s.fail(err)
+			return
+		}
+		unsynced = append(unsynced, r)
+		s.signal()
+		if len(unsynced) >= spoolSyncBatch {
+			if err := s.sync(unsynced); err != nil {
+				s.fail(err)
+				return
+			}
+			unsynced = unsynced[:0]
+		}
+	}
+}
+
+// sync the spooled records to disk, and ack them upstream. Segments that were
+// sealed since they were written were synced then.
+func (s *spool) sync(records []Record) error {
+	if len(records) <= 0 {
+		return nil
+	}
+	s.mtx.Lock()
+	var err error
+	if s.active != nil {
+		err = s.active.Sync()
+	}
+	s.mtx.Unlock()
+	if err != nil {
+		for _, r := range records {
+			r.Nack()
+		}
+		return err
+	}
+	for _, r := range records {
+		r.Ack()
+	}
+	return nil
+}
+
+// fail stops the spool with the error, once the spooled records are produced.
+func (s *spool) fail(err error) {
+	s.mtx.Lock()
+	s.err = err
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// write appends the record to the active segment, making room first.
+func (s *spool) write(data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sz := int64(len(data)) + 1
+	for !s.closed && s.bytes+sz > s.maxBytes && s.bytes > 0 {
+		if s.policy == SpoolDropOldest && s.dropOldest() {
+			continue
+		}
+		s.cond.Wait() // for acks to free some space
+	}
+	if s.closed {
+		return ErrSourceClosed
+	}
+
+	if s.active == nil {
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, extSpool))
+		f, err := s.filesys.Create(path)
+		if err != nil {
+			return err
+		}
+		s.seq++
+		s.active = f
+		s.segments = append(s.segments, &spoolSegment{path: path})
+	}
+	segment := s.segments[len(s.segments)-1]
+	buf := make([]byte, 0, sz)
+	if _, err := s.active.Write(append(append(buf, data...), '\n')); err != nil {
+		return err
+	}
+	segment.size += sz
+	segment.records++
+	s.bytes += sz
+	s.records++
+	s.updateMetrics()
+	if segment.size >= s.segmentSize {
+		return s.seal()
+	}
+	return nil
+}
+
+// seal syncs and closes the active segment, so it can be read.
+func (s *spool) seal() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Sync()
+	if cerr := s.active.Close(); err == nil {
+		err = cerr
+	}
+	s.active = nil
+	return err
+}
+
+// dropOldest removes the oldest segment that isn't being read.
+func (s *spool) dropOldest() bool {
+	for i, segment := range s.segments {
+		if segment.reading {
+			continue
+		}
+		if i == len(s.segments)-1 {
+			s.seal()
+		}
+		s.filesys.Remove(segment.path)
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		s.bytes -= segment.size
+		s.records -= segment.records
+		s.droppedRecords.Add(float64(segment.records))
+		s.updateMetrics()
+		return true
+	}
+	return false
+}
+
+func (s *spool) Next() (Record, error) {
+	for {
+		// Nacked records go first. Then, records waiting in memory are older
+		// than anything in spooled segments.
+		s.mtx.Lock()
+		if len(s.requeued) > 0 {
+			r := s.requeued[0]
+			s.requeued = s.requeued[1:]
+			s.mtx.Unlock()
+			return r.record, nil
+		}
+		s.mtx.Unlock()
+		select {
+		case r := <-s.handoff:
+			return s.produce(r), nil
+		default:
+		}
+
+		s.mtx.Lock()
+		r, ok, err := s.nextSpooled()
+		if err == nil && !ok && s.err != nil && len(s.handoff) == 0 {
+			err = s.err
+		}
+		s.mtx.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return s.produce(r), nil
+		}
+
+		select {
+		case r := <-s.handoff:
+			return s.produce(r), nil
+		case <-s.notify:
+		case <-s.done:
+			return nil, ErrSourceClosed
+		}
+	}
+}
+
+// nextSpooled produces the oldest unread spooled record, if there is one.
+func (s *spool) nextSpooled() (Record, bool, error) {
+	for _, segment := range s.segments {
+		if segment.reading && len(segment.loaded) <= 0 {
+			continue // all produced, waiting for acks
+		}
+		if !segment.reading {
+			if s.active != nil && segment == s.segments[len(s.segments)-1] {
+				if err := s.seal(); err != nil {
+					return nil, false, err
+				}
+			}
+			buf, err := s.readFile(segment.path)
+			if err != nil {
+				return nil, false, err
+			}
+			segment.reading = true
+			segment.loaded = bytes.SplitAfter(buf, []byte{'\n'})
+			if n := len(segment.loaded); n > 0 && len(segment.loaded[n-1]) == 0 {
+				segment.loaded = segment.loaded[:n-1]
+			}
+			if n := len(segment.loaded); n != segment.records {
+				// Only whole records are spooled, so this shouldn't happen,
+				// but acks must add up, or we'd remove the segment early.
+				s.records += n - segment.records
+				segment.records = n
+			}
+			if len(segment.loaded) <= 0 {
+				continue
+			}
+		}
+		data := segment.loaded[0]
+		segment.loaded = segment.loaded[1:]
+		return s.record(spoolRecord{segment, bytes.TrimSuffix(data, []byte{'\n'})}), true, nil
+	}
+	return nil, false, nil
+}
+
+// unread reports whether there are spooled records not yet produced.
+func (s *spool) unread() bool {
+	if len(s.requeued) > 0 {
+		return true
+	}
+	for _, segment := range s.segments {
+		if !segment.reading || len(segment.loaded) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *spool) record(sr spoolRecord) Record {
+	return record{
+		data: sr.data,
+		ack:  func() error { return s.ack(sr.segment) },
+	}
+}
+
+// passthrough wraps an upstream record handed directly to the forwarder.
+// If it's nacked, we produce it again ourselves, as the pump may be done
+// reading from the upstream.
+func (s *spool) passthrough(upstream Record) Record {
+	return record{
+		data: upstream.Data(),
+		ack:  upstream.Ack,
+	}
+}
+
+// produce numbers a record as it's handed to the forwarder, so that if it's
+// nacked, it's produced again before any record produced after it.
+func (s *spool) produce(r Record) Record {
+	s.mtx.Lock()
+	seq := s.produced
+	s.produced++
+	s.mtx.Unlock()
+	var produced record
+	produced = record{
+		data: r.Data(),
+		ack:  r.Ack,
+		nack: func() error { return s.requeue(seq, produced) },
+	}
+	return produced
+}
+
+// ack removes the segment from disk once all of its records are acked.
+func (s *spool) ack(segment *spoolSegment) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	segment.acked++
+	s.records--
+	if segment.acked != segment.records {
+		s.updateMetrics()
+		return nil
+	}
+	for i := range s.segments {
+		if s.segments[i] == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	s.bytes -= segment.size
+	s.updateMetrics()
+	s.cond.Broadcast()
+	return s.filesys.Remove(segment.path)
+}
+
+func (s *spool) requeue(seq uint64, r Record) error {
+	s.mtx.Lock()
+	i := sort.Search(len(s.requeued), func(i int) bool { return s.requeued[i].seq > seq })
+	s.requeued = append(s.requeued, spoolRequeued{})
+	copy(s.requeued[i+1:], s.requeued[i:])
+	s.requeued[i] = spoolRequeued{seq, r}
+	s.mtx.Unlock()
+	s.signal()
+	return nil
+}
+
+// signal wakes a Next waiting for spooled records.
+func (s *spool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *spool) readFile(path string) ([]byte, error) {
+	f, err := s.filesys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (s *spool) updateMetrics() {
+	s.spoolBytes.Set(float64(s.bytes))
+	s.spoolRecords.Set(float64(s.records))
+}
+
+func (s *spool) Close() error {
+	s.once.Do(func() { close(s.done) })
+	s.mtx.Lock()
+	s.closed = true
+	s.seal()
+	s.cond.Broadcast()
+	s.mtx.Unlock()
+	return s.upstream.Close()
+}
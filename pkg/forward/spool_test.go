@@ -0,0 +1,443 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestSpoolPassthrough(t *testing.T) {
+	t.Parallel()
+
+	filesys := fs.NewVirtualFilesystem()
+	s, m := newTestSpool(t, filesys, newCountingSource(3), 1024*1024, SpoolBlock)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		if want, have := fmt.Sprintf("record-%04d", i), next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+	if want, have := 0, countSpoolFiles(filesys); want != have {
+		t.Errorf("spool files: want %d, have %d", want, have)
+	}
+	if want, have := 0.0, m.records.value(); want != have {
+		t.Errorf("spool records: want %v, have %v", want, have)
+	}
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	t.Parallel()
+
+	// Nobody reads while the upstream produces, as if we were disconnected.
+	var (
+		filesys  = fs.NewVirtualFilesystem()
+		spooled  = 100
+		n        = spoolHandoff + spooled
+		upstream = newCountingSource(n)
+		s, m     = newTestSpool(t, filesys, upstream, 1024*1024, SpoolBlock)
+	)
+	defer s.Close()
+	if !within(5*time.Second, func() bool { return m.records.value() == float64(spooled) }) {
+		t.Fatalf("spool records: want %d, have %v", spooled, m.records.value())
+	}
+	if !within(5*time.Second, func() bool { return upstream.acked() == spooled }) {
+		t.Errorf("upstream acks: want %d, have %d", spooled, upstream.acked()) // only what's on disk
+	}
+
+	// Once we're back, everything comes out in order.
+	var nacked bool
+	for i := 0; i < n; i++ {
+		r, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := fmt.Sprintf("record-%04d", i), string(r.Data()); want != have {
+			t.Fatalf("want %q, have %q", want, have)
+		}
+		if i == n-2 && !nacked {
+			r.Nack() // should come right back
+			nacked = true
+			i--
+			continue
+		}
+		r.Ack()
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+	if want, have := 0, countSpoolFiles(filesys); want != have {
+		t.Errorf("spool files: want %d, have %d", want, have)
+	}
+	if want, have := 0.0, m.bytes.value(); want != have {
+		t.Errorf("spool bytes: want %v, have %v", want, have)
+	}
+}
+
+func TestSpoolNackTwice(t *testing.T) {
+	t.Parallel()
+
+	filesys := fs.NewVirtualFilesystem()
+	s, _ := newTestSpool(t, filesys, newCountingSource(3), 1024*1024, SpoolBlock)
+	defer s.Close()
+	r0, _ := s.Next()
+	r1, _ := s.Next()
+	r0.Nack()
+	r1.Nack()
+
+	// record-0000 is nacked again after record-0001, but still comes back
+	// before it.
+	r0, _ = s.Next()
+	r0.Nack()
+	for i := 0; i < 3; i++ {
+		if want, have := fmt.Sprintf("record-%04d", i), next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestSpoolPolicy(t *testing.T) {
+	t.Parallel()
+
+	const (
+		recordSize = int64(len("record-0000\n"))
+		capacity   = 32 // records
+		spooled    = 100
+	)
+	for _, testcase := range []struct {
+		name   string
+		policy SpoolPolicy
+	}{
+		{"block", SpoolBlock},
+		{"drop-oldest", SpoolDropOldest},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				n        = spoolHandoff + spooled
+				upstream = newCountingSource(n)
+				s, m     = newTestSpool(t, fs.NewVirtualFilesystem(), upstream, capacity*recordSize, testcase.policy)
+			)
+			defer s.Close()
+
+			// Fill the spool, and let the policy kick in.
+			if !within(5*time.Second, func() bool { return m.records.value() == capacity }) {
+				t.Fatalf("spool records: want %d, have %v", capacity, m.records.value())
+			}
+			time.Sleep(50 * time.Millisecond)
+			switch testcase.policy {
+			case SpoolBlock:
+				if produced := upstream.produced(); produced >= n {
+					t.Errorf("upstream wasn't blocked: produced %d", produced)
+				}
+			case SpoolDropOldest:
+				if !within(5*time.Second, func() bool { return upstream.produced() == n }) {
+					t.Fatalf("upstream was blocked: produced %d", upstream.produced())
+				}
+			}
+
+			// Drain it. Records are in order, and only the oldest may be missing.
+			var (
+				have []int
+				errc = make(chan error, 1)
+			)
+			go func() {
+				for {
+					r, err := s.Next()
+					if err != nil {
+						errc <- err
+						return
+					}
+					var i int
+					fmt.Sscanf(string(r.Data()), "record-%d", &i)
+					have = append(have, i)
+					r.Ack()
+				}
+			}()
+			select {
+			case err := <-errc:
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout draining the spool")
+			}
+			for i := 1; i < len(have); i++ {
+				if have[i] <= have[i-1] {
+					t.Fatalf("records out of order: %d after %d", have[i], have[i-1])
+				}
+			}
+			if want, have := n-1, have[len(have)-1]; want != have {
+				t.Errorf("last record: want %d, have %d", want, have)
+			}
+			dropped := int(m.dropped.value())
+			switch testcase.policy {
+			case SpoolBlock:
+				if want, have := n, len(have); want != have || dropped != 0 {
+					t.Errorf("want %d records, have %d, %d dropped", want, have, dropped)
+				}
+			case SpoolDropOldest:
+				if dropped <= 0 || len(have)+dropped != n {
+					t.Errorf("have %d records, %d dropped, want %d total", len(have), dropped, n)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	t.Parallel()
+
+	var (
+		filesys = fs.NewVirtualFilesystem()
+		spooled = 10
+		s, m    = newTestSpool(t, filesys, newCountingSource(spoolHandoff+spooled), 1024*1024, SpoolBlock)
+	)
+	if !within(5*time.Second, func() bool { return m.records.value() == float64(spooled) }) {
+		t.Fatalf("spool records: want %d, have %v", spooled, m.records.value())
+	}
+	s.Close()
+
+	// A new spool in the same place picks up where the last one left off.
+	s, m = newTestSpool(t, filesys, newCountingSource(0), 1024*1024, SpoolBlock)
+	defer s.Close()
+	if want, have := float64(spooled), m.records.value(); want != have {
+		t.Errorf("recovered records: want %v, have %v", want, have)
+	}
+	for i := spoolHandoff; i < spoolHandoff+spooled; i++ {
+		if want, have := fmt.Sprintf("record-%04d", i), next(t, s); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestSpoolRecoveryTornTail(t *testing.T) {
+	t.Parallel()
+
+	// The last record was cut short by a crash.
+	filesys := fs.NewVirtualFilesystem()
+	if err := filesys.MkdirAll("/spool"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := filesys.Create("/spool/00000000000000000000.spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("record-a\nrecord-b\nrec"))
+	f.Close()
+
+	s, m := newTestSpool(t, filesys, newCountingSource(0), 1024*1024, SpoolBlock)
+	defer s.Close()
+	if want, have := 2.0, m.records.value(); want != have {
+		t.Errorf("recovered records: want %v, have %v", want, have)
+	}
+	if want, have := 18.0, m.bytes.value(); want != have {
+		t.Errorf("recovered bytes: want %v, have %v", want, have)
+	}
+	for _, want := range []string{"record-a", "record-b"} {
+		r, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(r.Data()); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+		r.Ack()
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+
+	// Once both are acked, the segment is gone, and counted out once.
+	if want, have := 0, countSpoolFiles(filesys); want != have {
+		t.Errorf("spool files: want %d, have %d", want, have)
+	}
+	if want, have := 0.0, m.records.value(); want != have {
+		t.Errorf("spool records: want %v, have %v", want, have)
+	}
+	if want, have := 0.0, m.bytes.value(); want != have {
+		t.Errorf("spool bytes: want %v, have %v", want, have)
+	}
+}
+
+func TestSpoolSyncsInBatches(t *testing.T) {
+	t.Parallel()
+
+	var (
+		filesys  = &syncCountingFilesystem{Filesystem: fs.NewVirtualFilesystem()}
+		spooled  = 4 * spoolHandoff
+		upstream = newCountingSource(spoolHandoff + spooled)
+		s, m     = newTestSpool(t, filesys, upstream, 1024*1024, SpoolBlock)
+	)
+	defer s.Close()
+	if !within(5*time.Second, func() bool { return upstream.acked() == spooled }) {
+		t.Fatalf("upstream acks: want %d, have %d", spooled, upstream.acked())
+	}
+	if want, have := float64(spooled), m.records.value(); want != have {
+		t.Errorf("spool records: want %v, have %v", want, have)
+	}
+	if have := filesys.syncs(); have <= 0 || have >= spooled/2 {
+		t.Errorf("%d syncs for %d spooled records", have, spooled)
+	}
+}
+
+type spoolMetrics struct {
+	bytes, records *mockGauge
+	dropped        *mockCounter
+}
+
+func newTestSpool(t *testing.T, filesys fs.Filesystem, upstream Source, maxBytes int64, policy SpoolPolicy) (Source, spoolMetrics) {
+	m := spoolMetrics{
+		bytes:   &mockGauge{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{})},
+		records: &mockGauge{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{})},
+		dropped: &mockCounter{Counter: prometheus.NewCounter(prometheus.CounterOpts{})},
+	}
+	s, err := NewSpool(upstream, filesys, "/spool", maxBytes, policy, m.bytes, m.records, m.dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, m
+}
+
+func countSpoolFiles(filesys fs.Filesystem) (n int) {
+	filesys.Walk("/spool", func(path string, info os.FileInfo, err error) error {
+		if filepath.Ext(path) == extSpool {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// countingSource produces n numbered records, and then io.EOF.
+type countingSource struct {
+	mtx   sync.Mutex
+	n, i  int
+	acks  int
+	nacks requeue
+}
+
+func newCountingSource(n int) *countingSource {
+	return &countingSource{n: n}
+}
+
+func (s *countingSource) Next() (Record, error) {
+	if r, ok := s.nacks.pop(); ok {
+		return r, nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.i >= s.n {
+		return nil, io.EOF
+	}
+	var (
+		seq  = uint64(s.i)
+		data = []byte(fmt.Sprintf("record-%04d", s.i))
+	)
+	s.i++
+	return record{
+		data: data,
+		ack:  func() error { s.mtx.Lock(); s.acks++; s.mtx.Unlock(); return nil },
+		nack: func() error { s.nacks.push(seq, data); return nil },
+	}, nil
+}
+
+func (s *countingSource) Close() error { return nil }
+
+func (s *countingSource) produced() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.i
+}
+
+func (s *countingSource) acked() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.acks
+}
+
+type mockGauge struct {
+	prometheus.Gauge
+	mtx sync.Mutex
+	v   float64
+}
+
+func (g *mockGauge) Set(v float64) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.v = v
+}
+
+func (g *mockGauge) value() float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.v
+}
+
+type mockCounter struct {
+	prometheus.Counter
+	mtx sync.Mutex
+	v   float64
+}
+
+func (c *mockCounter) Add(v float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.v += v
+}
+
+func (c *mockCounter) value() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.v
+}
+
+func within(d time.Duration, f func() bool) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if f() {
+			return true
+		}
+		time.Sleep(d / 50)
+	}
+	return false
+}
+
+// syncCountingFilesystem counts syncs of the files it creates.
+type syncCountingFilesystem struct {
+	fs.Filesystem
+	mtx sync.Mutex
+	n   int
+}
+
+func (fs *syncCountingFilesystem) Create(path string) (fs.File, error) {
+	f, err := fs.Filesystem.Create(path)
+	return &syncCountingFile{File: f, fs: fs}, err
+}
+
+func (fs *syncCountingFilesystem) syncs() int {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return fs.n
+}
+
+type syncCountingFile struct {
+	fs.File
+	fs *syncCountingFilesystem
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.fs.mtx.Lock()
+	f.fs.n++
+	f.fs.mtx.Unlock()
+	return f.File.Sync()
+}
@@ -3,6 +3,7 @@ package fs
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -32,7 +33,7 @@ func (fs *virtualFilesystem) Create(path string) (File, error) {
 		mtime: time.Now(),
 	}
 	fs.files[path] = f
-	return f, nil
+	return &virtualHandle{virtualFile: f}, nil
 }
 
 func (fs *virtualFilesystem) Open(path string) (File, error) {
@@ -42,7 +43,7 @@ func (fs *virtualFilesystem) Open(path string) (File, error) {
 	if !ok {
 		return nil, os.ErrNotExist
 	}
-	return f, nil
+	return &virtualHandle{virtualFile: f}, nil
 }
 
 func (fs *virtualFilesystem) Remove(path string) error {
@@ -64,6 +65,9 @@ func (fs *virtualFilesystem) Rename(oldname, newname string) error {
 	}
 	delete(fs.files, oldname)
 	fs.files[newname] = f // potentially destructive to newname!
+	f.mtx.Lock()
+	f.name = newname // like an *os.File opened at the new path
+	f.mtx.Unlock()
 	return nil
 }
 
@@ -104,8 +108,8 @@ func (fs *virtualFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
 			continue // TODO(pb): this heuristic could be better, if necessary
 		}
 		if err := walkFn(path, virtualFileInfo{
-			name:  f.name,
-			size:  int64(f.buf.Len()),
+			name:  f.Name(),
+			size:  f.Size(),
 			mtime: f.mtime,
 		}, nil); err != nil {
 			return err
@@ -144,28 +148,59 @@ type virtualFile struct {
 	mtime time.Time
 }
 
-func (f *virtualFile) Read(p []byte) (int, error) {
+func (f *virtualFile) Write(p []byte) (int, error) {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
-	return f.buf.Read(p)
+	return f.buf.Write(p)
 }
 
-func (f *virtualFile) Write(p []byte) (int, error) {
+func (f *virtualFile) Name() string {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
-	return f.buf.Write(p)
+	return f.name
 }
 
-func (f *virtualFile) Close() error { return nil }
-func (f *virtualFile) Name() string { return f.name }
-
 func (f *virtualFile) Size() int64 {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 	return int64(f.buf.Len())
 }
 
-func (f *virtualFile) Sync() error { return nil }
+// virtualHandle is an open virtualFile. Like an *os.File, each handle has its
+// own read offset, so reading through one handle doesn't consume the contents
+// for everyone else.
+type virtualHandle struct {
+	*virtualFile
+	off int
+}
+
+func (h *virtualHandle) Read(p []byte) (int, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.off >= h.buf.Len() {
+		return 0, io.EOF
+	}
+	n := copy(p, h.buf.Bytes()[h.off:])
+	h.off += n
+	return n, nil
+}
+
+func (h *virtualHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if off >= int64(h.buf.Len()) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.buf.Bytes()[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *virtualHandle) Close() error { return nil }
+
+func (h *virtualHandle) Sync() error { return nil }
 
 type virtualFileInfo struct {
 	name  string
@@ -1,7 +1,9 @@
 package ingest
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,6 +21,7 @@ const (
 	APIPathRead         = "/read"
 	APIPathCommit       = "/commit"
 	APIPathFailed       = "/failed"
+	APIPathWrite        = "/write"
 	APIPathSegmentState = "/_segmentstate"
 	APIPathClusterState = "/_clusterstate"
 )
@@ -28,12 +31,19 @@ type API struct {
 	peer              ClusterPeer
 	log               Log
 	timeout           time.Duration
+	flushAge          time.Duration
+	flushSize         int
 	pending           map[string]pendingSegment
 	action            chan func()
 	stop              chan chan struct{}
 	failedSegments    prometheus.Counter
 	committedSegments prometheus.Counter
 	committedBytes    prometheus.Counter
+	writerBytes       prometheus.Counter
+	writerRecords     prometheus.Counter
+	writerSyncs       prometheus.Counter
+	segmentAge        prometheus.Histogram
+	segmentSize       prometheus.Histogram
 	duration          *prometheus.HistogramVec
 }
 
@@ -53,19 +63,30 @@ func NewAPI(
 	peer ClusterPeer,
 	log Log,
 	pendingSegmentTimeout time.Duration,
+	segmentFlushAge time.Duration,
+	segmentFlushSize int,
 	failedSegments, committedSegments, committedBytes prometheus.Counter,
+	writerBytes, writerRecords, writerSyncs prometheus.Counter,
+	segmentAge, segmentSize prometheus.Histogram,
 	duration *prometheus.HistogramVec,
 ) *API {
 	a := &API{
 		peer:              peer,
 		log:               log,
 		timeout:           pendingSegmentTimeout,
+		flushAge:          segmentFlushAge,
+		flushSize:         segmentFlushSize,
 		pending:           map[string]pendingSegment{},
 		action:            make(chan func()),
 		stop:              make(chan chan struct{}),
 		failedSegments:    failedSegments,
 		committedSegments: committedSegments,
 		committedBytes:    committedBytes,
+		writerBytes:       writerBytes,
+		writerRecords:     writerRecords,
+		writerSyncs:       writerSyncs,
+		segmentAge:        segmentAge,
+		segmentSize:       segmentSize,
 		duration:          duration,
 	}
 	go a.loop()
@@ -94,6 +115,8 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.handleCommit(w, r)
 	case method == "POST" && path == APIPathFailed:
 		a.handleFailed(w, r)
+	case method == "POST" && path == APIPathWrite:
+		a.handleWrite(w, r)
 	case method == "GET" && path == APIPathSegmentState:
 		a.handleSegmentStatus(w, r)
 	case method == "GET" && path == APIPathClusterState:
@@ -286,6 +309,92 @@ func (a *API) handleFailed(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// WriteResult is returned by the write endpoint. Low and High are the ULIDs of
+// the first and last accepted records, and are empty if Records is zero.
+type WriteResult struct {
+	Records int    `json:"records"`
+	Low     string `json:"low,omitempty"`
+	High    string `json:"high,omitempty"`
+}
+
+// handleWrite ingests newline-delimited records from the request body, which
+// may be gzip-encoded. Each request is treated like a connection to the fast
+// listener: it gets its own Writer and ID generator. With sync=true, the
+// records are synced to disk before we respond.
+func (a *API) handleWrite(w http.ResponseWriter, r *http.Request) {
+	var sync bool
+	if s := r.URL.Query().Get("sync"); s != "" {
+		var err error
+		if sync, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	wr, err := NewWriter(
+		a.log, a.flushAge, a.flushSize,
+		a.writerBytes, a.writerRecords, a.writerSyncs,
+		a.segmentAge, a.segmentSize,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer wr.Stop() // make sure it's flushed
+
+	var (
+		idGen  = newIDGenerator()
+		result WriteResult
+		s      = bufio.NewScanner(body)
+	)
+	s.Split(scanLinesPreserveNewline)
+	for s.Scan() {
+		line := s.Bytes()
+		if line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		id := idGen()
+		if _, err := fmt.Fprintf(wr, "%s %s", id, line); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result.Records == 0 {
+			result.Low = id
+		}
+		result.High = id
+		result.Records++
+	}
+	if err := s.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("accepted %d record(s) before error: %v", result.Records, err), http.StatusBadRequest)
+		return
+	}
+	if sync && result.Records > 0 {
+		if err := wr.Sync(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	buf, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
 func (a *API) handleSegmentStatus(w http.ResponseWriter, r *http.Request) {
 	status := make(chan string)
 	a.action <- func() {
@@ -296,7 +405,7 @@ func (a *API) handleSegmentStatus(w http.ResponseWriter, r *http.Request) {
 		}
 		status <- buf.String()
 	}
-	fmt.Fprintf(w, <-status)
+	fmt.Fprint(w, <-status)
 }
 
 func (a *API) handleClusterState(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,148 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestAPIWrite(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name   string
+		path   string
+		gzip   bool
+		body   string
+		code   int
+		result WriteResult
+	}{
+		{"plain", APIPathWrite, false, "foo\nbar\nbaz\n", http.StatusOK, WriteResult{Records: 3}},
+		{"no trailing newline", APIPathWrite, false, "foo\nbar", http.StatusOK, WriteResult{Records: 2}},
+		{"gzip", APIPathWrite, true, "foo\nbar\n", http.StatusOK, WriteResult{Records: 2}},
+		{"sync", APIPathWrite + "?sync=true", false, "foo\n", http.StatusOK, WriteResult{Records: 1}},
+		{"empty", APIPathWrite, false, "", http.StatusOK, WriteResult{Records: 0}},
+		{"bad sync", APIPathWrite + "?sync=maybe", false, "foo\n", http.StatusBadRequest, WriteResult{}},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			log, err := NewFileLog(fs.NewVirtualFilesystem(), "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			api := newTestAPI(log, 1024*1024)
+			defer api.Stop()
+
+			var body io.Reader = strings.NewReader(testcase.body)
+			if testcase.gzip {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				gz.Write([]byte(testcase.body))
+				gz.Close()
+				body = &buf
+			}
+			req := httptest.NewRequest("POST", testcase.path, body)
+			if testcase.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("code: want %d, have %d (%s)", want, have, strings.TrimSpace(rec.Body.String()))
+			}
+			if testcase.code != http.StatusOK {
+				return
+			}
+
+			var result WriteResult
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.result.Records, result.Records; want != have {
+				t.Fatalf("records: want %d, have %d", want, have)
+			}
+			if result.Records == 0 {
+				if _, err := log.Oldest(); err != ErrNoSegmentsAvailable {
+					t.Errorf("want %v, have %v", ErrNoSegmentsAvailable, err)
+				}
+				return
+			}
+
+			// The records were flushed with IDs spanning the reported range.
+			segment, err := log.Oldest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadAll(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+			if want, have := result.Records, len(lines); want != have {
+				t.Fatalf("segment: want %d records, have %d: %q", want, have, buf)
+			}
+			if want, have := result.Low, strings.Fields(lines[0])[0]; want != have {
+				t.Errorf("low: want %q, have %q", want, have)
+			}
+			if want, have := result.High, strings.Fields(lines[len(lines)-1])[0]; want != have {
+				t.Errorf("high: want %q, have %q", want, have)
+			}
+			for i, record := range strings.Split(strings.TrimSuffix(testcase.body, "\n"), "\n") {
+				if want, have := record, strings.SplitN(lines[i], " ", 2)[1]; want != have {
+					t.Errorf("record %d: want %q, have %q", i+1, want, have)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIWriteSyncRotates(t *testing.T) {
+	t.Parallel()
+
+	filesys := &syncCheckingFilesystem{Filesystem: fs.NewVirtualFilesystem()}
+	log, err := NewFileLog(filesys, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	api := newTestAPI(log, 1) // every record fills a segment
+	defer api.Stop()
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("POST", APIPathWrite+"?sync=true", strings.NewReader("foo\nbar\nbaz\n")))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("code: want %d, have %d (%s)", want, have, strings.TrimSpace(rec.Body.String()))
+	}
+	if have := filesys.unsyncedCloses(); have > 0 {
+		t.Errorf("%d segments were closed with records that weren't synced", have)
+	}
+}
+
+func newTestAPI(log Log, flushSize int) *API {
+	return NewAPI(
+		nil,
+		log,
+		time.Minute,
+		time.Minute, flushSize,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"method", "path", "status_code"}),
+	)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
@@ -44,10 +45,8 @@ func HandleConnections(
 			return err
 		}
 
-		// Create a new entropy source and ID generator for this connection.
-		// rand.New is not goroutine safe!
-		entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
-		idGen := func() string { return ulid.MustNew(ulid.Now(), entropy).String() }
+		// Create a new ID generator for this connection.
+		idGen := newIDGenerator()
 
 		// Register the connection in the manager, and launch the handler.
 		// The handler may exit from the client, or via manager shutdown.
@@ -65,10 +64,16 @@ func HandleConnections(
 type ConnectionHandler func(conn net.Conn, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) error
 
 // HandleFastWriter is a ConnectionHandler that writes records to the IngestLog.
+// The client first receives an "OK" line, once the connection is accepted.
+// Clients should wait for it before writing: a connection refused by a
+// LoadMonitor receives a line beginning with "ERR" instead.
 func HandleFastWriter(conn net.Conn, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) (err error) {
 	connectedClients.Inc()
 	defer connectedClients.Dec()
 	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "OK\n"); err != nil {
+		return err
+	}
 	s := bufio.NewScanner(conn)
 	s.Split(scanLinesPreserveNewline)
 	for s.Scan() {
@@ -80,9 +85,144 @@ func HandleFastWriter(conn net.Conn, w *Writer, idGen IDGenerator, connectedClie
 	return s.Err()
 }
 
+// HandleDurableWriter is a ConnectionHandler that writes records to the
+// IngestLog, and syncs them to disk before acknowledging them. Records that
+// arrive together are synced as a batch. Each record is acknowledged with a
+// line containing its assigned ULID, in the order the records were received.
+// If a write or sync fails, the client receives a line beginning with "ERR"
+// and the connection is closed; records without an ack should be retried.
+func HandleDurableWriter(conn net.Conn, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) (err error) {
+	connectedClients.Inc()
+	defer connectedClients.Dec()
+	defer conn.Close()
+	defer func() {
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(conn, "ERR %v\n", err)
+		}
+	}()
+	var (
+		r   = bufio.NewReader(conn)
+		ids []string // written but not yet synced
+	)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			id := idGen()
+			if _, err := fmt.Fprintf(w, "%s %s", id, line); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if readErr == nil && r.Buffered() > 0 {
+			continue // more of this batch is already here
+		}
+		if len(ids) > 0 {
+			if err := w.Sync(); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if _, err := fmt.Fprintf(conn, "%s\n", id); err != nil {
+					return err
+				}
+			}
+			ids = ids[:0]
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// HandleBulkWriter is a ConnectionHandler that writes the entire payload of a
+// connection to a single new segment in the IngestLog. Clients should write
+// their records, and then close their side of the connection for writing.
+// The segment is synced and made available for consumption only once the full
+// payload has arrived, so a batch is either ingested completely or not at all.
+// The client receives a single line: "OK <records> <low ULID> <high ULID>" on
+// success, or a line beginning with "ERR" on failure.
+func HandleBulkWriter(conn net.Conn, w *Writer, idGen IDGenerator, connectedClients prometheus.Gauge) (err error) {
+	connectedClients.Inc()
+	defer connectedClients.Dec()
+	defer conn.Close()
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(conn, "ERR %v\n", err)
+		}
+	}()
+
+	// The per-connection Writer is bypassed; the bulk segment is ours alone.
+	segment, err := w.log.Create()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Don't leave partial batches lying around.
+		if segment != nil {
+			segment.Delete()
+		}
+	}()
+
+	var (
+		records, sz int
+		low, high   string
+		s           = bufio.NewScanner(conn)
+	)
+	s.Split(scanLinesPreserveNewline)
+	for s.Scan() {
+		line := s.Bytes()
+		if line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		id := idGen()
+		n, err := fmt.Fprintf(segment, "%s %s", id, line)
+		if err != nil {
+			return err
+		}
+		if records == 0 {
+			low = id
+		}
+		high = id
+		records++
+		sz += n
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if records == 0 {
+		fmt.Fprintf(conn, "OK 0\n")
+		return nil
+	}
+	if err := segment.Sync(); err != nil {
+		return err
+	}
+	w.syncs.Inc()
+	if err := segment.Close(); err != nil {
+		return err
+	}
+	segment = nil
+	w.bytes.Add(float64(sz))
+	w.records.Add(float64(records))
+	w.size.Observe(float64(sz))
+	fmt.Fprintf(conn, "OK %d %s %s\n", records, low, high)
+	return nil
+}
+
 // IDGenerator should return unique record identifiers, i.e. ULIDs.
 type IDGenerator func() string
 
+// newIDGenerator returns an IDGenerator with its own entropy source.
+// rand.New is not goroutine safe, so each connection needs its own.
+func newIDGenerator() IDGenerator {
+	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func() string { return ulid.MustNew(ulid.Now(), entropy).String() }
+}
+
 // Like bufio.ScanLines, but retain the \n.
 func scanLinesPreserveNewline(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
@@ -2,7 +2,9 @@ package ingest
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"path/filepath"
 	"sync/atomic"
@@ -101,6 +103,276 @@ func TestHandleConnectionsCleanup(t *testing.T) {
 	}
 }
 
+func TestHandleFastWriter(t *testing.T) {
+	t.Parallel()
+
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	w, err := NewWriter(
+		log, time.Minute, 1024*1024,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		client, server = net.Pipe()
+		errc           = make(chan error, 1)
+	)
+	go func() {
+		errc <- HandleFastWriter(server, w, func() string { return "ID" }, prometheus.NewGauge(prometheus.GaugeOpts{}))
+	}()
+
+	// The connection is accepted before we write anything.
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "OK\n" {
+		t.Fatalf("want OK, have %q (%v)", line, err)
+	}
+	fmt.Fprint(client, "foo\nbar\n")
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+
+	segment, err := log.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(segment); err != nil {
+		t.Fatal(err)
+	} else if want, have := "ID foo\nID bar\n", string(buf); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestHandleDurableWriter(t *testing.T) {
+	t.Parallel()
+
+	filesys := fs.NewVirtualFilesystem()
+	log, err := NewFileLog(filesys, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	syncs := &mockCounter{Counter: prometheus.NewCounter(prometheus.CounterOpts{})}
+	w, err := NewWriter(
+		log, time.Minute, 1024*1024,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		syncs,
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drive the handler over an in-memory connection.
+	var (
+		client, server = net.Pipe()
+		idc            = make(chan string, 3)
+		errc           = make(chan error, 1)
+		n              = 0
+	)
+	idGen := func() string {
+		n++
+		id := fmt.Sprintf("ID%d", n)
+		idc <- id
+		return id
+	}
+	go func() {
+		errc <- HandleDurableWriter(server, w, idGen, prometheus.NewGauge(prometheus.GaugeOpts{}))
+	}()
+	go fmt.Fprint(client, "foo\nbar\nbaz\n")
+
+	// Every record is acknowledged with its ID, in order.
+	s := bufio.NewScanner(client)
+	for i := 0; i < 3; i++ {
+		if !s.Scan() {
+			t.Fatalf("ack %d: %v", i+1, s.Err())
+		}
+		if want, have := <-idc, s.Text(); want != have {
+			t.Errorf("ack %d: want %q, have %q", i+1, want, have)
+		}
+	}
+	if atomic.LoadUint64(&syncs.n) <= 0 {
+		t.Error("records were acknowledged without a sync")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("handler: %v", err)
+	}
+	w.Stop()
+
+	// The records were written, with IDs, to a flushed segment.
+	segment, err := log.Oldest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "ID1 foo\nID2 bar\nID3 baz\n", string(buf); want != have {
+		t.Errorf("segment: want %q, have %q", want, have)
+	}
+}
+
+func TestHandleDurableWriterRotates(t *testing.T) {
+	t.Parallel()
+
+	filesys := &syncCheckingFilesystem{Filesystem: fs.NewVirtualFilesystem()}
+	log, err := NewFileLog(filesys, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	// Every record fills a segment, so they're rotated before the sync.
+	w, err := NewWriter(
+		log, time.Minute, 1,
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewCounter(prometheus.CounterOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	var (
+		client, server = net.Pipe()
+		errc           = make(chan error, 1)
+		n              = 0
+	)
+	idGen := func() string { n++; return fmt.Sprintf("ID%d", n) }
+	go func() {
+		errc <- HandleDurableWriter(server, w, idGen, prometheus.NewGauge(prometheus.GaugeOpts{}))
+	}()
+	go fmt.Fprint(client, "foo\nbar\nbaz\n")
+
+	s := bufio.NewScanner(client)
+	for i := 0; i < 3; i++ {
+		if !s.Scan() {
+			t.Fatalf("ack %d: %v", i+1, s.Err())
+		}
+	}
+	if have := filesys.unsyncedCloses(); have > 0 {
+		t.Errorf("%d segments were closed with records that weren't synced", have)
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("handler: %v", err)
+	}
+}
+
+func TestHandleBulkWriter(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name    string
+		failing bool
+		ack     string
+		segment string
+	}{
+		{"success", false, "OK 3 ID1 ID3", "ID1 foo\nID2 bar\nID3 baz\n"},
+		{"failed sync", true, "ERR sync failed", ""},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			filesys := fs.NewVirtualFilesystem()
+			fileLog, err := NewFileLog(filesys, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fileLog.Close()
+			var log Log = fileLog
+			if testcase.failing {
+				log = failingSyncLog{log}
+			}
+			w, err := NewWriter(
+				log, time.Minute, 1024*1024,
+				prometheus.NewCounter(prometheus.CounterOpts{}),
+				prometheus.NewCounter(prometheus.CounterOpts{}),
+				prometheus.NewCounter(prometheus.CounterOpts{}),
+				prometheus.NewHistogram(prometheus.HistogramOpts{}),
+				prometheus.NewHistogram(prometheus.HistogramOpts{}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// We need a half-close, so use a real connection.
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			var (
+				errc  = make(chan error, 1)
+				n     = 0
+				idGen = func() string { n++; return fmt.Sprintf("ID%d", n) }
+			)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					errc <- err
+					return
+				}
+				errc <- HandleBulkWriter(conn, w, idGen, prometheus.NewGauge(prometheus.GaugeOpts{}))
+			}()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, "foo\nbar\nbaz")
+			conn.(*net.TCPConn).CloseWrite()
+
+			// The whole batch gets exactly one response.
+			buf, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.ack+"\n", string(buf); want != have {
+				t.Errorf("ack: want %q, have %q", want, have)
+			}
+			if err := <-errc; (err != nil) != testcase.failing {
+				t.Errorf("handler: %v", err)
+			}
+			w.Stop()
+
+			// Either the full batch is in a flushed segment, or nothing is.
+			segment, err := fileLog.Oldest()
+			if testcase.segment == "" {
+				if err != ErrNoSegmentsAvailable {
+					t.Fatalf("want %v, have %v", ErrNoSegmentsAvailable, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err = ioutil.ReadAll(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.segment, string(buf); want != have {
+				t.Errorf("segment: want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
 func echo(t *testing.T) ConnectionHandler {
 	return func(conn net.Conn, w *Writer, _ IDGenerator, _ prometheus.Gauge) error {
 		s := bufio.NewScanner(conn)
@@ -123,6 +395,47 @@ func within(d time.Duration, f func() bool) bool {
 	return false
 }
 
+type failingSyncLog struct{ Log }
+
+func (log failingSyncLog) Create() (WriteSegment, error) {
+	segment, err := log.Log.Create()
+	return failingSyncSegment{segment}, err
+}
+
+type failingSyncSegment struct{ WriteSegment }
+
+func (failingSyncSegment) Sync() error { return errors.New("sync failed") }
+
+// syncCheckingFilesystem counts files closed with writes that weren't synced.
+type syncCheckingFilesystem struct {
+	fs.Filesystem
+	unsynced uint64
+}
+
+func (fs *syncCheckingFilesystem) Create(path string) (fs.File, error) {
+	f, err := fs.Filesystem.Create(path)
+	return &syncCheckingFile{File: f, unsynced: &fs.unsynced}, err
+}
+
+func (fs *syncCheckingFilesystem) unsyncedCloses() uint64 {
+	return atomic.LoadUint64(&fs.unsynced)
+}
+
+type syncCheckingFile struct {
+	fs.File
+	dirty    bool
+	unsynced *uint64
+}
+
+func (f *syncCheckingFile) Write(p []byte) (int, error) { f.dirty = true; return f.File.Write(p) }
+func (f *syncCheckingFile) Sync() error                 { f.dirty = false; return f.File.Sync() }
+func (f *syncCheckingFile) Close() error {
+	if f.dirty {
+		atomic.AddUint64(f.unsynced, 1)
+	}
+	return f.File.Close()
+}
+
 type mockFilesystem struct{ wr, cl uint64 }
 
 func (fs *mockFilesystem) Create(path string) (fs.File, error)               { return &mockFile{&fs.wr, &fs.cl}, nil }
@@ -144,6 +457,13 @@ func (f *mockFile) Name() string                { return "" }
 func (f *mockFile) Size() int64                 { return 0 }
 func (f *mockFile) Sync() error                 { return nil }
 
+type mockCounter struct {
+	prometheus.Counter
+	n uint64
+}
+
+func (c *mockCounter) Inc() { atomic.AddUint64(&c.n, 1); c.Counter.Inc() }
+
 type mockReleaser struct{}
 
 func (mockReleaser) Release() error { return nil }
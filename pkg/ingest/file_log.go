@@ -176,8 +176,14 @@ func (w fileWriteSegment) Sync() error {
 	return w.f.Sync()
 }
 
-// Close closes the segment and makes it available for read.
+// Close syncs and closes the segment, and makes it available for read. It's
+// synced first, as records written since the last Sync may already have been
+// acknowledged, if the Writer rotated the segment in between.
 func (w fileWriteSegment) Close() error {
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
 	if err := w.f.Close(); err != nil {
 		return err
 	}
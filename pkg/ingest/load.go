@@ -0,0 +1,155 @@
+package ingest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+)
+
+// LoadMonitor periodically measures the load on this ingester, and publishes
+// it, typically to the cluster. While the backlog of records not yet consumed
+// by the store tier is over maxBacklog, refusing listeners send new
+// connections an "ERR" line and close them straight away, and writes to the
+// API are refused, so that forwarders move on to another ingester.
+type LoadMonitor struct {
+	log        Log
+	maxBacklog int64
+	publish    func(cluster.Load)
+	refused    prometheus.Counter
+	conns      int64 // atomic
+	overloaded int32 // atomic
+	stop       chan chan struct{}
+}
+
+// NewLoadMonitor returns a LoadMonitor for the log. A maxBacklog of zero means
+// connections are never refused.
+func NewLoadMonitor(log Log, maxBacklog int64, publish func(cluster.Load), refused prometheus.Counter) *LoadMonitor {
+	return &LoadMonitor{
+		log:        log,
+		maxBacklog: maxBacklog,
+		publish:    publish,
+		refused:    refused,
+		stop:       make(chan chan struct{}),
+	}
+}
+
+// Listener wraps the listener, counting its connections toward our load. If
+// refuse is true, connections accepted while we're overloaded receive a line
+// beginning with "ERR", and are closed. Clients must not consider anything
+// they wrote accepted until they get the handler's reply, e.g. the "OK" line
+// that HandleFastWriter starts with.
+func (m *LoadMonitor) Listener(ln net.Listener, refuse bool) net.Listener {
+	return &loadListener{Listener: ln, m: m, refuse: refuse}
+}
+
+// Handler wraps the ingest API, counting write requests toward our load while
+// they're served. Writes that arrive while we're overloaded are refused with
+// 503 Service Unavailable.
+func (m *LoadMonitor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != APIPathWrite {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if m.Overloaded() {
+			m.refused.Inc()
+			http.Error(w, errOverloaded, http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt64(&m.conns, 1)
+		defer atomic.AddInt64(&m.conns, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errOverloaded is why connections and writes are refused.
+const errOverloaded = "ingester overloaded; try another"
+
+// Overloaded reports whether the last measurement was over the threshold.
+func (m *LoadMonitor) Overloaded() bool {
+	return atomic.LoadInt32(&m.overloaded) == 1
+}
+
+// Run measures and publishes the load every interval, until stopped.
+func (m *LoadMonitor) Run(interval time.Duration) {
+	m.measure()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.measure()
+		case q := <-m.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the LoadMonitor.
+func (m *LoadMonitor) Stop() {
+	q := make(chan struct{})
+	m.stop <- q
+	<-q
+}
+
+func (m *LoadMonitor) measure() {
+	stats, err := m.log.Stats()
+	if err != nil {
+		return // try again next time
+	}
+	load := cluster.Load{
+		ConnectedClients: atomic.LoadInt64(&m.conns),
+		ActiveBytes:      stats.ActiveBytes,
+		FlushedBytes:     stats.FlushedBytes,
+		PendingBytes:     stats.PendingBytes,
+	}
+	var overloaded int32
+	if m.maxBacklog > 0 && load.Backlog() > m.maxBacklog {
+		overloaded = 1
+	}
+	atomic.StoreInt32(&m.overloaded, overloaded)
+	m.publish(load)
+}
+
+type loadListener struct {
+	net.Listener
+	m      *LoadMonitor
+	refuse bool
+}
+
+func (ln *loadListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.refuse && ln.m.Overloaded() {
+			fmt.Fprintf(conn, "ERR %s\n", errOverloaded)
+			conn.Close()
+			ln.m.refused.Inc()
+			continue
+		}
+		atomic.AddInt64(&ln.m.conns, 1)
+		return &loadConn{Conn: conn, m: ln.m}, nil
+	}
+}
+
+// loadConn stops counting toward our load once it's closed.
+type loadConn struct {
+	net.Conn
+	m    *LoadMonitor
+	once sync.Once
+}
+
+func (c *loadConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.m.conns, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,173 @@
+package ingest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestLoadMonitor(t *testing.T) {
+	t.Parallel()
+
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	var (
+		mtx  sync.Mutex
+		last cluster.Load
+	)
+	publish := func(load cluster.Load) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		last = load
+	}
+	published := func() cluster.Load {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return last
+	}
+	m := NewLoadMonitor(log, 10, publish, prometheus.NewCounter(prometheus.CounterOpts{}))
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := m.Listener(tcp, true)
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// Idle: connections are accepted, and counted.
+	m.measure()
+	if m.Overloaded() {
+		t.Fatal("overloaded while idle")
+	}
+	client, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+	m.measure()
+	if want, have := int64(1), published().ConnectedClients; want != have {
+		t.Errorf("connected clients: want %d, have %d", want, have)
+	}
+
+	// Over the backlog threshold: new connections are refused.
+	segment, err := log.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segment.Write([]byte("more than ten bytes\n")); err != nil {
+		t.Fatal(err)
+	}
+	m.measure()
+	if !m.Overloaded() {
+		t.Fatalf("not overloaded with a backlog of %d", published().Backlog())
+	}
+	refused, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(refused)
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "ERR ") {
+		t.Errorf("refused connection: want an ERR line, have %q (%v)", line, err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("refused connection: want %v, have %v", io.EOF, err)
+	}
+	select {
+	case <-accepted:
+		t.Error("refused connection was accepted")
+	default:
+	}
+
+	// Closed connections no longer count, however many times they're closed.
+	server.Close()
+	server.Close()
+	m.measure()
+	if want, have := int64(0), published().ConnectedClients; want != have {
+		t.Errorf("connected clients: want %d, have %d", want, have)
+	}
+}
+
+func TestLoadMonitorHandler(t *testing.T) {
+	t.Parallel()
+
+	log, err := NewFileLog(fs.NewVirtualFilesystem(), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	var (
+		m       = NewLoadMonitor(log, 10, func(cluster.Load) {}, prometheus.NewCounter(prometheus.CounterOpts{}))
+		writing int64
+		h       = m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writing = atomic.LoadInt64(&m.conns)
+		}))
+	)
+
+	// Writes count toward our load while they're served.
+	m.measure()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", APIPathWrite, strings.NewReader("foo\n")))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("write: want HTTP %d, have %d", want, have)
+	}
+	if want, have := int64(1), writing; want != have {
+		t.Errorf("while writing: want %d connections, have %d", want, have)
+	}
+	if want, have := int64(0), atomic.LoadInt64(&m.conns); want != have {
+		t.Errorf("after writing: want %d connections, have %d", want, have)
+	}
+
+	// Overloaded, writes are refused, but the rest of the API works.
+	segment, err := log.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segment.Write([]byte("more than ten bytes\n")); err != nil {
+		t.Fatal(err)
+	}
+	m.measure()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", APIPathWrite, strings.NewReader("foo\n")))
+	if want, have := http.StatusServiceUnavailable, rec.Code; want != have {
+		t.Errorf("overloaded write: want HTTP %d, have %d", want, have)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", APIPathNext, nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Errorf("overloaded next: want HTTP %d, have %d", want, have)
+	}
+}
@@ -17,7 +17,7 @@ type Log interface {
 
 // WriteSegment is a segment that can be written to.
 // It may be optionally synced to disk manually.
-// When writing is complete, it may be closed and flushed.
+// When writing is complete, it may be closed, which syncs it, and flushed.
 // If it would be closed with size 0, it may be deleted instead.
 type WriteSegment interface {
 	io.Writer
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// QueryAggCount makes a query count matching records per step of time,
+	// instead of returning them.
+	QueryAggCount = "count"
+
+	// QueryAggTop makes a query count matching records per value of a field,
+	// or of a regex capture group, and return the most common values.
+	QueryAggTop = "top"
+)
+
+// maxAggBuckets bounds the size of a time series, so a tiny step over a wide
+// range can't exhaust memory on every store.
+const maxAggBuckets = 10000
+
+// maxAggGroups bounds the number of groups a store returns for a top query,
+// for its part of the range. Past that, the least common values are only
+// counted as other records, so very high cardinality fields may yield
+// approximate results. The top n groups are only picked once the partial
+// results of all stores are merged.
+const maxAggGroups = 10000
+
+// defaultAggTop is how many groups a top query returns, by default.
+const defaultAggTop = 20
+
+// Aggregate is the result of an aggregation query, in place of records.
+type Aggregate struct {
+	Buckets []Bucket `json:"buckets,omitempty"`
+	Groups  []Group  `json:"groups,omitempty"`
+	Other   int64    `json:"other,omitempty"` // records in groups not returned
+}
+
+// Group is the number of matching records with a given value.
+type Group struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Bucket is the number of matching records from its time, inclusive, to the
+// time of the next bucket, exclusive.
+type Bucket struct {
+	From  time.Time `json:"from"`
+	Count int64     `json:"count"`
+}
+
+// newAggregate returns an Aggregate with an empty bucket for every step from
+// the query's from time to its to time. Buckets are aligned to multiples of
+// the step, so the same step always yields the same bucket times.
+func newAggregate(qp QueryParams) *Aggregate {
+	var (
+		first = qp.From.Time.UTC().Truncate(qp.Step)
+		last  = qp.To.Time.UTC().Truncate(qp.Step)
+		agg   = &Aggregate{Buckets: []Bucket{}}
+	)
+	for t := first; !t.After(last); t = t.Add(qp.Step) {
+		agg.Buckets = append(agg.Buckets, Bucket{From: t})
+	}
+	return agg
+}
+
+// aggBuckets returns how many buckets newAggregate would make.
+func aggBuckets(from, to time.Time, step time.Duration) int64 {
+	first, last := from.UTC().Truncate(step), to.UTC().Truncate(step)
+	if last.Before(first) {
+		return 0
+	}
+	return int64(last.Sub(first)/step) + 1
+}
+
+// count every ULID-prefixed record in r into its bucket, by the time of the
+// ULID. Records outside of the buckets are ignored.
+func (a *Aggregate) count(r io.Reader, step time.Duration) error {
+	if len(a.Buckets) <= 0 {
+		return nil
+	}
+	var (
+		first = a.Buckets[0].From
+		s     = bufio.NewScanner(r)
+		id    ulid.ULID
+	)
+	s.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	for s.Scan() {
+		line := s.Bytes()
+		if len(line) < ulid.EncodedSize {
+			continue
+		}
+		if err := id.UnmarshalText(line[:ulid.EncodedSize]); err != nil {
+			continue
+		}
+		t := time.Unix(0, int64(id.Time())*int64(time.Millisecond)).UTC()
+		if t.Before(first) {
+			continue
+		}
+		if i := int(t.Sub(first) / step); i < len(a.Buckets) {
+			a.Buckets[i].Count++
+		}
+	}
+	return errors.Wrap(s.Err(), "counting records")
+}
+
+// aggregate the ULID-prefixed records in r as the query asks, or returns nil if
+// it isn't an aggregation query.
+func aggregate(r io.Reader, qp QueryParams) (*Aggregate, error) {
+	switch qp.Agg {
+	case QueryAggCount:
+		agg := newAggregate(qp)
+		return agg, agg.count(r, qp.Step)
+	case QueryAggTop:
+		by, err := parseGroupBy(qp.By)
+		if err != nil {
+			panic(err) // DecodeFrom validated it
+		}
+		agg := &Aggregate{}
+		return agg, agg.group(r, by)
+	}
+	return nil, nil
+}
+
+// groupBy extracts the value to group a record by. It's a field, written like
+// the field of a predicate, e.g. user_id or json:user.id, or a regex whose
+// first capture group, or whole match if it has none, is the value.
+type groupBy struct {
+	format string
+	key    string
+	re     *regexp.Regexp
+}
+
+const groupByRegex = "regex"
+
+func parseGroupBy(s string) (groupBy, error) {
+	g := groupBy{format: fieldFormatLogfmt, key: s}
+	switch {
+	case strings.HasPrefix(s, groupByRegex+":"):
+		re, err := regexp.Compile(s[len(groupByRegex)+1:])
+		if err != nil {
+			return g, err
+		}
+		g.format, g.key, g.re = groupByRegex, "", re
+	case strings.HasPrefix(s, fieldFormatJSON+":"):
+		g.format, g.key = fieldFormatJSON, s[len(fieldFormatJSON)+1:]
+	case strings.HasPrefix(s, fieldFormatLogfmt+":"):
+		g.key = s[len(fieldFormatLogfmt)+1:]
+	}
+	if g.re == nil && g.key == "" {
+		return g, errors.Errorf("%q: no field", s)
+	}
+	return g, nil
+}
+
+// value of the record's text, and whether it has one.
+func (g groupBy) value(text []byte) (string, bool) {
+	if g.re == nil {
+		return (&recordFields{text: text}).get(g.format, g.key)
+	}
+	m := g.re.FindSubmatch(text)
+	switch {
+	case m == nil:
+		return "", false
+	case len(m) > 1:
+		return string(m[1]), m[1] != nil
+	default:
+		return string(m[0]), true
+	}
+}
+
+// group every ULID-prefixed record in r by its value. Records without one
+// aren't counted. At most maxAggGroups groups are kept.
+func (a *Aggregate) group(r io.Reader, by groupBy) error {
+	var (
+		counts = map[string]int64{}
+		s      = bufio.NewScanner(r)
+	)
+	s.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	for s.Scan() {
+		line := s.Bytes()
+		if len(line) <= ulid.EncodedSize {
+			continue
+		}
+		if value, ok := by.value(line[ulid.EncodedSize+1:]); ok {
+			counts[value]++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return errors.Wrap(err, "grouping records")
+	}
+	a.addGroups(counts)
+	a.top(maxAggGroups)
+	return nil
+}
+
+// addGroups adds the counts to the existing groups, and sorts them, most
+// common first.
+func (a *Aggregate) addGroups(counts map[string]int64) {
+	for _, g := range a.Groups {
+		counts[g.Value] += g.Count
+	}
+	groups := make([]Group, 0, len(counts))
+	for value, count := range counts {
+		groups = append(groups, Group{Value: value, Count: count})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Value < groups[j].Value
+	})
+	a.Groups = groups
+}
+
+// top keeps the n most common groups, and counts the rest as other records.
+func (a *Aggregate) top(n int) {
+	if len(a.Groups) <= n {
+		return
+	}
+	for _, g := range a.Groups[n:] {
+		a.Other += g.Count
+	}
+	a.Groups = a.Groups[:n]
+}
+
+// merge the other Aggregate into this one, summing the counts of buckets with
+// the same time, and of groups with the same value. Both sets of buckets must
+// be in time order.
+func (a *Aggregate) merge(other Aggregate) {
+	if len(other.Groups) > 0 {
+		counts := make(map[string]int64, len(other.Groups))
+		for _, g := range other.Groups {
+			counts[g.Value] += g.Count
+		}
+		a.addGroups(counts)
+	}
+	a.Other += other.Other
+
+	merged := make([]Bucket, 0, len(a.Buckets))
+	i, j := 0, 0
+	for i < len(a.Buckets) || j < len(other.Buckets) {
+		switch {
+		case j >= len(other.Buckets) || (i < len(a.Buckets) && a.Buckets[i].From.Before(other.Buckets[j].From)):
+			merged = append(merged, a.Buckets[i])
+			i++
+		case i >= len(a.Buckets) || other.Buckets[j].From.Before(a.Buckets[i].From):
+			merged = append(merged, other.Buckets[j])
+			j++
+		default:
+			merged = append(merged, Bucket{From: a.Buckets[i].From, Count: a.Buckets[i].Count + other.Buckets[j].Count})
+			i++
+			j++
+		}
+	}
+	a.Buckets = merged
+}
@@ -0,0 +1,334 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestAggregateCount(t *testing.T) {
+	t.Parallel()
+
+	var (
+		t0 = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+		qp QueryParams
+	)
+	qp.From.Time = t0.Add(30 * time.Second) // aligned down to 12:00
+	qp.To.Time = t0.Add(2*time.Minute + 59*time.Second)
+	qp.Step = time.Minute
+
+	agg := newAggregate(qp)
+	if want, have := int64(len(agg.Buckets)), aggBuckets(qp.From.Time, qp.To.Time, qp.Step); want != have {
+		t.Errorf("aggBuckets: want %d, have %d", want, have)
+	}
+
+	entropy := rand.New(rand.NewSource(12))
+	record := func(d time.Duration) string {
+		return ulid.MustNew(ulid.Timestamp(t0.Add(d)), entropy).String() + " hello\n"
+	}
+	input := strings.Join([]string{
+		record(-time.Second), // before the first bucket
+		record(0),
+		record(59 * time.Second),
+		record(time.Minute),
+		record(2*time.Minute + 59*time.Second),
+		record(2*time.Minute + 59*time.Second),
+		record(3 * time.Minute), // after the last bucket
+	}, "")
+	if err := agg.count(strings.NewReader(input), qp.Step); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Bucket{
+		{From: t0, Count: 2},
+		{From: t0.Add(time.Minute), Count: 1},
+		{From: t0.Add(2 * time.Minute), Count: 2},
+	}
+	if have := agg.Buckets; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestAggregateMerge(t *testing.T) {
+	t.Parallel()
+
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+	a := Aggregate{Buckets: []Bucket{{at(0), 1}, {at(1), 2}, {at(3), 3}}}
+	a.merge(Aggregate{Buckets: []Bucket{{at(1), 10}, {at(2), 20}, {at(3), 30}, {at(4), 40}}})
+	a.merge(Aggregate{})
+
+	want := []Bucket{{at(0), 1}, {at(1), 12}, {at(2), 20}, {at(3), 33}, {at(4), 40}}
+	if have := a.Buckets; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestQueryParamsAgg(t *testing.T) {
+	t.Parallel()
+
+	const (
+		from = "2017-06-01T12:00:00Z"
+		to   = "2017-06-01T13:00:00Z"
+	)
+	for _, testcase := range []struct {
+		query string
+		valid bool
+	}{
+		{"", true},
+		{"agg=count&step=1m", true},
+		{"agg=count&step=1ms", false}, // too many buckets
+		{"agg=count&step=100us", false},
+		{"agg=count", false},
+		{"agg=count&step=soon", false},
+		{"step=1m", false},
+		{"agg=avg&step=1m", false},
+		{"agg=top&by=user_id", true},
+		{"agg=top&by=json:user.id&n=5", true},
+		{"agg=top&by=regex:user=(%5Cw%2B)", true},
+		{"agg=top&by=regex:(", false},
+		{"agg=top", false},
+		{"agg=top&by=user_id&n=0", false},
+		{"agg=top&by=user_id&step=1m", false},
+		{"by=user_id", false},
+	} {
+		u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&%s", from, to, testcase.query))
+		var qp QueryParams
+		err := qp.DecodeFrom(u, rangeRequired)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%q: want valid=%v, have error %v", testcase.query, want, err)
+		}
+	}
+}
+
+func TestQueryAgg(t *testing.T) {
+	t.Parallel()
+
+	filelog, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	// Write a segment with records in the 2nd and 3rd minutes.
+	var (
+		t0      = time.Now().UTC().Truncate(time.Minute).Add(-10 * time.Minute)
+		entropy = rand.New(rand.NewSource(12))
+		ids     []ulid.ULID
+	)
+	segment, err := filelog.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, offset := range []time.Duration{65 * time.Second, 70 * time.Second, 150 * time.Second} {
+		id := ulid.MustNew(ulid.Timestamp(t0.Add(offset)), entropy)
+		ids = append(ids, id)
+		fmt.Fprintf(segment, "%s level=info n=%d\n", id, i)
+	}
+	if err := segment.Close(ids[0], ids[len(ids)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Count them per minute, and send the result over the wire.
+	u, _ := url.Parse(fmt.Sprintf(
+		"/query?from=%s&to=%s&q=info&agg=count&step=1m",
+		t0.Format(time.RFC3339), t0.Add(3*time.Minute).Format(time.RFC3339),
+	))
+	var qp QueryParams
+	if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+		t.Fatal(err)
+	}
+	result, err := filelog.Query(qp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	result.EncodeTo(rec)
+
+	var decoded QueryResult
+	if err := decoded.DecodeFrom(rec.Result()); err != nil {
+		t.Fatal(err)
+	}
+	defer decoded.Records.Close()
+	if want, have := time.Minute, decoded.Params.Step; want != have {
+		t.Errorf("step: want %s, have %s", want, have)
+	}
+	if decoded.Aggregate == nil {
+		t.Fatal("no aggregate")
+	}
+	want := []Bucket{
+		{From: t0, Count: 0},
+		{From: t0.Add(1 * time.Minute), Count: 2},
+		{From: t0.Add(2 * time.Minute), Count: 1},
+		{From: t0.Add(3 * time.Minute), Count: 0},
+	}
+	if have := decoded.Aggregate.Buckets; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestUserQueryAggReplicas(t *testing.T) {
+	t.Parallel()
+
+	// Both stores have a replica of the same segment, and the second one
+	// also has a record of its own.
+	var (
+		logs, _, url = newTestStores(t, 2, nil)
+		t0           = time.Now().UTC().Truncate(time.Minute).Add(-10 * time.Minute)
+		records      []string
+	)
+	for i, offset := range []time.Duration{65 * time.Second, 70 * time.Second, 150 * time.Second, 155 * time.Second} {
+		id := ulid.MustNew(ulid.Timestamp(t0.Add(offset)), nil)
+		records = append(records, fmt.Sprintf("%s level=info user=%s\n", id, []string{"alice", "bob", "alice", "carol"}[i]))
+	}
+	writeTestSegment(t, logs[0], records[:3]...)
+	writeTestSegment(t, logs[1], records[:3]...)
+	writeTestSegment(t, logs[1], records[3])
+
+	from, to := t0.Format(time.RFC3339), t0.Add(3*time.Minute).Format(time.RFC3339)
+	agg := userQueryAgg(t, url, fmt.Sprintf("from=%s&to=%s&agg=count&step=1m", from, to))
+	want := []Bucket{
+		{From: t0, Count: 0},
+		{From: t0.Add(1 * time.Minute), Count: 2},
+		{From: t0.Add(2 * time.Minute), Count: 2},
+		{From: t0.Add(3 * time.Minute), Count: 0},
+	}
+	if have := agg.Buckets; !reflect.DeepEqual(want, have) {
+		t.Errorf("count: want %v, have %v", want, have)
+	}
+
+	agg = userQueryAgg(t, url, fmt.Sprintf("from=%s&to=%s&agg=top&by=user&n=1", from, to))
+	if want, have := []Group{{"alice", 2}}, agg.Groups; !reflect.DeepEqual(want, have) {
+		t.Errorf("top: want %v, have %v", want, have)
+	}
+	if want, have := int64(2), agg.Other; want != have {
+		t.Errorf("other: want %d, have %d", want, have)
+	}
+}
+
+func TestUserQueryAggRing(t *testing.T) {
+	t.Parallel()
+
+	// Every store has every record, as if they were replicated to the owners
+	// of every bucket they span, but each is only counted once.
+	var (
+		ring         = NewRing(time.Minute, 2)
+		logs, _, url = newTestStores(t, 3, ring)
+		t0           = time.Now().UTC().Truncate(time.Minute).Add(-10 * time.Minute)
+		records      []string
+	)
+	for i := 0; i < 6; i++ {
+		id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*50*time.Second)), nil)
+		records = append(records, fmt.Sprintf("%s user=%s\n", id, []string{"alice", "bob"}[i%3/2]))
+	}
+	for _, l := range logs {
+		writeTestSegment(t, l, records...)
+	}
+
+	from, to := t0.Format(time.RFC3339), t0.Add(5*time.Minute).Format(time.RFC3339)
+	agg := userQueryAgg(t, url, fmt.Sprintf("from=%s&to=%s&agg=count&step=1m", from, to))
+	want := []Bucket{
+		{From: t0, Count: 2},                      // 0s, 50s
+		{From: t0.Add(1 * time.Minute), Count: 1}, // 100s
+		{From: t0.Add(2 * time.Minute), Count: 1}, // 150s
+		{From: t0.Add(3 * time.Minute), Count: 1}, // 200s
+		{From: t0.Add(4 * time.Minute), Count: 1}, // 250s
+		{From: t0.Add(5 * time.Minute), Count: 0},
+	}
+	if have := agg.Buckets; !reflect.DeepEqual(want, have) {
+		t.Errorf("count: want %v, have %v", want, have)
+	}
+
+	agg = userQueryAgg(t, url, fmt.Sprintf("from=%s&to=%s&agg=top&by=user&n=1", from, to))
+	if want, have := []Group{{"alice", 4}}, agg.Groups; !reflect.DeepEqual(want, have) {
+		t.Errorf("top: want %v, have %v", want, have)
+	}
+	if want, have := int64(2), agg.Other; want != have {
+		t.Errorf("other: want %d, have %d", want, have)
+	}
+}
+
+// userQueryAgg makes the aggregation query of the store API at url.
+func userQueryAgg(t *testing.T, url, query string) Aggregate {
+	resp, err := http.Get(fmt.Sprintf("%s%s?%s", url, APIPathUserQuery, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qr QueryResult
+	if err := qr.DecodeFrom(resp); err != nil {
+		t.Fatal(err)
+	}
+	qr.Records.Close()
+	if want, have := http.StatusOK, resp.StatusCode; want != have {
+		t.Fatalf("%s: want HTTP %d, have %d", query, want, have)
+	}
+	if qr.Aggregate == nil {
+		t.Fatalf("%s: no aggregate", query)
+	}
+	return *qr.Aggregate
+}
+
+func TestAggregateGroup(t *testing.T) {
+	t.Parallel()
+
+	const id = "01BB6RQR190000000000000000 "
+	input := strings.Join([]string{
+		id + `level=error user=alice`,
+		id + `level=error user=bob`,
+		id + `level=error user=alice`,
+		id + `level=error`,
+		id + `{"user":{"name":"carol"}}`,
+		id + `{"user":{"name":"alice"}}`,
+		"",
+	}, "\n")
+	for _, testcase := range []struct {
+		by   string
+		want []Group
+	}{
+		{"user", []Group{{"alice", 2}, {"bob", 1}}},
+		{"json:user.name", []Group{{"alice", 1}, {"carol", 1}}},
+		{`regex:(alice|carol)`, []Group{{"alice", 3}, {"carol", 1}}},
+		{`regex:level=\w+`, []Group{{"level=error", 4}}},
+	} {
+		by, err := parseGroupBy(testcase.by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var agg Aggregate
+		if err := agg.group(strings.NewReader(input), by); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := testcase.want, agg.Groups; !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want %v, have %v", testcase.by, want, have)
+		}
+	}
+}
+
+func TestAggregateTop(t *testing.T) {
+	t.Parallel()
+
+	// Two stores, and their partial groups.
+	var (
+		a = Aggregate{Groups: []Group{{"x", 5}, {"y", 3}, {"z", 1}}}
+		b = Aggregate{Groups: []Group{{"z", 6}, {"w", 2}}, Other: 1}
+	)
+	a.merge(b)
+	a.top(2)
+
+	if want, have := []Group{{"z", 7}, {"x", 5}}, a.Groups; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := int64(1+3+2), a.Other; want != have {
+		t.Errorf("other: want %d, have %d", want, have)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -30,11 +29,16 @@ const (
 	APIPathInternalStream = "/_stream"
 	APIPathReplicate      = "/replicate"
 	APIPathClusterState   = "/_clusterstate"
+	APIPathInventory      = "/_inventory"
 )
 
 // ClusterPeer models cluster.Peer.
 type ClusterPeer interface {
 	Current(cluster.PeerType) []string
+	Zones(cluster.PeerType) map[string]string
+	RingBuckets(cluster.PeerType) map[string]time.Duration
+	Name() string
+	SetPlacement(cluster.Placement)
 	State() map[string]interface{}
 }
 
@@ -49,6 +53,7 @@ type API struct {
 	log                Log
 	queryClient        Doer // should time out
 	streamClient       Doer // should not time out
+	ring               *Ring
 	streamQueries      *queryRegistry
 	replicatedSegments prometheus.Counter
 	replicatedBytes    prometheus.Counter
@@ -56,11 +61,13 @@ type API struct {
 	reporter           EventReporter
 }
 
-// NewAPI returns a usable API.
+// NewAPI returns a usable API. If ring isn't nil, user queries only go to the
+// stores that own the records in their range.
 func NewAPI(
 	peer ClusterPeer,
 	log Log,
 	queryClient, streamClient Doer,
+	ring *Ring,
 	replicatedSegments, replicatedBytes prometheus.Counter,
 	duration *prometheus.HistogramVec,
 	reporter EventReporter,
@@ -70,6 +77,7 @@ func NewAPI(
 		log:                log,
 		queryClient:        queryClient,
 		streamClient:       streamClient,
+		ring:               ring,
 		streamQueries:      newQueryRegistry(),
 		replicatedSegments: replicatedSegments,
 		replicatedBytes:    replicatedBytes,
@@ -111,6 +119,8 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.handleReplicate(w, r)
 	case method == "GET" && path == APIPathClusterState:
 		a.handleClusterState(w, r)
+	case method == "GET" && path == APIPathInventory:
+		a.handleInventory(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -151,8 +161,52 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var requests []*http.Request
+	// Each target is queried for records from and to the given IDs. By
+	// default, that's the whole range, on every store.
+	type target struct {
+		hostport string
+		from, to ulid.ULID
+	}
+	var targets []target
 	for _, hostport := range members {
+		targets = append(targets, target{hostport, qp.From.ULID, qp.To.ULID})
+	}
+
+	// Stores have replicas of the same records, so we can't sum the
+	// aggregates of all of them. With a ring, every bucket of the range is
+	// owned by a known set of stores, so we ask one owner of each bucket to
+	// aggregate that bucket, and sum those. Without a ring, we can't know
+	// which stores have which records; we ask every store for the matching
+	// records, which are deduplicated as they're merged, and aggregate them
+	// here. That ships every matching record to this node, so queries over
+	// many records are much more expensive than with a ring.
+	ring := a.ring.agreed(a.peer.RingBuckets(cluster.PeerTypeStore), members, "handleUserQuery", a.reporter)
+	storeAgg := qp.Agg != "" && ring != nil
+	if ring != nil {
+		zones := a.peer.Zones(cluster.PeerTypeStore)
+		from, to := qp.From.ULID.Time(), qp.To.ULID.Time()
+		targets = targets[:0]
+		if storeAgg {
+			for _, rg := range ring.assign(members, zones, from, to) {
+				t := target{rg.store, msULID(rg.from), msULID(rg.to)}
+				if rg.from == from {
+					t.from = qp.From.ULID
+				}
+				if rg.to == to {
+					t.to = qp.To.ULID
+				}
+				targets = append(targets, t)
+			}
+		} else {
+			// Only the owners of the range have its records.
+			for _, hostport := range ring.ownersOf(members, zones, from, to) {
+				targets = append(targets, target{hostport, qp.From.ULID, qp.To.ULID})
+			}
+		}
+	}
+
+	var requests []*http.Request
+	for _, t := range targets {
 		// Copy original URL, to save all the query params, etc.
 		u, err := url.Parse(r.URL.String())
 		if err != nil {
@@ -163,13 +217,25 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request) {
 		// Fix the scheme, host, and path.
 		// (These may be empty due to StripPrefix.)
 		u.Scheme = "http"
-		u.Host = hostport
+		u.Host = t.hostport
 		u.Path = fmt.Sprintf("store%s", APIPathInternalQuery)
 
+		// Narrow the range to the target's, and ask for the records
+		// themselves if we aggregate them here.
+		q := u.Query()
+		q.Set("from", t.from.String())
+		q.Set("to", t.to.String())
+		if qp.Agg != "" && !storeAgg {
+			for _, key := range []string{"agg", "step", "by", "n", "fields"} {
+				q.Del(key)
+			}
+		}
+		u.RawQuery = q.Encode()
+
 		// Construct a new request.
 		req, err := http.NewRequest(r.Method, u.String(), nil)
 		if err != nil {
-			err = errors.Wrapf(err, "constructing request for %s", hostport)
+			err = errors.Wrapf(err, "constructing request for %s", t.hostport)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -192,7 +258,14 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// We'll collect responses into a single QueryResult.
+	// Aggregates start with every bucket, in case we only return stats.
 	qr := QueryResult{Params: qp}
+	switch qp.Agg {
+	case QueryAggCount:
+		qr.Aggregate = newAggregate(qp)
+	case QueryAggTop:
+		qr.Aggregate = &Aggregate{}
+	}
 
 	// We'll merge all records in a single pass.
 	var rcs []io.ReadCloser
@@ -235,7 +308,7 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request) {
 			}
 			response.resp.Body.Close()
 			a.reporter.ReportEvent(Event{
-				Op: "handleUserQuery", Error: fmt.Errorf(response.resp.Status),
+				Op: "handleUserQuery", Error: errors.New(response.resp.Status),
 				Msg: fmt.Sprintf("gather query response from store %d/%d: bad status (%s)", i+1, len(responses), strings.TrimSpace(string(buf))),
 			})
 			qr.ErrorCount++
@@ -279,7 +352,7 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Now bind all the partial ReadClosers together.
-	mrc, err := newMergeReadCloser(rcs)
+	mrc, err := newLimitedMergeReadCloser(rcs, qp.desc(), qp.Limit)
 	if err != nil {
 		err = errors.Wrap(err, "constructing merging reader")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -288,6 +361,40 @@ func (a *API) handleUserQuery(w http.ResponseWriter, r *http.Request) {
 	qr.Records = mrc // lazy reader
 	rcs = nil        // don't double-close on return
 
+	// A limited result is small enough to read up front, so we can tell the
+	// client where the next page starts.
+	if qp.Limit > 0 && r.Method != "HEAD" {
+		next, buf, err := readPage(mrc, qp.Limit)
+		mrc.Close()
+		if err != nil {
+			err = errors.Wrap(err, "reading merged records")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		qr.Next = next
+		qr.Records = ioutil.NopCloser(bytes.NewReader(buf))
+	}
+
+	// Without a ring, aggregate the merged records, each counted once however
+	// many stores have it. Either way, only the top groups are returned.
+	if qp.Agg != "" {
+		if !storeAgg && r.Method != "HEAD" {
+			agg, err := aggregate(mrc, qp)
+			if err != nil {
+				mrc.Close()
+				err = errors.Wrap(err, "aggregating merged records")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			qr.Aggregate = agg
+		}
+		mrc.Close()
+		if qp.Agg == QueryAggTop {
+			qr.Aggregate.top(qp.N)
+		}
+		qr.Records = nil
+	}
+
 	// Return!
 	qr.Duration = time.Since(begin).String() // overwrite
 	qr.EncodeTo(w)
@@ -395,20 +502,24 @@ func (a *API) handleInternalStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pass := recordFilterPlain([]byte(qp.Q))
-	if qp.Regex {
-		// QueryParams.DecodeFrom validated the regex.
-		pass = recordFilterRegex(regexp.MustCompile(qp.Q))
-	}
+	// QueryParams.DecodeFrom validated the query.
+	pass := qp.recordFilter()
 
-	// The records chan is closed when the context is canceled.
-	records := a.streamQueries.Register(r.Context(), pass)
+	// The records chan is closed when the context is canceled, or when the
+	// registry cancels the query, e.g. because we didn't keep up.
+	records, failed := a.streamQueries.Register(r.Context(), pass)
 
 	// Thus, we range over the records chan.
 	for record := range records {
 		w.Write(record) // includes trailing newline
 		flusher.Flush()
 	}
+	if err := failed(); err != nil {
+		a.reporter.ReportEvent(Event{
+			Op: "handleInternalStream", Error: err,
+			Msg: fmt.Sprintf("streaming query for %s", r.RemoteAddr),
+		})
+	}
 }
 
 func (a *API) handleReplicate(w http.ResponseWriter, r *http.Request) {
@@ -418,8 +529,11 @@ func (a *API) handleReplicate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var buf bytes.Buffer
-	lo, hi, n, err := teeRecords(r.Body, segment, &buf)
+	// Records go to the streaming queries as they arrive, so nothing holds the
+	// whole segment in memory. If the segment then fails, the consumer tries
+	// again elsewhere, and streams see the records twice; that's OK, as they
+	// get every record from every replica anyway, and deduplicate them.
+	lo, hi, n, err := teeRecords(r.Body, segment, matchWriter{a.streamQueries})
 	if err != nil {
 		segment.Delete()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -433,7 +547,6 @@ func (a *API) handleReplicate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	go a.streamQueries.Match(buf.Bytes()) // TODO(pb): validate `go`
 	a.replicatedSegments.Inc()
 	a.replicatedBytes.Add(float64(n))
 	fmt.Fprintln(w, "OK")
@@ -449,6 +562,21 @@ func (a *API) handleClusterState(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
+func (a *API) handleInventory(w http.ResponseWriter, r *http.Request) {
+	segments, err := a.log.Inventory()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf, err := json.Marshal(Inventory{Peer: a.peer.Name(), Segments: segments})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf)
+}
+
 func teeRecords(src io.Reader, dst ...io.Writer) (lo, hi ulid.ULID, n int, err error) {
 	var (
 		first = true
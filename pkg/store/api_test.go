@@ -2,14 +2,17 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
@@ -82,6 +85,155 @@ func TestAPIInternalQueryFromULID(t *testing.T) {
 	}
 }
 
+func TestAPIUserQueryPages(t *testing.T) {
+	t.Parallel()
+
+	// Records of a realistic size, of which the second store has replicas
+	// of the first half.
+	var (
+		logs, _, url = newTestStores(t, 2, nil)
+		t0           = time.Now().Add(-time.Hour)
+		ids          []ulid.ULID
+		records      []string
+	)
+	for i := 0; i < 20; i++ {
+		id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*time.Millisecond)), nil)
+		ids = append(ids, id)
+		records = append(records, fmt.Sprintf("%s %-60s\n", id, fmt.Sprintf("record %d", i)))
+	}
+	writeTestSegment(t, logs[0], records...)
+	writeTestSegment(t, logs[1], records[:10]...)
+
+	var (
+		after string
+		have  string
+	)
+	for page := 0; page < 3; page++ {
+		resp, err := http.Get(fmt.Sprintf(
+			"%s%s?from=%s&to=%s&limit=10&after=%s",
+			url, APIPathUserQuery, ids[0], ids[len(ids)-1], after,
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var qr QueryResult
+		if err := qr.DecodeFrom(resp); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(qr.Records)
+		qr.Records.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := http.StatusOK, resp.StatusCode; want != have {
+			t.Fatalf("page %d: want HTTP %d, have %d: %s", page, want, have, buf)
+		}
+		have += string(buf)
+		if after = qr.Next; after == "" {
+			break
+		}
+	}
+	if want := strings.Join(records, ""); want != have {
+		t.Errorf("want:\n%s\nhave:\n%s", want, have)
+	}
+}
+
+func TestAPIReplicateSlowStream(t *testing.T) {
+	t.Parallel()
+
+	filelog, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 64*1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	var (
+		duration  = prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"method", "path", "status_code"})
+		nopMetric = prometheus.NewCounter(prometheus.CounterOpts{})
+		a         = NewAPI(mockClusterPeer{}, filelog, mockDoer{}, mockDoer{}, nil, nopMetric, nopMetric, duration, &eventRecorder{})
+	)
+	defer a.Close()
+
+	// A stream subscriber for every record, which never reads them.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, failed := a.streamQueries.Register(ctx, recordFilterPlain([]byte("")))
+
+	// Replicating more records than it can buffer still completes.
+	var (
+		t0      = time.Now().Add(-time.Hour)
+		segment bytes.Buffer
+	)
+	for i := 0; i < 4096; i++ {
+		fmt.Fprintf(&segment, "%s record %d\n", ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*time.Millisecond)), nil), i)
+	}
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathReplicate, &segment))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if want, have := http.StatusOK, code; want != have {
+			t.Errorf("want HTTP %d, have %d", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replication is held up by a stream subscriber that doesn't read")
+	}
+
+	// The subscriber is told why it missed records.
+	if want, have := errStreamTooSlow, failed(); want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+// newTestStores starts the API of n stores in a cluster, placing records with
+// the ring if it isn't nil, and returns their logs, their names in the cluster,
+// and the URL of the first one's API.
+func newTestStores(t *testing.T, n int, ring *Ring) ([]Log, []string, string) {
+	var (
+		logs      []Log
+		stores    []string
+		urls      []string
+		duration  = prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"method", "path", "status_code"})
+		nopMetric = prometheus.NewCounter(prometheus.CounterOpts{})
+	)
+	for i := 0; i < n; i++ {
+		filelog, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 64*1024*1024, 1024, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { filelog.Close() })
+		name := fmt.Sprintf("store-%d", i)
+		api := NewAPI(&repairPeer{name, &stores, ring.Width()}, filelog, http.DefaultClient, mockDoer{}, ring, nopMetric, nopMetric, duration, &eventRecorder{})
+		t.Cleanup(func() { api.Close() })
+		server := httptest.NewServer(http.StripPrefix("/store", api))
+		t.Cleanup(server.Close)
+		logs = append(logs, filelog)
+		stores = append(stores, strings.TrimPrefix(server.URL, "http://"))
+		urls = append(urls, server.URL+"/store")
+	}
+	return logs, stores, urls[0]
+}
+
+// writeTestSegment writes the records, which must be in order, to a segment.
+func writeTestSegment(t *testing.T, l Log, records ...string) {
+	segment, err := l.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		fmt.Fprint(segment, record)
+	}
+	var (
+		lo = ulid.MustParse(records[0][:ulid.EncodedSize])
+		hi = ulid.MustParse(records[len(records)-1][:ulid.EncodedSize])
+	)
+	if err := segment.Close(lo, hi); err != nil {
+		t.Fatal(err)
+	}
+}
+
 var (
 	recordA  = "01BB6RQR190000000000000000 A 2017-03-14T16:59:40.585457189+01:00\n"
 	recordB  = "01BB6RRTB70000000000000000 B 2017-03-14T17:00:15.719316824+01:00\n"
@@ -122,7 +274,7 @@ func newFixtureAPI(t *testing.T) (*API, error) {
 		replicatedSegments = prometheus.NewCounter(prometheus.CounterOpts{})
 		replicatedBytes    = prometheus.NewCounter(prometheus.CounterOpts{})
 		duration           = prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"method", "path", "status_code"})
-		a                  = NewAPI(peer, filelog, queryClient, streamClient, replicatedSegments, replicatedBytes, duration, apiReporter)
+		a                  = NewAPI(peer, filelog, queryClient, streamClient, nil, replicatedSegments, replicatedBytes, duration, apiReporter)
 	)
 
 	// Populate the store via the replicate API.
@@ -148,8 +300,14 @@ func newFixtureAPI(t *testing.T) (*API, error) {
 
 type mockClusterPeer struct{}
 
-func (mockClusterPeer) Current(cluster.PeerType) []string { return []string{} }
-func (mockClusterPeer) State() map[string]interface{}     { return map[string]interface{}{} }
+func (mockClusterPeer) Current(cluster.PeerType) []string        { return []string{} }
+func (mockClusterPeer) Zones(cluster.PeerType) map[string]string { return map[string]string{} }
+func (mockClusterPeer) RingBuckets(cluster.PeerType) map[string]time.Duration {
+	return map[string]time.Duration{}
+}
+func (mockClusterPeer) Name() string                   { return "mock" }
+func (mockClusterPeer) SetPlacement(cluster.Placement) {}
+func (mockClusterPeer) State() map[string]interface{}  { return map[string]interface{}{} }
 
 type mockDoer struct{}
 
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+// Each flushed segment also has a bloom filter in a sidecar file, holding
+// every 3-byte gram of every record's text. Plain queries match substrings,
+// so a segment can only have a match if it has all of the grams of the query.
+// That lets queries for rare terms, like request IDs, skip most segments.
+const (
+	extBloom = ".bloom"
+
+	bloomGramSize   = 3
+	bloomHashes     = 4
+	bloomMinBitsLog = 13 // 1KB
+	bloomMaxBitsLog = 21 // 256KB
+)
+
+var bloomMagic = []byte("OKBF\x01")
+
+type bloomFilter struct {
+	k    uint8
+	bits []uint64
+	mask uint64
+}
+
+// newBloomFilter returns an empty bloom filter sized for a segment of size
+// bytes: about a bit per byte, within limits.
+func newBloomFilter(size int64) *bloomFilter {
+	log := uint(bloomMinBitsLog)
+	for log < bloomMaxBitsLog && int64(1)<<log < size {
+		log++
+	}
+	return &bloomFilter{
+		k:    bloomHashes,
+		bits: make([]uint64, (1<<log)/64),
+		mask: 1<<log - 1,
+	}
+}
+
+// addGrams adds every gram of the text.
+func (f *bloomFilter) addGrams(text []byte) {
+	for i := 0; i+bloomGramSize <= len(text); i++ {
+		h1, h2 := bloomHash(text[i:])
+		for j := uint64(0); j < uint64(f.k); j++ {
+			bit := (h1 + j*h2) & f.mask
+			f.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+}
+
+// mayContain returns false if no text added to the filter can contain q.
+// Terms shorter than a gram may always be contained.
+func (f *bloomFilter) mayContain(q []byte) bool {
+	for i := 0; i+bloomGramSize <= len(q); i++ {
+		h1, h2 := bloomHash(q[i:])
+		for j := uint64(0); j < uint64(f.k); j++ {
+			bit := (h1 + j*h2) & f.mask
+			if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bloomHash returns the two hashes of the gram at the start of b, for double
+// hashing. The second is odd, so it cycles through all of the bits.
+func bloomHash(b []byte) (h1, h2 uint64) {
+	x := uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	x ^= x >> 30 // splitmix64's finalizer
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x & 0xffffffff, x>>32 | 1
+}
+
+func (f *bloomFilter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(bloomMagic)
+	buf.WriteByte(f.k)
+	binary.Write(&buf, binary.LittleEndian, f.bits)
+	return buf.Bytes(), nil
+}
+
+func (f *bloomFilter) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, bloomMagic) || len(data) < len(bloomMagic)+1 {
+		return errors.New("not a bloom filter")
+	}
+	data = data[len(bloomMagic):]
+	k, data := data[0], data[1:]
+	words := len(data) / 8
+	if k == 0 || words == 0 || len(data)%8 != 0 || words&(words-1) != 0 {
+		return errors.New("invalid bloom filter")
+	}
+	f.k = k
+	f.bits = make([]uint64, words)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	f.mask = uint64(64*words - 1)
+	return nil
+}
+
+func bloomPath(segmentPath string) string {
+	return modifyExtension(segmentPath, extBloom)
+}
+
+// readBloom reads the bloom filter of the segment at path.
+func readBloom(filesys fs.Filesystem, path string) (*bloomFilter, error) {
+	f, err := filesys.Open(bloomPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var bloom bloomFilter
+	if err := bloom.UnmarshalBinary(data); err != nil {
+		return nil, errors.Wrap(err, bloomPath(path))
+	}
+	return &bloom, nil
+}
+
+// skipSegments drops the segments whose bloom filters say they can't contain
+// the plain query term q, and closes them. Segments without a usable bloom
+// filter are kept.
+func (fl *fileLog) skipSegments(segments []readSegment, q []byte) (kept []readSegment, skipped int) {
+	if len(q) < bloomGramSize {
+		return segments, 0 // every segment may contain it
+	}
+	kept = segments[:0]
+	for _, segment := range segments {
+		bloom, err := readBloom(fl.filesys, segment.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fl.reporter.ReportEvent(Event{
+					Op: "skipSegments", File: segment.path, Warning: err,
+					Msg: "querying the segment without its bloom filter",
+				})
+			}
+			kept = append(kept, segment)
+			continue
+		}
+		if bloom.mayContain(q) {
+			kept = append(kept, segment)
+			continue
+		}
+		if err := segment.file.Close(); err != nil {
+			fl.reporter.ReportEvent(Event{
+				Op: "skipSegments", File: segment.path, Warning: err,
+				Msg: "Close of skipped segment failed",
+			})
+		}
+		skipped++
+	}
+	return kept, skipped
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestBloomFilter(t *testing.T) {
+	t.Parallel()
+
+	bloom := newBloomFilter(1024)
+	bloom.addGrams([]byte("GET /users request_id=7f3a9c01 status=200\n"))
+	bloom.addGrams([]byte("POST /orders request_id=b2e4d6f8 status=500\n"))
+
+	data, err := bloom.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bloomFilter
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		q    string
+		want bool
+	}{
+		{"request_id=7f3a9c01", true},
+		{"7f3a", true},  // part of a token
+		{"500\n", true}, // with the newline
+		{"/orders", true},
+		{"ab", true}, // too short to tell
+		{"", true},
+		{"request_id=00000000", false},
+		{"DELETE", false},
+		{"status=404", false},
+	} {
+		for name, f := range map[string]*bloomFilter{"built": bloom, "decoded": &decoded} {
+			if have := f.mayContain([]byte(testcase.q)); have != testcase.want {
+				t.Errorf("%s: %q: want %v, have %v", name, testcase.q, testcase.want, have)
+			}
+		}
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("OKBF"),
+		append(data[:len(bloomMagic)+1:len(bloomMagic)+1], 0, 0, 0),       // not whole words
+		append(data[:len(bloomMagic)+1:len(bloomMagic)+1], data[6:30]...), // not a power of two
+	} {
+		var f bloomFilter
+		if err := f.UnmarshalBinary(data); err == nil {
+			t.Errorf("%q: want error, have none", data)
+		}
+	}
+}
+
+func TestQueryWithBloom(t *testing.T) {
+	t.Parallel()
+
+	filesys := fs.NewVirtualFilesystem()
+	filelog, err := NewFileLog(filesys, "/", 64*1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	// Write a few segments, each with its own request IDs.
+	var (
+		t0       = time.Now().Add(-time.Hour)
+		segments = 4
+		records  = 100
+		paths    []string
+	)
+	for i := 0; i < segments; i++ {
+		segment, err := filelog.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lo, hi ulid.ULID
+		for j := 0; j < records; j++ {
+			id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i*records+j)*time.Millisecond)), nil)
+			fmt.Fprintf(segment, "%s method=GET request_id=seg%d-req%03d\n", id, i, j)
+			if j == 0 {
+				lo = id
+			}
+			hi = id
+		}
+		if err := segment.Close(lo, hi); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, fmt.Sprintf("/%s-%s%s", lo, hi, extFlushed))
+	}
+
+	from := t0.Add(-time.Minute).UTC().Format(time.RFC3339)
+	to := time.Now().UTC().Format(time.RFC3339)
+	for _, testcase := range []struct {
+		query   string
+		want    int // records
+		skipped int
+	}{
+		{"q=seg2-req042", 1, segments - 1},
+		{"q=seg2", records, segments - 1},
+		{"q=nowhere", 0, segments},
+		{"q=GET", segments * records, 0},
+		{"q=GE", segments * records, 0},    // too short to tell
+		{"q=seg2-req042&regex=true", 1, 0}, // not a plain term
+		{"q=seg2-req042&where=method%3DGET", 1, segments - 1},
+		{"q=seg2-req042&agg=count&step=1h", 0, segments - 1},
+	} {
+		u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&%s", from, to, testcase.query))
+		var qp QueryParams
+		if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+			t.Fatalf("%s: %v", testcase.query, err)
+		}
+		result, err := filelog.Query(qp, false)
+		if err != nil {
+			t.Fatalf("%s: %v", testcase.query, err)
+		}
+		buf, err := ioutil.ReadAll(result.Records)
+		result.Records.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", testcase.query, err)
+		}
+		if want, have := testcase.want, strings.Count(string(buf), "\n"); want != have {
+			t.Errorf("%s: want %d records, have %d", testcase.query, want, have)
+		}
+		if want, have := testcase.skipped, result.SegmentsSkipped; want != have {
+			t.Errorf("%s: want %d segments skipped, have %d", testcase.query, want, have)
+		}
+		if want, have := segments-testcase.skipped, result.SegmentsQueried; want != have {
+			t.Errorf("%s: want %d segments queried, have %d", testcase.query, want, have)
+		}
+	}
+
+	// Segments without a bloom filter are queried.
+	if err := filesys.Remove(bloomPath(paths[0])); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&q=nowhere", from, to))
+	var qp QueryParams
+	if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+		t.Fatal(err)
+	}
+	result, err := filelog.Query(qp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Records.Close()
+	if want, have := segments-1, result.SegmentsSkipped; want != have {
+		t.Errorf("without a bloom filter: want %d segments skipped, have %d", want, have)
+	}
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+// Each flushed segment has the CRC-32C of its file in a sidecar, written when
+// the segment is closed. Whenever we read a whole segment, e.g. to compact it,
+// we verify it. Its index has the CRC-32C of each part it maps, so queries
+// that read only some parts, or read backwards, verify the parts they read
+// before they use them. Segments that fail, or that are otherwise malformed, are
+// quarantined: renamed to extCorrupt, where nothing touches them again, so an
+// operator can inspect them.
+const (
+	extChecksum = ".crc"
+	extCorrupt  = ".corrupt"
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptSegment is the cause of all errors due to corrupt segments.
+var errCorruptSegment = errors.New("corrupt segment")
+
+// corruptf returns an error with errCorruptSegment as its cause.
+func corruptf(format string, args ...interface{}) error {
+	return errors.Wrapf(errCorruptSegment, format, args...)
+}
+
+// isCorrupt returns true if the error is due to a corrupt segment.
+func isCorrupt(err error) bool {
+	if serr, ok := err.(segmentError); ok {
+		err = serr.err
+	}
+	return errors.Cause(err) == errCorruptSegment
+}
+
+func newChecksum() hash.Hash32 {
+	return crc32.New(checksumTable)
+}
+
+func checksumPath(segmentPath string) string {
+	return modifyExtension(segmentPath, extChecksum)
+}
+
+// writeChecksum writes the checksum of the segment at path.
+func writeChecksum(filesys fs.Filesystem, path string, sum uint32) error {
+	return writeFile(filesys, checksumPath(path), []byte(fmt.Sprintf("%08x\n", sum)))
+}
+
+// readChecksum reads the checksum of the segment at path.
+func readChecksum(filesys fs.Filesystem, path string) (uint32, error) {
+	f, err := filesys.Open(checksumPath(path))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	sum, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid checksum %q", buf)
+	}
+	return uint32(sum), nil
+}
+
+// computeChecksum reads the segment at path, and returns its checksum.
+func computeChecksum(filesys fs.Filesystem, path string) (uint32, error) {
+	f, err := filesys.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := newChecksum()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// newVerifyingReadCloser checks that the size bytes read from src have the
+// checksum, and fails the read that finishes them if they don't.
+func newVerifyingReadCloser(src io.ReadCloser, size int64, sum uint32) io.ReadCloser {
+	return &verifyingReadCloser{src: src, size: size, want: sum, h: newChecksum()}
+}
+
+type verifyingReadCloser struct {
+	src     io.ReadCloser
+	size    int64
+	want    uint32
+	h       hash.Hash32
+	n       int64
+	err     error
+	corrupt func(error) // if set, called once, if it's corrupt
+}
+
+func (v *verifyingReadCloser) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err // lest a reader that got n > 0 with it missed it
+	}
+	n, err := v.src.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	switch {
+	case v.n > v.size:
+		err = corruptf("more than the %d bytes we expected", v.size)
+	case v.n == v.size && n > 0 && v.h.Sum32() != v.want:
+		err = corruptf("checksum %08x, expected %08x", v.h.Sum32(), v.want)
+	case err == io.EOF && v.n < v.size:
+		err = corruptf("%d bytes, expected %d", v.n, v.size)
+	}
+	if isCorrupt(err) {
+		v.err = err
+		if v.corrupt != nil {
+			v.corrupt(err)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReadCloser) Close() error {
+	return v.src.Close()
+}
+
+// verifySegment wraps the file of the whole segment at path to verify its
+// checksum, if it has a usable one.
+func verifySegment(filesys fs.Filesystem, path string, f io.ReadCloser, size int64) io.ReadCloser {
+	sum, err := readChecksum(filesys, path)
+	if err != nil {
+		return f // e.g. an older segment; we can't tell
+	}
+	return newVerifyingReadCloser(f, size, sum)
+}
+
+// verifySegments wraps the segments that are read whole to verify them, and
+// quarantines those that fail. Read backwards, a segment is verified before
+// any of it is used.
+func (fl *fileLog) verifySegments(segments []readSegment, desc bool) {
+	for i, segment := range segments {
+		if _, ok := segment.file.(sectionReadCloser); ok {
+			continue // verified in parts by seekSegments
+		}
+		sum, err := readChecksum(fl.filesys, segment.path)
+		if err != nil {
+			continue // e.g. an older segment; we can't tell
+		}
+		path := segment.path
+		corrupt := func(err error) { fl.quarantine("Query", path, err) }
+		if ra, ok := segment.file.(io.ReaderAt); ok && desc && !isCompressed(path) {
+			ra = &verifyingReaderAt{
+				ra:       ra,
+				idx:      segmentIndex{{sum: sum}},
+				size:     segment.size,
+				verified: make([]bool, 1),
+				corrupt:  corrupt,
+			}
+			segments[i].file = sectionReadCloser{io.NewSectionReader(ra, 0, segment.size), segment.file}
+			continue
+		}
+		v := newVerifyingReadCloser(segment.file, segment.size, sum).(*verifyingReadCloser)
+		v.corrupt = corrupt
+		segments[i].file = v
+	}
+}
+
+// checksumIndex sets the checksum of each part of the segment at path, of size
+// bytes, that the index maps.
+func checksumIndex(filesys fs.Filesystem, path string, idx segmentIndex, size int64) error {
+	if len(idx) <= 0 {
+		return nil
+	}
+	f, err := filesys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(ioutil.Discard, f, idx[0].offset); err != nil {
+		return err
+	}
+	for i := range idx {
+		h := newChecksum()
+		if _, err := io.CopyN(h, f, idx.end(i, size)-idx[i].offset); err != nil {
+			return err
+		}
+		idx[i].sum = h.Sum32()
+	}
+	return nil
+}
+
+// verifyingReaderAt checks each part of a segment of size bytes against its
+// checksum in the index, the first time any of it is read.
+type verifyingReaderAt struct {
+	ra       io.ReaderAt
+	idx      segmentIndex
+	size     int64
+	verified []bool
+	err      error
+	corrupt  func(error) // called once, if it's corrupt
+}
+
+func (v *verifyingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := v.verify(off, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	return v.ra.ReadAt(p, off)
+}
+
+// verify the parts of the segment from from to to.
+func (v *verifyingReaderAt) verify(from, to int64) error {
+	if v.err != nil {
+		return v.err
+	}
+	for i, e := range v.idx {
+		end := v.idx.end(i, v.size)
+		if v.verified[i] || end <= from || e.offset >= to {
+			continue
+		}
+		h := newChecksum()
+		n, err := io.Copy(h, io.NewSectionReader(v.ra, e.offset, end-e.offset))
+		switch {
+		case err != nil:
+			return err
+		case n < end-e.offset:
+			err = corruptf("%d bytes at offset %d, expected %d", n, e.offset, end-e.offset)
+		case h.Sum32() != e.sum:
+			err = corruptf("checksum %08x at offset %d, expected %08x", h.Sum32(), e.offset, e.sum)
+		}
+		if err != nil {
+			v.err = err
+			if v.corrupt != nil {
+				v.corrupt(err)
+			}
+			return err
+		}
+		v.verified[i] = true
+	}
+	return nil
+}
+
+// quarantine the segment at path, as corrupt.
+func quarantine(filesys fs.Filesystem, path string) error {
+	if err := filesys.Rename(path, modifyExtension(path, extCorrupt)); err != nil {
+		return err
+	}
+	return removeSidecars(filesys, path)
+}
+
+// quarantine the segment at path, and report it.
+func (fl *fileLog) quarantine(op, path string, cause error) {
+	if err := quarantine(fl.filesys, path); err != nil {
+		fl.reporter.ReportEvent(Event{
+			Op: op, File: path, Error: err,
+			Msg: fmt.Sprintf("failed to quarantine corrupt segment (%v)", cause),
+		})
+		return
+	}
+	fl.reporter.ReportEvent(Event{
+		Op: op, File: path, Error: cause,
+		Msg: fmt.Sprintf("quarantined corrupt segment as %s", modifyExtension(path, extCorrupt)),
+	})
+}
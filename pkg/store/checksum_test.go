@@ -0,0 +1,285 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestVerifyingReadCloser(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("01BB6RQR190Q1W0ZCGBPZQH8GR some record\n")
+	h := newChecksum()
+	h.Write(data)
+	sum := h.Sum32()
+
+	flipped := append([]byte{}, data...)
+	flipped[10] ^= 1
+	for _, testcase := range []struct {
+		name    string
+		data    []byte
+		size    int64
+		corrupt bool
+	}{
+		{"intact", data, int64(len(data)), false},
+		{"flipped", flipped, int64(len(data)), true},
+		{"short", data[:20], int64(len(data)), true},
+		{"long", append(append([]byte{}, data...), 'x'), int64(len(data)), true},
+	} {
+		var calls int
+		v := newVerifyingReadCloser(ioutil.NopCloser(bytes.NewReader(testcase.data)), testcase.size, sum).(*verifyingReadCloser)
+		v.corrupt = func(error) { calls++ }
+		_, err := ioutil.ReadAll(v)
+		if want, have := testcase.corrupt, isCorrupt(err); want != have {
+			t.Errorf("%s: want corrupt %v, have %v (%v)", testcase.name, want, have, err)
+		}
+		if _, again := v.Read(make([]byte, 1)); testcase.corrupt && again != err {
+			t.Errorf("%s: want %v again, have %v", testcase.name, err, again)
+		}
+		if want, have := map[bool]int{true: 1}[testcase.corrupt], calls; want != have {
+			t.Errorf("%s: want %d corrupt calls, have %d", testcase.name, want, have)
+		}
+	}
+}
+
+func TestQuarantineCorruptSegments(t *testing.T) {
+	t.Parallel()
+
+	var (
+		filesys  = fs.NewVirtualFilesystem()
+		reporter = &eventRecorder{}
+	)
+	filelog, err := NewFileLog(filesys, "/", 64*1024*1024, 1024, reporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	// Two segments, one of which gets corrupted.
+	var (
+		t0    = time.Now().Add(-time.Hour)
+		paths []string
+	)
+	for i := 0; i < 2; i++ {
+		segment, err := filelog.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lo, hi ulid.ULID
+		for j := 0; j < 10; j++ {
+			id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i*10+j)*time.Millisecond)), nil)
+			fmt.Fprintf(segment, "%s segment %d record %d\n", id, i, j)
+			if j == 0 {
+				lo = id
+			}
+			hi = id
+		}
+		if err := segment.Close(lo, hi); err != nil {
+			t.Fatal(err)
+		}
+		path := fmt.Sprintf("/%s-%s%s", lo, hi, extFlushed)
+		if !filesys.Exists(checksumPath(path)) {
+			t.Fatalf("%s has no checksum", path)
+		}
+		paths = append(paths, path)
+	}
+	corruptFile(t, filesys, paths[1], func(data []byte) { data[len(data)/2] ^= 1 })
+
+	u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&q=record",
+		t0.Add(-time.Minute).UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339)))
+	var qp QueryParams
+	if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+		t.Fatal(err)
+	}
+	result, err := filelog.Query(qp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(result.Records)
+	result.Records.Close()
+	if !isCorrupt(err) {
+		t.Errorf("query: want corrupt segment error, have %v", err)
+	}
+	checkQuarantined(t, filesys, paths[1])
+	if !filesys.Exists(paths[0]) {
+		t.Errorf("%s was quarantined too", paths[0])
+	}
+	if want, have := 1, reporter.count(paths[1]); want != have {
+		t.Errorf("want %d event for %s, have %d", want, paths[1], have)
+	}
+
+	// The Compacter quarantines a segment with records it can't merge.
+	segment, err := filelog.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lo := ulid.MustNew(ulid.Timestamp(t0.Add(time.Second)), nil)
+	hi := ulid.MustNew(ulid.Timestamp(t0.Add(2*time.Second)), nil)
+	fmt.Fprintf(segment, "%s fine\nshort\n%s fine\n", lo, hi)
+	if err := segment.Close(lo, hi); err != nil {
+		t.Fatal(err)
+	}
+	short := fmt.Sprintf("/%s-%s%s", lo, hi, extFlushed)
+
+	compactDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"kind", "compacted", "result"})
+	c := NewCompacter(filelog, 64*1024*1024, time.Hour, time.Hour, false, compactDuration, nil, nil, reporter)
+	if _, result := c.compact("Sequential", filelog.Sequential); result != "Corrupt" {
+		t.Fatalf("want Corrupt, have %s", result)
+	}
+	checkQuarantined(t, filesys, short)
+	if !filesys.Exists(paths[0]) {
+		t.Errorf("%s wasn't set aside for the next compaction", paths[0])
+	}
+
+	// A segment with a name we can't parse is quarantined, not removed.
+	bad := "/not-a-segment" + extFlushed
+	f, err := filesys.Create(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := filelog.Sequential(); err != ErrNoSegmentsAvailable {
+		t.Errorf("want %v, have %v", ErrNoSegmentsAvailable, err)
+	}
+	checkQuarantined(t, filesys, bad)
+}
+
+func TestQueryVerifiesWhatItReads(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name  string
+		order string
+		whole bool // without an index
+	}{
+		{"asc", QueryOrderAsc, false},
+		{"desc", QueryOrderDesc, false},
+		{"desc whole", QueryOrderDesc, true},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			filesys := fs.NewVirtualFilesystem()
+			filelog, err := NewFileLog(filesys, "/", 64*1024*1024, 1024, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer filelog.Close()
+
+			// A segment of a few index strides, corrupted in the middle.
+			var (
+				t0  = time.Now().Add(-time.Hour)
+				n   = 8 * indexStride / 64
+				ids = make([]ulid.ULID, n)
+			)
+			segment, err := filelog.Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range ids {
+				ids[i] = ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*time.Millisecond)), nil)
+				fmt.Fprintf(segment, "%s record %029d\n", ids[i], i) // 64 bytes
+			}
+			if err := segment.Close(ids[0], ids[n-1]); err != nil {
+				t.Fatal(err)
+			}
+			path := fmt.Sprintf("/%s-%s%s", ids[0], ids[n-1], extFlushed)
+			corruptFile(t, filesys, path, func(data []byte) { data[len(data)/2+100] ^= 1 })
+			if testcase.whole {
+				if err := filesys.Remove(indexPath(path)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A query of the corrupt part notices, whichever way it reads.
+			var (
+				lo, hi = n/2 + 10, n/2 + 20
+				from   = time.Unix(0, int64(ids[lo].Time())*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+				to     = time.Unix(0, int64(ids[hi].Time())*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+			)
+			u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&q=record&order=%s", from, to, testcase.order))
+			var qp QueryParams
+			if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+				t.Fatal(err)
+			}
+			result, err := filelog.Query(qp, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ioutil.ReadAll(result.Records)
+			result.Records.Close()
+			if !isCorrupt(err) {
+				t.Errorf("want corrupt segment error, have %v", err)
+			}
+			checkQuarantined(t, filesys, path)
+		})
+	}
+}
+
+// corruptFile rewrites the file at path, after modify has its way with it.
+func corruptFile(t *testing.T, filesys fs.Filesystem, path string, modify func([]byte)) {
+	t.Helper()
+	f, err := filesys.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify(data)
+	if f, err = filesys.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkQuarantined(t *testing.T, filesys fs.Filesystem, path string) {
+	t.Helper()
+	if filesys.Exists(path) {
+		t.Errorf("%s still exists", path)
+	}
+	if corrupt := modifyExtension(path, extCorrupt); !filesys.Exists(corrupt) {
+		t.Errorf("%s doesn't exist", corrupt)
+	}
+	for _, sidecar := range []string{indexPath(path), bloomPath(path), checksumPath(path)} {
+		if filesys.Exists(sidecar) {
+			t.Errorf("%s still exists", sidecar)
+		}
+	}
+}
+
+type eventRecorder struct {
+	mtx    sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) ReportEvent(e Event) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events = append(r.events, e)
+}
+
+// count the events about the file at path.
+func (r *eventRecorder) count(path string) (n int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, e := range r.events {
+		if e.File == path {
+			n++
+		}
+	}
+	return n
+}
@@ -17,6 +17,7 @@ type Compacter struct {
 	segmentTargetSize int64
 	retain            time.Duration
 	purge             time.Duration
+	compress          bool
 	stop              chan chan struct{}
 	compactDuration   *prometheus.HistogramVec
 	trashSegments     *prometheus.CounterVec
@@ -25,10 +26,11 @@ type Compacter struct {
 }
 
 // NewCompacter creates a Compacter.
+// If compress is true, the segments it writes are compressed.
 // Don't forget to Run it.
 func NewCompacter(
 	log Log,
-	segmentTargetSize int64, retain time.Duration, purge time.Duration,
+	segmentTargetSize int64, retain time.Duration, purge time.Duration, compress bool,
 	compactDuration *prometheus.HistogramVec, trashSegments, purgeSegments *prometheus.CounterVec,
 	reporter EventReporter,
 ) *Compacter {
@@ -37,6 +39,7 @@ func NewCompacter(
 		segmentTargetSize: segmentTargetSize,
 		retain:            retain,
 		purge:             purge,
+		compress:          compress,
 		stop:              make(chan chan struct{}),
 		trashSegments:     trashSegments,
 		purgeSegments:     purgeSegments,
@@ -123,7 +126,18 @@ func (c *Compacter) compact(kind string, getSegments func() ([]ReadSegment, erro
 	for i, readSegment := range readSegments {
 		readers[i] = readSegment
 	}
-	if _, err := mergeRecordsToLog(c.log, c.segmentTargetSize, readers...); err != nil {
+	create := c.log.Create
+	if c.compress {
+		create = c.log.CreateCompressed
+	}
+	if _, err := mergeRecordsToLog(create, c.segmentTargetSize, readers...); err != nil {
+		if serr, ok := err.(segmentError); ok && isCorrupt(serr) {
+			// Set the corrupt segment aside, so the rest can be compacted
+			// next time.
+			c.quarantine(kind, readSegments[serr.reader], serr.err)
+			readSegments = append(readSegments[:serr.reader], readSegments[serr.reader+1:]...)
+			return 0, "Corrupt"
+		}
 		c.reporter.ReportEvent(Event{
 			Op: "compact", Error: err,
 			Msg: fmt.Sprintf("compact %s failed during mergeRecordsToLog", kind),
@@ -151,6 +165,20 @@ func (c *Compacter) compact(kind string, getSegments func() ([]ReadSegment, erro
 	return n, "OK"
 }
 
+func (c *Compacter) quarantine(kind string, readSegment ReadSegment, cause error) {
+	if err := readSegment.Quarantine(); err != nil {
+		c.reporter.ReportEvent(Event{
+			Op: "compact", Error: err,
+			Msg: fmt.Sprintf("compact %s failed to Quarantine a corrupt read segment (%v)", kind, cause),
+		})
+		return
+	}
+	c.reporter.ReportEvent(Event{
+		Op: "compact", Error: cause,
+		Msg: fmt.Sprintf("compact %s quarantined a corrupt read segment", kind),
+	})
+}
+
 func (c *Compacter) moveToTrash() {
 	oldestRecord := time.Now().Add(-c.retain)
 	readSegments, err := c.log.Trashable(oldestRecord)
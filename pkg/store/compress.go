@@ -0,0 +1,271 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+// The Compacter may write segments compressed. Their names have extCompressed
+// before the extension of their state, e.g. LOW-HIGH.z.flushed, so that it
+// survives every change of state, and old and new segments coexist.
+//
+// A compressed segment is a header, then blocks of whole records, each
+// deflated on its own. Since records never span blocks, a reader can start at
+// any block, which is what the index points to. Each block has a header of its
+// compressed and raw sizes, as big-endian uint32s. The last block is empty,
+// and followed by the raw size of the segment, as a big-endian uint64.
+const (
+	extCompressed = ".z"
+
+	compressBlockSize   = indexStride // raw bytes, about
+	compressBlockHeader = 8           // bytes
+	compressTrailer     = compressBlockHeader + 8
+
+	// maxCompressedBlock is far larger than any block we write, and smaller
+	// than compressMagic read as a size, so we can tell a block header from the
+	// segment header.
+	maxCompressedBlock = 1 << 30
+)
+
+var compressMagic = []byte("OKLZ\x00\x00\x00\x01") // and version
+
+// isCompressed returns true if the segment at path is compressed.
+func isCompressed(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasSuffix(base[:len(base)-len(filepath.Ext(base))], extCompressed)
+}
+
+// blockWriter compresses the records written to it into blocks.
+type blockWriter struct {
+	w   io.Writer
+	buf []byte // raw records, not yet in a block
+	z   bytes.Buffer
+	zw  *flate.Writer
+	raw uint64 // total
+	err error
+}
+
+func newBlockWriter(w io.Writer) (*blockWriter, error) {
+	zw, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(compressMagic); err != nil {
+		return nil, err
+	}
+	return &blockWriter{w: w, zw: zw}, nil
+}
+
+// Write buffers p, and writes a block once there's enough, up to the end of
+// the last whole record.
+func (w *blockWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= compressBlockSize {
+		if i := bytes.LastIndexByte(w.buf, '\n'); i >= 0 {
+			if w.err = w.writeBlock(i + 1); w.err != nil {
+				return 0, w.err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// writeBlock compresses the first n bytes of buf into a block.
+func (w *blockWriter) writeBlock(n int) error {
+	w.z.Reset()
+	w.zw.Reset(&w.z)
+	if _, err := w.zw.Write(w.buf[:n]); err != nil {
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	var header [compressBlockHeader]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(w.z.Len()))
+	binary.BigEndian.PutUint32(header[4:], uint32(n))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.z.Bytes()); err != nil {
+		return err
+	}
+	w.raw += uint64(n)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return nil
+}
+
+// Close writes the rest of the records, and the trailer. It doesn't close the
+// underlying writer.
+func (w *blockWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) > 0 {
+		if err := w.writeBlock(len(w.buf)); err != nil {
+			return err
+		}
+	}
+	var trailer [compressTrailer]byte
+	binary.BigEndian.PutUint64(trailer[compressBlockHeader:], w.raw)
+	_, err := w.w.Write(trailer[:])
+	return err
+}
+
+// newBlockReadCloser decompresses the records of a compressed segment, read
+// from the start of the file, or from the start of any block.
+func newBlockReadCloser(src io.ReadCloser) io.ReadCloser {
+	return &blockReadCloser{src: src, first: true}
+}
+
+type blockReadCloser struct {
+	src   io.ReadCloser
+	first bool
+	whole bool // we started at the start of the file
+	z     bytes.Buffer
+	zr    io.ReadCloser
+	buf   []byte
+	raw   []byte // decompressed, not yet read
+	err   error
+
+	// block, if set, is called with the offsets of each block as it's read.
+	block  func(blockOffset)
+	off    int64 // read from src
+	rawOff int64 // decompressed
+}
+
+// blockOffset is where a block starts, in the file and in the records.
+type blockOffset struct {
+	file, raw int64
+}
+
+func (r *blockReadCloser) Read(p []byte) (int, error) {
+	for len(r.raw) <= 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.raw)
+	r.raw = r.raw[n:]
+	return n, nil
+}
+
+// next decompresses the next block.
+func (r *blockReadCloser) next() error {
+	var header [compressBlockHeader]byte
+	if _, err := io.ReadFull(r.src, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return corruptf("truncated block header")
+		}
+		return err // EOF at a block boundary is a section's end
+	}
+	start := r.off
+	r.off += compressBlockHeader
+	if r.first {
+		r.first = false
+		if bytes.Equal(header[:4], compressMagic[:4]) {
+			if !bytes.Equal(header[:], compressMagic) {
+				return corruptf("unsupported compressed segment version %d", binary.BigEndian.Uint32(header[4:]))
+			}
+			r.whole = true
+			return nil // the blocks follow
+		}
+	}
+	zlen, rawlen := binary.BigEndian.Uint32(header[:4]), binary.BigEndian.Uint32(header[4:])
+	if zlen == 0 {
+		return r.trailer()
+	}
+	if zlen > maxCompressedBlock || rawlen > maxCompressedBlock {
+		return corruptf("invalid block header: %d bytes, %d raw", zlen, rawlen)
+	}
+
+	if r.block != nil {
+		r.block(blockOffset{file: start, raw: r.rawOff})
+	}
+
+	r.z.Reset()
+	if _, err := io.CopyN(&r.z, r.src, int64(zlen)); err != nil {
+		if err == io.EOF {
+			return corruptf("truncated block")
+		}
+		return err
+	}
+	r.off += int64(zlen)
+	if r.zr == nil {
+		r.zr = flate.NewReader(&r.z)
+	} else if err := r.zr.(flate.Resetter).Reset(&r.z, nil); err != nil {
+		return err
+	}
+	if cap(r.buf) < int(rawlen) {
+		r.buf = make([]byte, rawlen)
+	}
+	r.buf = r.buf[:rawlen]
+	if _, err := io.ReadFull(r.zr, r.buf); err != nil {
+		return corruptf("block: %v", err)
+	}
+	r.raw = r.buf
+	r.rawOff += int64(rawlen)
+	return nil
+}
+
+// trailer reads the rest of the segment, after the empty last block, and
+// returns io.EOF if it's all there. Reading to the end also lets src verify
+// the segment, if it does.
+func (r *blockReadCloser) trailer() error {
+	var size [8]byte
+	if _, err := io.ReadFull(r.src, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return corruptf("truncated trailer")
+		}
+		return err
+	}
+	if r.whole && binary.BigEndian.Uint64(size[:]) != uint64(r.rawOff) {
+		return corruptf("%d bytes of records, expected %d", r.rawOff, binary.BigEndian.Uint64(size[:]))
+	}
+	var extra [1]byte
+	switch n, err := r.src.Read(extra[:]); {
+	case n > 0:
+		return corruptf("data after the trailer")
+	case err != nil && err != io.EOF:
+		return err
+	}
+	return io.EOF
+}
+
+func (r *blockReadCloser) Close() error {
+	return r.src.Close()
+}
+
+// compressedRawSize returns the size of the records in the compressed segment
+// at path, from its trailer.
+func compressedRawSize(filesys fs.Filesystem, path string) (int64, error) {
+	f, err := filesys.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		return io.Copy(ioutil.Discard, newBlockReadCloser(f))
+	}
+	var trailer [compressTrailer]byte
+	if _, err := ra.ReadAt(trailer[:], f.Size()-compressTrailer); err != nil {
+		return 0, errors.Wrap(err, "reading trailer")
+	}
+	if binary.BigEndian.Uint32(trailer[:4]) != 0 {
+		return 0, errors.New("invalid trailer")
+	}
+	return int64(binary.BigEndian.Uint64(trailer[compressBlockHeader:])), nil
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestBlockWriter(t *testing.T) {
+	t.Parallel()
+
+	// Records of all sizes, for a few blocks.
+	var (
+		records bytes.Buffer
+		rng     = rand.New(rand.NewSource(18))
+	)
+	for records.Len() < 5*compressBlockSize {
+		id := ulid.MustNew(uint64(records.Len()), rng)
+		fmt.Fprintf(&records, "%s %s\n", id, strings.Repeat("x", rng.Intn(2000)))
+	}
+	records.WriteString(ulid.MustNew(0, rng).String() + " no newline")
+
+	var segment bytes.Buffer
+	w, err := newBlockWriter(&segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range bytes.SplitAfter(records.Bytes(), []byte("x\n")) {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if segment.Len() >= records.Len()/2 {
+		t.Errorf("compressed %d bytes to %d", records.Len(), segment.Len())
+	}
+
+	// The whole segment.
+	var (
+		blocks []blockOffset
+		r      = &blockReadCloser{src: ioutil.NopCloser(bytes.NewReader(segment.Bytes())), first: true}
+	)
+	r.block = func(b blockOffset) { blocks = append(blocks, b) }
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(records.Bytes(), buf) {
+		t.Fatalf("want %d bytes of records back, have %d", records.Len(), len(buf))
+	}
+	if len(blocks) < 5 {
+		t.Fatalf("want at least 5 blocks, have %d", len(blocks))
+	}
+
+	// From any block, to the end or the start of a later block.
+	for i, b := range blocks {
+		want := records.Bytes()[b.raw:]
+		if b.raw > 0 && buf[b.raw-1] != '\n' {
+			t.Errorf("block %d: starts in the middle of a record", i)
+		}
+		end := int64(segment.Len())
+		if i+2 < len(blocks) {
+			end = blocks[i+2].file
+			want = records.Bytes()[b.raw:blocks[i+2].raw]
+		}
+		have, err := ioutil.ReadAll(newBlockReadCloser(ioutil.NopCloser(bytes.NewReader(segment.Bytes()[b.file:end]))))
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if !bytes.Equal(want, have) {
+			t.Errorf("block %d: want %d bytes, have %d", i, len(want), len(have))
+		}
+	}
+
+	// Torn and corrupt segments are errors.
+	for name, data := range map[string][]byte{
+		"torn block":  segment.Bytes()[:blocks[1].file-10],
+		"torn header": segment.Bytes()[:blocks[1].file+4],
+		"bad version": append([]byte("OKLZ\x00\x00\x00\x09"), segment.Bytes()[len(compressMagic):]...),
+		"bad block":   append(append([]byte{}, segment.Bytes()[:blocks[1].file+compressBlockHeader]...), bytes.Repeat([]byte{0xff}, 100)...),
+	} {
+		if _, err := ioutil.ReadAll(newBlockReadCloser(ioutil.NopCloser(bytes.NewReader(data)))); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+
+	// The trailer has the size of the records.
+	filesys := fs.NewVirtualFilesystem()
+	f, err := filesys.Create("/segment" + extCompressed + extFlushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(segment.Bytes())
+	f.Close()
+	if size, err := compressedRawSize(filesys, f.Name()); err != nil || size != int64(records.Len()) {
+		t.Errorf("raw size: want %d, have %d (%v)", records.Len(), size, err)
+	}
+}
+
+func TestCompressedSegments(t *testing.T) {
+	t.Parallel()
+
+	filesys := fs.NewVirtualFilesystem()
+	filelog, err := NewFileLog(filesys, "/", 64*1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A compressed segment, and a raw one that overlaps it.
+	var (
+		t0      = time.Now().Add(-time.Hour)
+		entropy = rand.New(rand.NewSource(18))
+		n       = 4 * compressBlockSize / 64
+		ids     = make([]ulid.ULID, n)
+	)
+	for i := range ids {
+		ids[i] = ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*time.Millisecond)), entropy)
+	}
+	for parity, create := range []func() (WriteSegment, error){filelog.CreateCompressed, filelog.Create} {
+		segment, err := create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := parity; i < n; i += 2 {
+			fmt.Fprintf(segment, "%s record %029d\n", ids[i], i) // 64 bytes
+		}
+		if err := segment.Close(ids[parity], ids[n-2+parity]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compressed := fmt.Sprintf("/%s-%s%s%s", ids[0], ids[n-2], extCompressed, extFlushed)
+	if !filesys.Exists(compressed) {
+		t.Fatalf("%s doesn't exist", compressed)
+	}
+	if idx, err := readIndex(filesys, compressed); err != nil || len(idx) < 2 {
+		t.Fatalf("index of %s: %d entries (%v)", compressed, len(idx), err)
+	}
+
+	query := func(order, from, to string) []string {
+		u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&q=record&order=%s", from, to, order))
+		var qp QueryParams
+		if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+			t.Fatal(err)
+		}
+		result, err := filelog.Query(qp, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(result.Records)
+		result.Records.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+	check := func(name string) {
+		for _, order := range []string{QueryOrderAsc, QueryOrderDesc} {
+			var (
+				lo, hi = n/2 + 10, n/2 + 20
+				millis = func(id ulid.ULID) string {
+					return time.Unix(0, int64(id.Time())*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+				}
+				all  = query(order, t0.Add(-time.Minute).Format(time.RFC3339), time.Now().Format(time.RFC3339))
+				some = query(order, millis(ids[lo]), millis(ids[hi]))
+			)
+			if want, have := n, len(all); want != have {
+				t.Errorf("%s, %s: want %d records, have %d", name, order, want, have)
+			}
+			if want, have := hi-lo+1, len(some); want != have {
+				t.Errorf("%s, %s: want %d records in range, have %d", name, order, want, have)
+				continue
+			}
+			first, last := ids[lo].String(), ids[hi].String()
+			if order == QueryOrderDesc {
+				first, last = last, first
+			}
+			if !strings.HasPrefix(some[0], first) || !strings.HasPrefix(some[len(some)-1], last) {
+				t.Errorf("%s, %s: want %s..%s, have %s..%s", name, order, first, last, some[0][:ulid.EncodedSize], some[len(some)-1][:ulid.EncodedSize])
+			}
+		}
+	}
+	check("before compaction")
+
+	// Compact them into a compressed segment, as the Compacter would.
+	segments, err := filelog.Sequential()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers := make([]io.Reader, len(segments))
+	for i, segment := range segments {
+		readers[i] = segment
+	}
+	if _, err := mergeRecordsToLog(filelog.CreateCompressed, 64*1024*1024, readers...); err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range segments {
+		if err := segment.Purge(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compacted := fmt.Sprintf("/%s-%s%s%s", ids[0], ids[n-1], extCompressed, extFlushed)
+	if !filesys.Exists(compacted) {
+		t.Fatalf("%s doesn't exist", compacted)
+	}
+	if size, err := compressedRawSize(filesys, compacted); err != nil || size != int64(64*n) {
+		t.Errorf("raw size: want %d, have %d (%v)", 64*n, size, err)
+	}
+	check("after compaction")
+
+	// Recovery drops compressed segments that were still being written.
+	active, err := filelog.CreateCompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(active, "%s record\n", ids[0])
+	filelog.Close()
+	if filelog, err = NewFileLog(filesys, "/", 64*1024*1024, 1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	filesys.Walk("/", func(path string, info os.FileInfo, err error) error {
+		if filepath.Ext(path) == extActive {
+			t.Errorf("%s wasn't removed", path)
+		}
+		return nil
+	})
+	check("after recovery")
+}
@@ -1,72 +1,115 @@
 package store
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/oklog/ulid"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/fs"
 	"github.com/1046102779/oklog/pkg/ingest"
 )
 
 // Consumer reads segments from the ingesters, and replicates merged segments to
 // the rest of the cluster. It's implemented as a state machine: gather
-// segments, replicate, commit, and repeat. All failures invalidate the entire
-// batch.
+// segments, replicate, commit, and repeat. Failures to gather invalidate the
+// entire batch. Failures to replicate are retried against other stores, and
+// the batch is committed once it's on enough of them, or on any of them after
+// the last attempt.
+//
+// The merged segment is spooled to a file, rather than held in memory, and
+// streamed from there to the stores, concurrently.
 type Consumer struct {
-	peer               *cluster.Peer
-	client             *http.Client
-	segmentTargetSize  int64
-	segmentTargetAge   time.Duration
-	replicationFactor  int
-	gatherErrors       int                 // heuristic to move out of gather state
-	pending            map[string][]string // ingester: segment IDs
-	active             *bytes.Buffer       // merged pending segments
-	activeSince        time.Time           // active segment has been "open" since this time
-	stop               chan chan struct{}
-	consumedSegments   prometheus.Counter
-	consumedBytes      prometheus.Counter
-	replicatedSegments prometheus.Counter
-	replicatedBytes    prometheus.Counter
-	reporter           EventReporter
+	peer                ClusterPeer
+	client              *http.Client
+	filesys             fs.Filesystem
+	spoolPath           string
+	segmentTargetSize   int64
+	segmentTargetAge    time.Duration
+	replicationFactor   int
+	replicationTimeout  time.Duration          // per target
+	ring                *Ring                  // places segments, if not nil
+	gatherErrors        int                    // heuristic to move out of gather state
+	pending             map[string][]string    // ingester: segment IDs
+	activeSize          int64                  // of the merged pending segments, in the spool
+	activeSince         time.Time              // active segment has been "open" since this time
+	parts               map[string][]spoolPart // with a ring, store: the parts of active it owns
+	replicated          map[string]bool        // stores that have the active segment
+	failed              map[string]bool        // stores that failed to take it
+	replicateAttempts   int
+	replicateAfter      time.Time // backing off until
+	stop                chan chan struct{}
+	consumedSegments    prometheus.Counter
+	consumedBytes       prometheus.Counter
+	replicatedSegments  prometheus.Counter
+	replicatedBytes     prometheus.Counter
+	replicationDuration *prometheus.HistogramVec
+	replicationRetries  prometheus.Counter
+	reporter            EventReporter
 }
 
-// NewConsumer creates a consumer.
+const (
+	maxReplicateAttempts = 3
+	replicateBackoff     = time.Second // times the attempts so far
+)
+
+// NewConsumer creates a consumer, which spools the segment it's replicating to
+// spoolPath on filesys. Every consumer needs a spoolPath of its own. If ring
+// isn't nil, segments go to the stores that own them in it, rather than to any.
 // Don't forget to Run it.
 func NewConsumer(
-	peer *cluster.Peer,
+	peer ClusterPeer,
 	client *http.Client,
+	filesys fs.Filesystem,
+	spoolPath string,
 	segmentTargetSize int64,
 	segmentTargetAge time.Duration,
 	replicationFactor int,
+	replicationTimeout time.Duration,
+	ring *Ring,
 	consumedSegments, consumedBytes prometheus.Counter,
 	replicatedSegments, replicatedBytes prometheus.Counter,
+	replicationDuration *prometheus.HistogramVec,
+	replicationRetries prometheus.Counter,
 	reporter EventReporter,
 ) *Consumer {
 	return &Consumer{
-		peer:               peer,
-		client:             client,
-		segmentTargetSize:  segmentTargetSize,
-		segmentTargetAge:   segmentTargetAge,
-		replicationFactor:  replicationFactor,
-		gatherErrors:       0,
-		pending:            map[string][]string{},
-		active:             &bytes.Buffer{},
-		activeSince:        time.Time{},
-		stop:               make(chan chan struct{}),
-		consumedSegments:   consumedSegments,
-		consumedBytes:      consumedBytes,
-		replicatedSegments: replicatedSegments,
-		replicatedBytes:    replicatedBytes,
-		reporter:           reporter,
+		peer:                peer,
+		client:              client,
+		filesys:             filesys,
+		spoolPath:           spoolPath,
+		segmentTargetSize:   segmentTargetSize,
+		segmentTargetAge:    segmentTargetAge,
+		replicationFactor:   replicationFactor,
+		replicationTimeout:  replicationTimeout,
+		ring:                ring,
+		gatherErrors:        0,
+		pending:             map[string][]string{},
+		activeSize:          0,
+		activeSince:         time.Time{},
+		parts:               nil,
+		replicated:          map[string]bool{},
+		failed:              map[string]bool{},
+		stop:                make(chan chan struct{}),
+		consumedSegments:    consumedSegments,
+		consumedBytes:       consumedBytes,
+		replicatedSegments:  replicatedSegments,
+		replicatedBytes:     replicatedBytes,
+		replicationDuration: replicationDuration,
+		replicationRetries:  replicationRetries,
+		reporter:            reporter,
 	}
 }
 
@@ -82,7 +125,11 @@ func (c *Consumer) Run() {
 			state = state()
 
 		case q := <-c.stop:
-			c.fail() // any outstanding segments
+			if len(c.replicated) > 0 {
+				c.commit() // it's somewhere, at least
+			} else {
+				c.fail() // any outstanding segments
+			}
 			close(q)
 			return
 		}
@@ -103,7 +150,7 @@ func (c *Consumer) gather() stateFn {
 	// TODO(pb): this obviously needs more thought and consideration
 	instances := c.peer.Current(cluster.PeerTypeIngest)
 	if c.gatherErrors > 0 && c.gatherErrors > 2*len(instances) {
-		if c.active.Len() <= 0 {
+		if c.activeSize <= 0 {
 			// We didn't successfully consume any segments.
 			// Nothing to do but reset and try again.
 			c.gatherErrors = 0
@@ -129,7 +176,7 @@ func (c *Consumer) gather() stateFn {
 
 	// More typical exit clauses.
 	var (
-		tooBig = int64(c.active.Len()) > c.segmentTargetSize
+		tooBig = c.activeSize > c.segmentTargetSize
 		tooOld = !c.activeSince.IsZero() && time.Since(c.activeSince) > c.segmentTargetAge
 	)
 	if tooBig || tooOld {
@@ -165,7 +212,7 @@ func (c *Consumer) gather() stateFn {
 	}
 	if nextResp.StatusCode != http.StatusOK {
 		c.reporter.ReportEvent(Event{
-			Op: "gather", Warning: fmt.Errorf(nextResp.Status),
+			Op: "gather", Warning: errors.New(nextResp.Status),
 			Msg: fmt.Sprintf("ingester %s, during %s: bad response code", instance, ingest.APIPathNext),
 		})
 		c.gatherErrors++
@@ -193,7 +240,7 @@ func (c *Consumer) gather() stateFn {
 	defer readResp.Body.Close()
 	if readResp.StatusCode != http.StatusOK {
 		c.reporter.ReportEvent(Event{
-			Op: "gather", Error: fmt.Errorf(readResp.Status),
+			Op: "gather", Error: errors.New(readResp.Status),
 			Msg: fmt.Sprintf("ingester %s, during %s: bad response code", instance, ingest.APIPathRead),
 		})
 		c.gatherErrors++
@@ -202,7 +249,8 @@ func (c *Consumer) gather() stateFn {
 
 	// Merge the segment into our active segment.
 	var cw countingWriter
-	if _, _, _, err := mergeRecords(c.active, io.TeeReader(readResp.Body, &cw)); err != nil {
+	_, _, n, err := c.mergeSpool(io.TeeReader(readResp.Body, &cw))
+	if err != nil {
 		c.reporter.ReportEvent(Event{
 			Op: "gather", Error: err,
 			Msg: fmt.Sprintf("ingester %s, during %s: fatal error", instance, "mergeRecords"),
@@ -210,6 +258,7 @@ func (c *Consumer) gather() stateFn {
 		c.gatherErrors++
 		return c.fail // fail everything, same as above
 	}
+	c.activeSize = n
 	if c.activeSince.IsZero() {
 		c.activeSince = time.Now()
 	}
@@ -221,55 +270,275 @@ func (c *Consumer) gather() stateFn {
 }
 
 func (c *Consumer) replicate() stateFn {
-	// Replicate the segment to the cluster.
+	if time.Now().Before(c.replicateAfter) {
+		return c.replicate // backing off
+	}
+
+	// Replicate the segment to the stores that don't have it yet, trying
+	// those that haven't failed to take it first, and spreading the replicas
+	// across zones. With a ring, the segment is split by bucket, and each
+	// store takes the parts it owns: only the owners will do, and all of them,
+	// but never fewer than the replication factor. If there are no owners, or
+	// too few, it's a failed attempt like any other.
 	var (
-		peers      = c.peer.Current(cluster.PeerTypeStore)
-		indices    = rand.Perm(len(peers))
-		replicated = 0
+		peers           = c.peer.Current(cluster.PeerTypeStore)
+		zones           = c.peer.Zones(cluster.PeerTypeStore)
+		ring            = c.ring.agreed(c.peer.RingBuckets(cluster.PeerTypeStore), peers, "replicate", c.reporter)
+		targets         = peers
+		want            = c.replicationFactor
+		untried, failed []string
 	)
-	if want, have := c.replicationFactor, len(peers); have < want {
-		c.reporter.ReportEvent(Event{
-			Op: "replicate", Warning: fmt.Errorf("replication factor %d, available peers %d: replication currently impossible", want, have),
-		})
-		return c.fail // can't do anything here
-	}
-	for i := 0; i < len(indices) && replicated < c.replicationFactor; i++ {
-		var (
-			index    = indices[i]
-			target   = peers[index]
-			uri      = fmt.Sprintf("http://%s/store%s", target, APIPathReplicate)
-			bodyType = "application/binary"
-			body     = bytes.NewReader(c.active.Bytes())
-		)
-		resp, err := c.client.Post(uri, bodyType, body)
+	c.parts = nil
+	if ring != nil {
+		parts, err := c.splitSpool(ring, peers, zones)
 		if err != nil {
 			c.reporter.ReportEvent(Event{
 				Op: "replicate", Error: err,
-				Msg: fmt.Sprintf("target %s, during %s: fatal error", target, APIPathReplicate),
+				Msg: "failed to split the segment by bucket",
 			})
-			continue // we'll try another one
+			return c.fail
 		}
-		resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			c.reporter.ReportEvent(Event{
-				Op: "replicate", Error: fmt.Errorf(resp.Status),
-				Msg: fmt.Sprintf("target %s, during %s: bad status code", target, APIPathReplicate),
-			})
-			continue // we'll try another one
+		c.parts, targets = parts, make([]string, 0, len(parts))
+		for target := range parts {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		if len(targets) > want {
+			want = len(targets)
+		}
+	}
+	have := func() (n int) {
+		for _, target := range targets {
+			if c.replicated[target] {
+				n++
+			}
+		}
+		return n
+	}
+	for _, i := range rand.Perm(len(targets)) {
+		switch target := targets[i]; {
+		case c.replicated[target]:
+			continue
+		case c.failed[target]:
+			failed = append(failed, target)
+		default:
+			untried = append(untried, target)
+		}
+	}
+	// Each round streams the segment to as many stores as are missing,
+	// concurrently.
+	for candidates := append(untried, failed...); len(candidates) > 0 && have() < want; {
+		candidates = spreadZones(candidates, zones, c.replicas())
+		n := want - have()
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		var (
+			round = candidates[:n]
+			errs  = make([]error, n)
+			wg    sync.WaitGroup
+		)
+		candidates = candidates[n:]
+		wg.Add(n)
+		for i, target := range round {
+			go func(i int, target string) {
+				defer wg.Done()
+				errs[i] = c.replicateTo(target)
+			}(i, target)
+		}
+		wg.Wait()
+		for i, target := range round {
+			if err := errs[i]; err != nil {
+				c.reporter.ReportEvent(Event{
+					Op: "replicate", Error: err,
+					Msg: fmt.Sprintf("target %s, during %s", target, APIPathReplicate),
+				})
+				c.failed[target] = true
+				continue // we'll try another one
+			}
+			c.replicated[target] = true
+			delete(c.failed, target)
 		}
-		replicated++
 	}
-	if replicated < c.replicationFactor {
+	if have() >= want {
+		// All good!
+		c.replicatedSegments.Inc()
+		c.replicatedBytes.Add(float64(c.activeSize))
+		c.peer.SetPlacement(placement(c.replicas(), peers, zones))
+		return c.commit
+	}
+
+	// Try again for the missing replicas, in a bit.
+	c.replicateAttempts++
+	if c.replicateAttempts < maxReplicateAttempts {
 		c.reporter.ReportEvent(Event{
-			Op: "replicate", Error: fmt.Errorf("failed to fully replicate: want %d, have %d", c.replicationFactor, replicated),
+			Op: "replicate", Warning: fmt.Errorf("replicated to %d of %d stores, with %d available", have(), want, len(targets)),
+			Msg: fmt.Sprintf("attempt %d of %d; will retry", c.replicateAttempts, maxReplicateAttempts),
 		})
-		return c.fail // harsh, but OK
+		c.replicationRetries.Inc()
+		c.replicateAfter = time.Now().Add(time.Duration(c.replicateAttempts) * replicateBackoff)
+		return c.replicate
+	}
+	if len(c.replicated) > 0 {
+		// Failing the segments would have the ingesters hand them out again,
+		// duplicating them on the stores that have them. Better to leave the
+		// missing replicas to the Repairers.
+		c.reporter.ReportEvent(Event{
+			Op: "replicate", Warning: fmt.Errorf("replicated to %d of %d stores", have(), want),
+			Msg: "committing the under-replicated segment anyway",
+		})
+		c.replicatedSegments.Inc()
+		c.replicatedBytes.Add(float64(c.activeSize))
+		c.peer.SetPlacement(placement(c.replicas(), peers, zones))
+		return c.commit
+	}
+	c.reporter.ReportEvent(Event{
+		Op: "replicate", Error: fmt.Errorf("failed to replicate to any of %d stores", len(targets)),
+	})
+	return c.fail // harsh, but OK
+}
+
+// mergeSpool merges the records with those of the active segment, into a new
+// spool that then replaces it. Segments from the ingesters overlap in time, so
+// appending them to one another would give the stores unsorted segments.
+func (c *Consumer) mergeSpool(r io.Reader) (low, high ulid.ULID, n int64, err error) {
+	next := c.spoolPath + ".next"
+	f, err := c.filesys.Create(next)
+	if err != nil {
+		return low, high, n, err
+	}
+	readers := []io.Reader{r}
+	if c.filesys.Exists(c.spoolPath) {
+		prev, err := c.filesys.Open(c.spoolPath)
+		if err != nil {
+			f.Close()
+			c.filesys.Remove(next)
+			return low, high, n, err
+		}
+		defer prev.Close()
+		readers = append(readers, prev)
+	}
+	low, high, n, err = mergeRecords(f, readers...)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		c.filesys.Remove(next)
+		return low, high, n, err
+	}
+	return low, high, n, c.filesys.Rename(next, c.spoolPath)
+}
+
+// replicas returns the stores that have the active segment, sorted.
+func (c *Consumer) replicas() []string {
+	replicas := make([]string, 0, len(c.replicated))
+	for store := range c.replicated {
+		replicas = append(replicas, store)
+	}
+	sort.Strings(replicas)
+	return replicas
+}
+
+// spoolPart is a range of the spool, in bytes.
+type spoolPart struct {
+	offset, size int64
+}
+
+// splitSpool splits the active segment by the buckets of the ring, and
+// returns the parts each of the stores owns, in order. The spool is sorted,
+// so the records of a bucket are together. Records with IDs we can't parse go
+// with the ones before them.
+func (c *Consumer) splitSpool(ring *Ring, stores []string, zones map[string]string) (map[string][]spoolPart, error) {
+	f, err := c.filesys.Open(c.spoolPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		parts  = map[string][]spoolPart{}
+		owners []string // of the current bucket
+		bucket uint64
+		offset int64
+		id     ulid.ULID
+		s      = bufio.NewScanner(io.LimitReader(f, c.activeSize))
+	)
+	s.Split(scanLinesPreserveNewline)
+	s.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	for s.Scan() {
+		record := s.Bytes()
+		ok := len(record) >= ulid.EncodedSize && id.UnmarshalText(record[:ulid.EncodedSize]) == nil
+		if b := ring.bucket(id.Time()); owners == nil || (ok && b != bucket) {
+			bucket, owners = b, ring.owners(stores, zones, b)
+		}
+		size := int64(len(record))
+		for _, owner := range owners {
+			if n := len(parts[owner]); n > 0 && parts[owner][n-1].offset+parts[owner][n-1].size == offset {
+				parts[owner][n-1].size += size
+				continue
+			}
+			parts[owner] = append(parts[owner], spoolPart{offset, size})
+		}
+		offset += size
+	}
+	return parts, s.Err()
+}
+
+// replicateTo streams the active segment, or with a ring the parts of it the
+// target owns, to the target store, from a handle of its own on the spool.
+func (c *Consumer) replicateTo(target string) (err error) {
+	defer func(begin time.Time) {
+		result := "OK"
+		if err != nil {
+			result = "Error"
+		}
+		c.replicationDuration.WithLabelValues(result).Observe(time.Since(begin).Seconds())
+	}(time.Now())
 
-	// All good!
-	c.replicatedSegments.Inc()
-	c.replicatedBytes.Add(float64(c.active.Len()))
-	return c.commit
+	ctx := context.Background()
+	if c.replicationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.replicationTimeout)
+		defer cancel()
+	}
+	f, err := c.filesys.Open(c.spoolPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var (
+		body io.Reader = io.LimitReader(f, c.activeSize)
+		size           = c.activeSize
+	)
+	if c.parts != nil {
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			return errors.New("can't read parts of the spool")
+		}
+		var readers []io.Reader
+		size = 0
+		for _, part := range c.parts[target] {
+			readers = append(readers, io.NewSectionReader(ra, part.offset, part.size))
+			size += part.size
+		}
+		body = io.MultiReader(readers...)
+	}
+	uri := fmt.Sprintf("http://%s/store%s", target, APIPathReplicate)
+	req, err := http.NewRequest("POST", uri, ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/binary")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
 }
 
 func (c *Consumer) commit() stateFn {
@@ -302,7 +571,7 @@ func (c *Consumer) resetVia(commitOrFailed string) stateFn {
 				resp.Body.Close()
 				if resp.StatusCode != http.StatusOK {
 					c.reporter.ReportEvent(Event{
-						Op: commitOrFailed, Error: fmt.Errorf(resp.Status),
+						Op: commitOrFailed, Error: errors.New(resp.Status),
 						Msg: fmt.Sprintf("instance %s, during %s: bad status code", instance, "POST"),
 					})
 					return
@@ -315,8 +584,21 @@ func (c *Consumer) resetVia(commitOrFailed string) stateFn {
 	// Reset various pending things.
 	c.gatherErrors = 0
 	c.pending = map[string][]string{}
-	c.active.Reset()
+	if c.filesys.Exists(c.spoolPath) {
+		if err := c.filesys.Remove(c.spoolPath); err != nil {
+			c.reporter.ReportEvent(Event{
+				Op: commitOrFailed, Error: err,
+				Msg: fmt.Sprintf("spool %s, during %s", c.spoolPath, "Remove"),
+			})
+		}
+	}
+	c.activeSize = 0
+	c.parts = nil
 	c.activeSince = time.Time{}
+	c.replicated = map[string]bool{}
+	c.failed = map[string]bool{}
+	c.replicateAttempts = 0
+	c.replicateAfter = time.Time{}
 
 	// Back to the beginning.
 	return c.gather
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestConsumerReplicate(t *testing.T) {
+	t.Parallel()
+
+	const record = "01BB6RQR190Q1W0ZCGBPZQH8GR some record\n"
+
+	// Stores that take segments, count them, and fail or hang if told to.
+	// Unless they take parts of segments, they expect the one record.
+	type store struct {
+		addr   string
+		mtx    sync.Mutex
+		posts  int
+		bodies []string
+		fail   bool
+		hang   bool
+		parts  bool
+	}
+	newStore := func(fail, hang bool) *store {
+		var (
+			s       = &store{fail: fail, hang: hang}
+			release = make(chan struct{})
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.hang {
+				<-release // until the test is done
+				return
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			s.mtx.Lock()
+			if err != nil || (!s.parts && string(body) != record) {
+				t.Errorf("want %q posted, have %q (%v)", record, body, err)
+			}
+			s.posts++
+			s.bodies = append(s.bodies, string(body))
+			s.mtx.Unlock()
+			if s.fail {
+				http.Error(w, "failed", http.StatusInternalServerError)
+			}
+		}))
+		s.addr = strings.TrimPrefix(server.URL, "http://")
+		t.Cleanup(server.Close)
+		t.Cleanup(func() { close(release) }) // before Close
+		return s
+	}
+	posts := func(s *store) int {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return s.posts
+	}
+	filesys := fs.NewVirtualFilesystem()
+	newConsumer := func(stores ...*store) (*Consumer, *countingCounter, *countingCounter) {
+		var addrs []string
+		for _, s := range stores {
+			addrs = append(addrs, s.addr)
+		}
+		var (
+			replicated = &countingCounter{}
+			retries    = &countingCounter{}
+			c          = NewConsumer(
+				&repairPeer{"consumer", &addrs, 0}, http.DefaultClient,
+				filesys, "/consumer.spool",
+				1024, time.Second, 2, 100*time.Millisecond, nil,
+				nil, nil,
+				replicated, prometheus.NewCounter(prometheus.CounterOpts{}),
+				prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"result"}), retries,
+				&eventRecorder{},
+			)
+		)
+		spool, err := filesys.Create(c.spoolPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := spool.Write([]byte(record))
+		c.activeSize = int64(n)
+		return c, replicated, retries
+	}
+
+	// One store fails, and another hangs, but there are enough others.
+	ok1, ok2, failing, hanging := newStore(false, false), newStore(false, false), newStore(true, false), newStore(false, true)
+	c, replicated, retries := newConsumer(ok1, failing, hanging, ok2)
+	for i := 0; len(c.replicated) < 2 && i < maxReplicateAttempts; i++ {
+		c.replicateAfter = time.Time{} // don't wait
+		c.replicate()
+	}
+	if want, have := 1, posts(ok1); want != have {
+		t.Errorf("want %d post to the first store, have %d", want, have)
+	}
+	if want, have := 1, posts(ok2); want != have {
+		t.Errorf("want %d post to the second store, have %d", want, have)
+	}
+	if want, have := 1, replicated.n; want != have {
+		t.Errorf("want %d replicated segment, have %d", want, have)
+	}
+	if len(c.replicated) != 2 || !c.replicated[ok1.addr] || !c.replicated[ok2.addr] {
+		t.Errorf("want the segment replicated to %s and %s, have %v", ok1.addr, ok2.addr, c.replicated)
+	}
+	if have := retries.n; have >= maxReplicateAttempts {
+		t.Errorf("want fewer than %d retries, have %d", maxReplicateAttempts, have)
+	}
+	c.commit()
+	if filesys.Exists(c.spoolPath) {
+		t.Errorf("%s wasn't removed after the commit", c.spoolPath)
+	}
+
+	// With just one store that works, the missing replica is retried against
+	// the others, and the segment is committed after the last attempt.
+	ok, failing := newStore(false, false), newStore(true, false)
+	c, replicated, retries = newConsumer(ok, failing)
+	for i := 0; i < maxReplicateAttempts; i++ {
+		if want, have := i, retries.n; want != have {
+			t.Fatalf("attempt %d: want %d retries, have %d", i+1, want, have)
+		}
+		c.replicateAfter = time.Time{} // don't wait
+		c.replicate()
+	}
+	if want, have := 1, posts(ok); want != have {
+		t.Errorf("want %d post to the working store, have %d", want, have)
+	}
+	if want, have := maxReplicateAttempts, posts(failing); want != have {
+		t.Errorf("want %d posts to the failing store, have %d", want, have)
+	}
+	if want, have := 1, replicated.n; want != have {
+		t.Errorf("want %d replicated segment, have %d", want, have)
+	}
+	if want, have := maxReplicateAttempts-1, retries.n; want != have {
+		t.Errorf("want %d retries, have %d", want, have)
+	}
+
+	// Replicas are spread across zones, and the placement is recorded.
+	a1, a2, b1, b2 := newStore(false, false), newStore(false, false), newStore(false, false), newStore(false, false)
+	c, _, _ = newConsumer(a1, a2, b1, b2)
+	peer := &zonedPeer{
+		repairPeer: c.peer.(*repairPeer),
+		zones:      map[string]string{a1.addr: "a", a2.addr: "a", b1.addr: "b", b2.addr: "b"},
+	}
+	c.peer = peer
+	c.replicate()
+	if want, have := 1, posts(a1)+posts(a2); want != have {
+		t.Errorf("want %d post to zone a, have %d", want, have)
+	}
+	if want, have := 1, posts(b1)+posts(b2); want != have {
+		t.Errorf("want %d post to zone b, have %d", want, have)
+	}
+	if peer.placement == nil || !peer.placement.Spread || peer.placement.Zones != 2 {
+		t.Errorf("want a placement spread across 2 zones, have %+v", peer.placement)
+	}
+
+	// With a ring, the segment is split by bucket, and each part goes to the
+	// owners of its bucket, and only them.
+	var ringStores []*store
+	for i := 0; i < 6; i++ {
+		s := newStore(false, false)
+		s.parts = true
+		ringStores = append(ringStores, s)
+	}
+	c, replicated, _ = newConsumer(ringStores...)
+	c.ring = NewRing(time.Minute, 2)
+	c.peer.(*repairPeer).ring = time.Minute
+	var segment strings.Builder
+	for _, ms := range []uint64{1000, 30000, 61000, 125000, 126000} { // three buckets
+		fmt.Fprintf(&segment, "%s record\n", ulid.MustNew(ms, nil))
+	}
+	writeSpool(t, c, segment.String())
+	c.replicate()
+	if want, have := 1, replicated.n; want != have {
+		t.Errorf("want %d replicated segment, have %d", want, have)
+	}
+	copies := map[string]int{}
+	for _, s := range ringStores {
+		if posts(s) > 1 {
+			t.Errorf("%s: want at most 1 post, have %d", s.addr, posts(s))
+		}
+		for _, body := range s.bodies {
+			for _, line := range strings.SplitAfter(body, "\n") {
+				if line == "" {
+					continue
+				}
+				copies[line]++
+				id := ulid.MustParse(line[:ulid.EncodedSize])
+				if owners := c.ring.owners(c.peer.Current(cluster.PeerTypeStore), nil, c.ring.bucket(id.Time())); !contains(owners, s.addr) {
+					t.Errorf("%s: took %q, of a bucket owned by %v", s.addr, line, owners)
+				}
+			}
+		}
+	}
+	for _, line := range strings.SplitAfter(segment.String(), "\n") {
+		if want, have := 2, copies[line]; line != "" && want != have {
+			t.Errorf("%q: want %d copies, have %d", line, want, have)
+		}
+	}
+
+	// Until the stores agree on the ring, it's as if there were none.
+	for _, s := range ringStores {
+		s.mtx.Lock()
+		s.posts, s.bodies = 0, nil
+		s.mtx.Unlock()
+	}
+	c, replicated, _ = newConsumer(ringStores...)
+	c.ring = NewRing(time.Minute, 2)
+	c.peer.(*repairPeer).ring = time.Hour
+	writeSpool(t, c, segment.String())
+	c.replicate()
+	var whole int
+	for _, s := range ringStores {
+		for _, body := range s.bodies {
+			if body == segment.String() {
+				whole++
+			}
+		}
+	}
+	if want, have := 2, whole; want != have {
+		t.Errorf("without an agreed ring: want %d whole copies, have %d", want, have)
+	}
+	if want, have := 1, replicated.n; want != have {
+		t.Errorf("without an agreed ring: want %d replicated segment, have %d", want, have)
+	}
+
+	// With a ring, the segment is never committed without replicas, even if
+	// the segment has no owners, nor before it has enough of them.
+	c, replicated, retries = newConsumer()
+	c.ring = NewRing(time.Minute, 2)
+	for i := 0; i < maxReplicateAttempts; i++ {
+		c.replicateAfter = time.Time{} // don't wait
+		c.replicate()
+	}
+	if want, have := 0, replicated.n; want != have {
+		t.Errorf("without owners: want %d replicated segments, have %d", want, have)
+	}
+	if want, have := maxReplicateAttempts-1, retries.n; want != have {
+		t.Errorf("without owners: want %d retries, have %d", want, have)
+	}
+	lonely := newStore(false, false)
+	c, replicated, retries = newConsumer(lonely)
+	c.ring = NewRing(time.Minute, 2)
+	c.replicate()
+	if want, have := 1, posts(lonely); want != have {
+		t.Errorf("want %d post to the only owner, have %d", want, have)
+	}
+	if want, have := 0, replicated.n; want != have {
+		t.Errorf("with one owner: want %d replicated segments, have %d", want, have)
+	}
+	if want, have := 1, retries.n; want != have {
+		t.Errorf("with one owner: want %d retry, have %d", want, have)
+	}
+
+	// Attempts back off.
+	c, _, _ = newConsumer(newStore(true, false))
+	c.replicate()
+	c.replicate()
+	if want, have := 1, c.replicateAttempts; want != have {
+		t.Errorf("want %d attempt while backing off, have %d", want, have)
+	}
+}
+
+// writeSpool replaces the consumer's active segment.
+func writeSpool(t *testing.T, c *Consumer, segment string) {
+	t.Helper()
+	f, err := c.filesys.Create(c.spoolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := f.Write([]byte(segment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.activeSize = int64(n)
+}
+
+// zonedPeer has stores in zones, and records the placement of replicas.
+type zonedPeer struct {
+	*repairPeer
+	zones     map[string]string
+	placement *cluster.Placement
+}
+
+func (p *zonedPeer) Zones(cluster.PeerType) map[string]string { return p.zones }
+func (p *zonedPeer) SetPlacement(placement cluster.Placement) { p.placement = &placement }
+
+func TestConsumerMergeSpool(t *testing.T) {
+	t.Parallel()
+
+	var (
+		filesys = fs.NewVirtualFilesystem()
+		c       = &Consumer{filesys: filesys, spoolPath: "/consumer.spool"}
+	)
+
+	// Segments from ingesters overlap in time, but the spool stays sorted.
+	for _, segment := range []string{
+		"01BB6RQR190Q1W0ZCGBPZQH8GR a\n01BB6RQR1E0Q1W0ZCGBPZQH8GR c\n",
+		"01BB6RQR1B0Q1W0ZCGBPZQH8GR b\n01BB6RQR1H0Q1W0ZCGBPZQH8GR d\n",
+	} {
+		low, high, n, err := c.mergeSpool(strings.NewReader(segment))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.activeSize = n
+		if want, have := "01BB6RQR190Q1W0ZCGBPZQH8GR", low.String(); want != have {
+			t.Errorf("low: want %s, have %s", want, have)
+		}
+		if want, have := segment[len(segment)-29:len(segment)-3], high.String(); want != have {
+			t.Errorf("high: want %s, have %s", want, have)
+		}
+	}
+	f, err := filesys.Open(c.spoolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "01BB6RQR190Q1W0ZCGBPZQH8GR a\n01BB6RQR1B0Q1W0ZCGBPZQH8GR b\n01BB6RQR1E0Q1W0ZCGBPZQH8GR c\n01BB6RQR1H0Q1W0ZCGBPZQH8GR d\n"
+	if have := string(buf); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if want, have := int64(len(want)), c.activeSize; want != have {
+		t.Errorf("want %d bytes, have %d", want, have)
+	}
+	if filesys.Exists(c.spoolPath + ".next") {
+		t.Errorf("%s.next wasn't renamed", c.spoolPath)
+	}
+}
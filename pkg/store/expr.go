@@ -0,0 +1,322 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// QueryLangExpr selects boolean expressions as the query language.
+//
+// An expression is made of terms, combined with AND, OR, and NOT, and grouped
+// with parentheses. Adjacent terms are implicitly ANDed, and NOT binds tighter
+// than AND, which binds tighter than OR. Bare terms match case-insensitively.
+// Quoted phrases, which may contain spaces and keywords, match exactly; escape
+// quotes and backslashes within them with a backslash. Keywords must be
+// uppercase; "and" is a term. The empty expression matches every record.
+//
+//	error OR warn
+//	(timeout OR refused) AND NOT "level=debug"
+//	"connection reset" user=alice
+const QueryLangExpr = "expr"
+
+// compileExpr parses the expression, and returns a filter that passes
+// records whose text, after the ULID, matches it.
+func compileExpr(q string) (recordFilter, error) {
+	p := &exprParser{lexer: exprLexer{input: q}}
+	p.advance()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind == exprEOF {
+		return func(b []byte) bool { return len(b) > ulid.EncodedSize }, nil
+	}
+	node, err := p.parseOr()
+	if err == nil {
+		err = p.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != exprEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return func(b []byte) bool {
+		if len(b) <= ulid.EncodedSize {
+			return false
+		}
+		return node.match(&exprRecord{text: b[ulid.EncodedSize+1:]})
+	}, nil
+}
+
+// exprRecord is the record being matched. Its lowercase form is computed
+// once, the first time a case-insensitive term needs it.
+type exprRecord struct {
+	text  []byte
+	lower []byte
+}
+
+func (r *exprRecord) folded() []byte {
+	if r.lower == nil {
+		r.lower = bytes.ToLower(r.text)
+	}
+	return r.lower
+}
+
+type exprNode interface {
+	match(r *exprRecord) bool
+}
+
+type exprOr []exprNode
+
+func (e exprOr) match(r *exprRecord) bool {
+	for _, n := range e {
+		if n.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+type exprAnd []exprNode
+
+func (e exprAnd) match(r *exprRecord) bool {
+	for _, n := range e {
+		if !n.match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type exprNot struct{ exprNode }
+
+func (e exprNot) match(r *exprRecord) bool {
+	return !e.exprNode.match(r)
+}
+
+// exprTerm matches a substring. If fold is set, s is already lowercase.
+type exprTerm struct {
+	s    []byte
+	fold bool
+}
+
+func (e exprTerm) match(r *exprRecord) bool {
+	if e.fold {
+		return bytes.Contains(r.folded(), e.s)
+	}
+	return bytes.Contains(r.text, e.s)
+}
+
+// exprParser is a recursive descent parser, one token of lookahead.
+//
+//	or   = and { "OR" and }
+//	and  = not { [ "AND" ] not }
+//	not  = "NOT" not | atom
+//	atom = "(" or ")" | term | phrase
+type exprParser struct {
+	lexer exprLexer
+	tok   exprToken
+	err   error // from the lexer
+}
+
+func (p *exprParser) advance() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lexer.next()
+	if p.err != nil {
+		p.tok = exprToken{kind: exprEOF, pos: p.tok.pos}
+	}
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return errors.Errorf("query expression: at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := exprOr{first}
+	for p.tok.kind == exprOpOr {
+		p.advance()
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	return nodes, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	nodes := exprAnd{first}
+	for {
+		switch p.tok.kind {
+		case exprOpAnd:
+			p.advance()
+		case exprOpNot, exprLParen, exprWord, exprPhrase:
+			// implicit AND
+		default:
+			if len(nodes) == 1 {
+				return first, nil
+			}
+			return nodes, nil
+		}
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.tok.kind == exprOpNot {
+		p.advance()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{n}, nil
+	}
+	return p.parseAtom()
+}
+
+func (p *exprParser) parseAtom() (exprNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case exprLParen:
+		p.advance()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.err != nil {
+			return nil, p.err
+		}
+		if p.tok.kind != exprRParen {
+			return nil, p.errorf("expected ), found %s", p.tok)
+		}
+		p.advance()
+		return n, nil
+	case exprWord:
+		p.advance()
+		return exprTerm{s: []byte(strings.ToLower(tok.text)), fold: true}, nil
+	case exprPhrase:
+		p.advance()
+		return exprTerm{s: []byte(tok.text)}, nil
+	default:
+		return nil, p.errorf("expected a term, found %s", tok)
+	}
+}
+
+type exprTokenKind int
+
+const (
+	exprEOF exprTokenKind = iota
+	exprLParen
+	exprRParen
+	exprWord
+	exprPhrase
+	exprOpAnd
+	exprOpOr
+	exprOpNot
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	switch t.kind {
+	case exprEOF:
+		return "end of expression"
+	case exprPhrase:
+		return fmt.Sprintf("phrase %q", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+type exprLexer struct {
+	input string
+	pos   int
+}
+
+func (l *exprLexer) next() (exprToken, error) {
+	for l.pos < len(l.input) {
+		r, n := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += n
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return exprToken{kind: exprEOF, pos: start}, nil
+	}
+
+	switch c := l.input[l.pos]; c {
+	case '(':
+		l.pos++
+		return exprToken{kind: exprLParen, text: "(", pos: start}, nil
+	case ')':
+		l.pos++
+		return exprToken{kind: exprRParen, text: ")", pos: start}, nil
+	case '"':
+		l.pos++
+		var buf []byte
+		for l.pos < len(l.input) {
+			c := l.input[l.pos]
+			l.pos++
+			switch {
+			case c == '"':
+				return exprToken{kind: exprPhrase, text: string(buf), pos: start}, nil
+			case c == '\\' && l.pos < len(l.input):
+				buf = append(buf, l.input[l.pos])
+				l.pos++
+			default:
+				buf = append(buf, c)
+			}
+		}
+		return exprToken{pos: start}, errors.Errorf("query expression: at offset %d: unterminated phrase", start)
+	}
+
+	for l.pos < len(l.input) {
+		r, n := utf8.DecodeRuneInString(l.input[l.pos:])
+		if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' {
+			break
+		}
+		l.pos += n
+	}
+	word := l.input[start:l.pos]
+	switch word {
+	case "AND":
+		return exprToken{kind: exprOpAnd, text: word, pos: start}, nil
+	case "OR":
+		return exprToken{kind: exprOpOr, text: word, pos: start}, nil
+	case "NOT":
+		return exprToken{kind: exprOpNot, text: word, pos: start}, nil
+	}
+	return exprToken{kind: exprWord, text: word, pos: start}, nil
+}
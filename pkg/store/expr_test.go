@@ -0,0 +1,115 @@
+package store
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCompileExpr(t *testing.T) {
+	t.Parallel()
+
+	const id = "01BB6RQR190000000000000000 "
+	for _, testcase := range []struct {
+		q     string
+		match []string
+		miss  []string
+	}{
+		{``, []string{"anything", ""}, nil},
+		{`foo`, []string{"foo", "a foo b", "FOO", "Foobar"}, []string{"bar", "fo o"}},
+		{`FOO`, []string{"foo", "fOo"}, []string{"bar"}},
+		{`foo bar`, []string{"foo bar", "bar foo", "foobar"}, []string{"foo", "bar"}},
+		{`foo AND bar`, []string{"foo bar", "BAR FOO"}, []string{"foo", "bar"}},
+		{`foo OR bar`, []string{"foo", "bar", "foo bar"}, []string{"baz"}},
+		{`NOT foo`, []string{"bar", ""}, []string{"foo", "FOO"}},
+		{`NOT NOT foo`, []string{"foo"}, []string{"bar"}},
+		{`foo OR bar AND baz`, []string{"foo", "bar baz"}, []string{"bar", "baz"}},
+		{`(foo OR bar) AND baz`, []string{"foo baz", "bar baz"}, []string{"foo", "bar", "baz"}},
+		{`foo AND NOT bar`, []string{"foo"}, []string{"foo bar", "bar"}},
+		{`NOT foo OR bar`, []string{"baz", "foo bar", "bar"}, []string{"foo"}},
+		{`NOT (foo OR bar)`, []string{"baz"}, []string{"foo", "bar"}},
+		{`((foo))`, []string{"foo"}, []string{"bar"}},
+		{`"Foo Bar"`, []string{"a Foo Bar b"}, []string{"foo bar", "Foo  Bar", "Foo"}},
+		{`"AND"`, []string{"AND"}, []string{"and"}},
+		{`"say \"hi\""`, []string{`they say "hi"`}, []string{"say hi"}},
+		{`"back\\slash"`, []string{`back\slash`}, []string{"backslash"}},
+		{`and`, []string{"AND", "android"}, []string{"or"}},
+		{`foo"bar"`, []string{"FOO bar"}, []string{"foo BAR"}},
+		{`level=error (timeout OR "connection refused")`, []string{"level=ERROR msg=timeout", "level=error connection refused"}, []string{"level=error Connection Refused", "level=warn timeout"}},
+		{`héllo`, []string{"HÉLLO"}, []string{"hello"}},
+	} {
+		pass, err := compileExpr(testcase.q)
+		if err != nil {
+			t.Errorf("%s: %v", testcase.q, err)
+			continue
+		}
+		for _, record := range testcase.match {
+			if !pass([]byte(id + record)) {
+				t.Errorf("%s: should match %q", testcase.q, record)
+			}
+		}
+		for _, record := range testcase.miss {
+			if pass([]byte(id + record)) {
+				t.Errorf("%s: shouldn't match %q", testcase.q, record)
+			}
+		}
+		if pass([]byte("short")) {
+			t.Errorf("%s: shouldn't match a record without a ULID", testcase.q)
+		}
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	t.Parallel()
+
+	for q, want := range map[string]string{
+		`(`:           "at offset 1: expected a term, found end of expression",
+		`(foo`:        "at offset 4: expected ), found end of expression",
+		`foo)`:        `at offset 3: unexpected ")"`,
+		`)`:           `at offset 0: expected a term, found ")"`,
+		`AND`:         `at offset 0: expected a term, found "AND"`,
+		`foo AND`:     "at offset 7: expected a term, found end of expression",
+		`foo OR OR`:   `at offset 7: expected a term, found "OR"`,
+		`NOT`:         "at offset 3: expected a term, found end of expression",
+		`()`:          `at offset 1: expected a term, found ")"`,
+		`"foo`:        "at offset 0: unterminated phrase",
+		`foo "bar`:    "at offset 4: unterminated phrase",
+		`(foo "bar)`:  "at offset 5: unterminated phrase",
+		`foo AND (OR`: `at offset 9: expected a term, found "OR"`,
+	} {
+		_, err := compileExpr(q)
+		if err == nil {
+			t.Errorf("%s: want error, have none", q)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want %q, have %q", q, want, err.Error())
+		}
+	}
+}
+
+func TestQueryParamsLang(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		query string
+		valid bool
+	}{
+		{"q=foo", true},
+		{"q=foo+OR+bar&lang=expr", true},
+		{"q=(foo&lang=expr", false},
+		{"q=foo&lang=expr&regex=true", false},
+		{"q=foo&lang=sql", false},
+	} {
+		u, _ := url.Parse("/query?" + testcase.query)
+		var qp QueryParams
+		err := qp.DecodeFrom(u, rangeNotRequired)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s: want valid=%v, have error %v", testcase.query, want, err)
+			continue
+		}
+		if err == nil && !qp.recordFilter()([]byte("01BB6RQR190000000000000000 foo")) {
+			t.Errorf("%s: should match", testcase.query)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// Records are opaque, but they're often logfmt or JSON. Field predicates and
+// projections parse them on the fly, at query time.
+
+const (
+	fieldFormatLogfmt = "logfmt"
+	fieldFormatJSON   = "json"
+)
+
+// fieldOps in the order they're tried at each position of a predicate, so
+// that two-character operators win.
+var fieldOps = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+// fieldPredicate compares a field of each record to a value, e.g. level=error
+// or json:status>=500. Fields are logfmt keys, unless the predicate starts
+// with "json:", in which case they're JSON object keys, and may be dotted
+// paths into nested objects. Values that parse as numbers on both sides are
+// compared as numbers; otherwise, only = and != apply, comparing strings.
+// Records without the field fail the predicate.
+type fieldPredicate struct {
+	format string
+	key    string
+	op     string
+	value  string
+	num    float64
+	isNum  bool
+}
+
+func parseFieldPredicate(s string) (fieldPredicate, error) {
+	p := fieldPredicate{format: fieldFormatLogfmt}
+	switch {
+	case strings.HasPrefix(s, fieldFormatJSON+":"):
+		p.format, s = fieldFormatJSON, s[len(fieldFormatJSON)+1:]
+	case strings.HasPrefix(s, fieldFormatLogfmt+":"):
+		s = s[len(fieldFormatLogfmt)+1:]
+	}
+	for i := 0; i < len(s) && p.op == ""; i++ {
+		for _, op := range fieldOps {
+			if strings.HasPrefix(s[i:], op) {
+				p.key, p.op, p.value = s[:i], op, s[i+len(op):]
+				break
+			}
+		}
+	}
+	if p.op == "" {
+		return p, errors.Errorf("%q: no comparison operator", s)
+	}
+	if p.key == "" {
+		return p, errors.Errorf("%q: no field", s)
+	}
+	if n, err := strconv.ParseFloat(p.value, 64); err == nil {
+		p.num, p.isNum = n, true
+	}
+	if !p.isNum && p.op != "=" && p.op != "!=" {
+		return p, errors.Errorf("%q: %s needs a number", s, p.op)
+	}
+	return p, nil
+}
+
+func (p fieldPredicate) match(f *recordFields) bool {
+	value, ok := f.get(p.format, p.key)
+	if !ok {
+		return false
+	}
+	if p.isNum {
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			switch p.op {
+			case "=":
+				return n == p.num
+			case "!=":
+				return n != p.num
+			case ">":
+				return n > p.num
+			case ">=":
+				return n >= p.num
+			case "<":
+				return n < p.num
+			case "<=":
+				return n <= p.num
+			}
+		}
+	}
+	switch p.op {
+	case "=":
+		return value == p.value
+	case "!=":
+		return value != p.value
+	}
+	return false
+}
+
+// recordFilterFields passes records matching all of the predicates.
+func recordFilterFields(preds []fieldPredicate) recordFilter {
+	return func(b []byte) bool {
+		if len(b) <= ulid.EncodedSize {
+			return false
+		}
+		f := &recordFields{text: b[ulid.EncodedSize+1:]}
+		for _, p := range preds {
+			if !p.match(f) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// recordFilterAll passes records passing every filter.
+func recordFilterAll(filters ...recordFilter) recordFilter {
+	return func(b []byte) bool {
+		for _, pass := range filters {
+			if !pass(b) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// recordFields parses a record's text, at most once per format.
+type recordFields struct {
+	text   []byte
+	logfmt map[string]string
+	json   map[string]interface{}
+	parsed map[string]bool
+}
+
+func (f *recordFields) get(format, key string) (string, bool) {
+	if f.parsed == nil {
+		f.parsed = map[string]bool{}
+	}
+	if !f.parsed[format] {
+		f.parsed[format] = true
+		switch format {
+		case fieldFormatLogfmt:
+			f.logfmt = parseLogfmt(f.text)
+		case fieldFormatJSON:
+			json.Unmarshal(f.text, &f.json) // on error, there are no fields
+		}
+	}
+	switch format {
+	case fieldFormatLogfmt:
+		value, ok := f.logfmt[key]
+		return value, ok
+	case fieldFormatJSON:
+		return jsonField(f.json, key)
+	}
+	return "", false
+}
+
+// parseLogfmt returns the first value of each key in the first line of text.
+// If the text isn't logfmt, we keep what we could decode before the error.
+func parseLogfmt(text []byte) map[string]string {
+	m := map[string]string{}
+	d := logfmt.NewDecoder(bytes.NewReader(text))
+	if !d.ScanRecord() {
+		return m
+	}
+	for d.ScanKeyval() {
+		if _, ok := m[string(d.Key())]; !ok {
+			m[string(d.Key())] = string(d.Value())
+		}
+	}
+	return m
+}
+
+// jsonField follows the dotted path into the object, and formats the value
+// it finds as a string.
+func jsonField(obj map[string]interface{}, path string) (string, bool) {
+	var v interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case nil:
+		return "null", true
+	default:
+		buf, err := json.Marshal(v)
+		return string(buf), err == nil
+	}
+}
+
+// parseFields splits the fields= query params, which may each be a comma
+// separated list, into field names.
+func parseFields(params []string) (fields []string) {
+	for _, param := range params {
+		for _, field := range strings.Split(param, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// newProjectingReadCloser yields each record from src with only the selected
+// fields, in the order they're given, after the ULID. JSON objects stay JSON
+// objects, with the selected top-level keys; anything else is treated as
+// logfmt. Records without any of the fields are still yielded, without them.
+func newProjectingReadCloser(src io.ReadCloser, fields []string) io.ReadCloser {
+	s := bufio.NewScanner(src)
+	s.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	s.Split(scanLinesPreserveNewline)
+	return &projectingReadCloser{src: src, s: s, fields: fields}
+}
+
+// maxRecordSize is the longest record we'll project.
+const maxRecordSize = 1024 * 1024
+
+type projectingReadCloser struct {
+	src    io.ReadCloser
+	s      *bufio.Scanner
+	fields []string
+	buf    bytes.Buffer
+	err    error
+}
+
+func (p *projectingReadCloser) Read(b []byte) (int, error) {
+	for p.buf.Len() <= 0 && p.err == nil {
+		if !p.s.Scan() {
+			p.err = p.s.Err()
+			if p.err == nil {
+				p.err = io.EOF
+			}
+			break
+		}
+		p.project(p.s.Bytes())
+	}
+	if p.buf.Len() > 0 {
+		return p.buf.Read(b)
+	}
+	return 0, p.err
+}
+
+func (p *projectingReadCloser) Close() error {
+	return p.src.Close()
+}
+
+func (p *projectingReadCloser) project(line []byte) {
+	if len(line) <= ulid.EncodedSize {
+		p.buf.Write(line) // not a record; pass it along
+		return
+	}
+	p.buf.Write(line[:ulid.EncodedSize+1])
+	text := bytes.TrimRight(line[ulid.EncodedSize+1:], "\n")
+	if trimmed := bytes.TrimSpace(text); len(trimmed) > 0 && trimmed[0] == '{' {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &obj); err == nil {
+			p.projectJSON(obj)
+			p.buf.WriteByte('\n')
+			return
+		}
+	}
+	p.projectLogfmt(parseLogfmt(text))
+	p.buf.WriteByte('\n')
+}
+
+func (p *projectingReadCloser) projectJSON(obj map[string]json.RawMessage) {
+	p.buf.WriteByte('{')
+	var n int
+	for _, field := range p.fields {
+		value, ok := obj[field]
+		if !ok {
+			continue
+		}
+		if n > 0 {
+			p.buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field)
+		p.buf.Write(key)
+		p.buf.WriteByte(':')
+		json.Compact(&p.buf, value)
+		n++
+	}
+	p.buf.WriteByte('}')
+}
+
+func (p *projectingReadCloser) projectLogfmt(m map[string]string) {
+	e := logfmt.NewEncoder(&p.buf)
+	for _, field := range p.fields {
+		if value, ok := m[field]; ok {
+			e.EncodeKeyval(field, value)
+		}
+	}
+}
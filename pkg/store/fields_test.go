@@ -0,0 +1,209 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestParseFieldPredicate(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		input string
+		want  fieldPredicate
+		err   bool
+	}{
+		{"level=error", fieldPredicate{format: "logfmt", key: "level", op: "=", value: "error"}, false},
+		{"logfmt:level!=debug", fieldPredicate{format: "logfmt", key: "level", op: "!=", value: "debug"}, false},
+		{"json:status>=500", fieldPredicate{format: "json", key: "status", op: ">=", value: "500", num: 500, isNum: true}, false},
+		{"json:http.latency<0.5", fieldPredicate{format: "json", key: "http.latency", op: "<", value: "0.5", num: 0.5, isNum: true}, false},
+		{"msg=a=b", fieldPredicate{format: "logfmt", key: "msg", op: "=", value: "a=b"}, false},
+		{"msg=", fieldPredicate{format: "logfmt", key: "msg", op: "=", value: ""}, false},
+		{"level", fieldPredicate{}, true},
+		{"=error", fieldPredicate{}, true},
+		{"json:>5", fieldPredicate{}, true},
+		{"level>error", fieldPredicate{}, true},
+	} {
+		have, err := parseFieldPredicate(testcase.input)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: want error, have none", testcase.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", testcase.input, err)
+			continue
+		}
+		if want := testcase.want; want != have {
+			t.Errorf("%s: want %+v, have %+v", testcase.input, want, have)
+		}
+	}
+}
+
+func TestRecordFilterFields(t *testing.T) {
+	t.Parallel()
+
+	const id = "01BB6RQR190000000000000000 "
+	for _, testcase := range []struct {
+		where []string
+		match []string
+		miss  []string
+	}{
+		{
+			[]string{"level=error"},
+			[]string{"level=error msg=x", `ts=1 level=error msg="a b"` + "\n"},
+			[]string{"level=warn", "msg=level=error", "level=errors", `{"level":"error"}`},
+		},
+		{
+			[]string{`msg=a b`},
+			[]string{`msg="a b"`},
+			[]string{"msg=a b"},
+		},
+		{
+			[]string{"status>=500", "status<600"},
+			[]string{"status=500", "status=599.5"},
+			[]string{"status=499", "status=600", "status=oops", "code=500"},
+		},
+		{
+			[]string{"status=500"},
+			[]string{"status=500", "status=500.0"},
+			[]string{"status=5000"},
+		},
+		{
+			[]string{"level!=debug"},
+			[]string{"level=info"},
+			[]string{"level=debug", "msg=no-level"},
+		},
+		{
+			[]string{"json:status>=500"},
+			[]string{`{"status":503}`, `{"status":"500"}` + "\n"},
+			[]string{`{"status":200}`, "status=503", `{"status":`, `{"code":503}`},
+		},
+		{
+			[]string{"json:http.method=GET", "json:ok=true"},
+			[]string{`{"http":{"method":"GET"},"ok":true}`},
+			[]string{`{"http":{"method":"POST"},"ok":true}`, `{"http":"GET","ok":true}`, `{"http":{"method":"GET"},"ok":false}`},
+		},
+		{
+			[]string{"json:user=null"},
+			[]string{`{"user":null}`},
+			[]string{`{}`},
+		},
+		{
+			[]string{"level=error", "json:status=500"},
+			nil, // a record isn't both
+			[]string{"level=error", `{"status":500}`},
+		},
+	} {
+		preds := make([]fieldPredicate, len(testcase.where))
+		for i, s := range testcase.where {
+			p, err := parseFieldPredicate(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			preds[i] = p
+		}
+		pass := recordFilterFields(preds)
+		for _, record := range testcase.match {
+			if !pass([]byte(id + record)) {
+				t.Errorf("%v: should match %q", testcase.where, record)
+			}
+		}
+		for _, record := range testcase.miss {
+			if pass([]byte(id + record)) {
+				t.Errorf("%v: shouldn't match %q", testcase.where, record)
+			}
+		}
+	}
+}
+
+func TestProjectingReadCloser(t *testing.T) {
+	t.Parallel()
+
+	const id = "01BB6RQR190000000000000000 "
+	var (
+		input = strings.Join([]string{
+			id + `ts=1 level=error msg="a b" user=x`,
+			id + `{"msg":"hi", "level":"info","nested":{"a": 1}}`,
+			id + `nothing here`,
+			id + `{not json} level=warn`,
+			"",
+		}, "\n")
+		want = strings.Join([]string{
+			id + `msg="a b" level=error`,
+			id + `{"msg":"hi","level":"info"}`,
+			id,
+			id + `level=warn`,
+			"",
+		}, "\n")
+		rc = newProjectingReadCloser(ioutil.NopCloser(strings.NewReader(input)), parseFields([]string{"msg, level", "missing"}))
+	)
+	have, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != string(have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryFields(t *testing.T) {
+	t.Parallel()
+
+	filelog, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	// Write a segment of logfmt records.
+	var (
+		t0      = time.Now().Add(-time.Minute)
+		entropy = rand.New(rand.NewSource(11))
+		ids     []ulid.ULID
+	)
+	segment, err := filelog.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, level := range []string{"info", "error", "warn", "error"} {
+		id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*time.Second)), entropy)
+		ids = append(ids, id)
+		fmt.Fprintf(segment, "%s level=%s n=%d\n", id, level, i)
+	}
+	if err := segment.Close(ids[0], ids[len(ids)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Query for errors, and project one field.
+	u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&where=level%%3Derror&fields=n", ids[0], ids[len(ids)-1]))
+	var qp QueryParams
+	if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+		t.Fatal(err)
+	}
+	result, err := filelog.Query(qp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadAll(result.Records)
+	result.Records.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%s n=1\n%s n=3\n", ids[1], ids[3]); want != string(have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+}
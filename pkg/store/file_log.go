@@ -3,6 +3,8 @@ package store
 import (
 	"bytes"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -65,9 +67,10 @@ func NewFileLog(filesys fs.Filesystem, root string, segmentTargetSize, segmentBu
 		// So this is like Prometheus "crash recovery" mode.
 		// But we don't have anything special we need to do.
 	}
-	if err := recoverSegments(filesys, root); err != nil {
+	if err := recoverSegments(filesys, root, reporter); err != nil {
 		return nil, errors.Wrap(err, "during recovery")
 	}
+	recoverSidecars(filesys, root, reporter)
 	return &fileLog{
 		root:              root,
 		filesys:           filesys,
@@ -84,31 +87,100 @@ func (fl *fileLog) Create() (WriteSegment, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &fileWriteSegment{fl.filesys, f}, nil
+	sum := newChecksum()
+	return &fileWriteSegment{fl.filesys, f, io.MultiWriter(f, sum), nil, sum, fl.reporter}, nil
+}
+
+func (fl *fileLog) CreateCompressed() (WriteSegment, error) {
+	filename := filepath.Join(fl.root, fmt.Sprintf("%s%s%s", uuid.New(), extCompressed, extActive))
+	f, err := fl.filesys.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	sum := newChecksum()
+	bw, err := newBlockWriter(io.MultiWriter(f, sum))
+	if err != nil {
+		f.Close()
+		fl.filesys.Remove(filename)
+		return nil, err
+	}
+	return &fileWriteSegment{fl.filesys, f, bw, bw, sum, fl.reporter}, nil
 }
 
 func (fl *fileLog) Query(qp QueryParams, statsOnly bool) (QueryResult, error) {
+	begin := time.Now()
+
+	// Time range should be inclusive, so we need a max value here.
+	if err := qp.To.ULID.SetEntropy(ulidMaxEntropy); err != nil {
+		panic(err)
+	}
+
+	// Cursors narrow the range, so we skip the segments already paged past.
+	from, to := qp.From.ULID, qp.To.ULID
+	if qp.After.Compare(from) > 0 {
+		from = qp.After
+	}
+	if qp.Before != (ulid.ULID{}) && qp.Before.Compare(to) < 0 {
+		to = qp.Before
+	}
+
 	var (
-		begin    = time.Now()
-		segments = fl.queryMatchingSegments(qp.From.ULID, qp.To.ULID)
+		segments = fl.queryMatchingSegments(from, to)
+		skipped  int
 		pass     = recordFilterBoundedPlain(qp.From.ULID, qp.To.ULID, []byte(qp.Q))
 	)
-	if qp.Regex {
+	if qp.Lang != QueryLangExpr && !qp.Regex {
+		segments, skipped = fl.skipSegments(segments, []byte(qp.Q))
+	}
+	fl.seekSegments(segments, from, to)
+	fl.verifySegments(segments, qp.desc())
+	for i, segment := range segments {
+		if isCompressed(segment.path) {
+			segments[i].file = newBlockReadCloser(segment.file)
+		}
+	}
+	switch {
+	case qp.Lang == QueryLangExpr || len(qp.Where) > 0:
+		pass = recordFilterBounded(qp.From.ULID, qp.To.ULID, qp.recordFilter())
+	case qp.Regex:
 		pass = recordFilterBoundedRegex(qp.From.ULID, qp.To.ULID, regexp.MustCompile(qp.Q))
 	}
-
-	// Time range should be inclusive, so we need a max value here.
-	if err := qp.To.ULID.SetEntropy(ulidMaxEntropy); err != nil {
-		panic(err)
+	if qp.After != (ulid.ULID{}) || qp.Before != (ulid.ULID{}) {
+		pass = recordFilterAll(pass, recordFilterCursor(qp.After, qp.Before))
 	}
 
-	// Build the lazy reader.
-	rc, sz, err := newQueryReadCloser(fl.filesys, segments, pass, fl.segmentBufferSize, fl.reporter)
-	if err != nil {
+	// Build the lazy reader. Newest first, we read segments backwards.
+	var (
+		rc  io.ReadCloser
+		sz  int64
+		err error
+	)
+	if qp.desc() {
+		rc, sz = newReverseQueryReadCloser(segments, pass, fl.reporter)
+	} else if rc, sz, err = newQueryReadCloser(fl.filesys, segments, pass, fl.segmentBufferSize, fl.reporter); err != nil {
 		return QueryResult{}, errors.Wrap(err, "constructing the lazy reader")
 	}
-	if statsOnly {
+
+	// Stop reading once we have enough records.
+	if qp.Limit > 0 {
+		if rc, err = newLimitedMergeReadCloser([]io.ReadCloser{rc}, qp.desc(), qp.Limit); err != nil {
+			return QueryResult{}, errors.Wrap(err, "constructing the limited reader")
+		}
+	}
+
+	var agg *Aggregate
+	switch {
+	case statsOnly:
+		rc = ioutil.NopCloser(bytes.NewReader(nil))
+	case qp.Agg != "":
+		agg, err = aggregate(rc, qp)
+		rc.Close()
+		if err != nil {
+			return QueryResult{}, err
+		}
 		rc = ioutil.NopCloser(bytes.NewReader(nil))
+	case len(qp.Fields) > 0:
+		rc = newProjectingReadCloser(rc, qp.Fields)
 	}
 
 	return QueryResult{
@@ -116,11 +188,13 @@ func (fl *fileLog) Query(qp QueryParams, statsOnly bool) (QueryResult, error) {
 
 		NodesQueried:    1,
 		SegmentsQueried: len(segments),
+		SegmentsSkipped: skipped,
 		MaxDataSetSize:  sz,
 		ErrorCount:      0,
 		Duration:        time.Since(begin).String(),
 
-		Records: rc,
+		Records:   rc,
+		Aggregate: agg,
 	}, nil
 }
 
@@ -140,17 +214,8 @@ func (fl *fileLog) Overlapping() ([]ReadSegment, error) {
 			return nil // skip
 		}
 		if _, _, err := parseFilename(path); err != nil {
-			fl.reporter.ReportEvent(Event{
-				Op: "Overlapping", File: path, Warning: err,
-				Msg: fmt.Sprintf("will remove apparently-bad data file of size %d", info.Size()),
-			})
 			// TODO(pb): re-parse and recover this file, async
-			if err := fl.filesys.Remove(path); err != nil {
-				fl.reporter.ReportEvent(Event{
-					Op: "Overlapping", File: path, Warning: err,
-					Msg: "tried to remove apparently-bad data file, which failed",
-				})
-			}
+			fl.quarantine("Overlapping", path, err)
 			return nil // weird; ignore
 		}
 		segments[path] = nil
@@ -222,20 +287,23 @@ func (fl *fileLog) Sequential() ([]ReadSegment, error) {
 		}
 		a, _, err := parseFilename(path)
 		if err != nil {
-			fl.reporter.ReportEvent(Event{
-				Op: "Sequential", File: path, Warning: err,
-				Msg: fmt.Sprintf("will remove apparently-bad data file of size %d", info.Size()),
-			})
 			// TODO(pb): re-parse and recover this file, async
-			if err := fl.filesys.Remove(path); err != nil {
+			fl.quarantine("Sequential", path, err)
+			return nil // weird; skip
+		}
+		size := info.Size()
+		if isCompressed(path) {
+			// Compaction writes records up to the target size, whatever
+			// their size on disk, so that's the size we go by.
+			if size, err = compressedRawSize(fl.filesys, path); err != nil {
 				fl.reporter.ReportEvent(Event{
 					Op: "Sequential", File: path, Warning: err,
-					Msg: "tried to remove apparently-bad data file, which failed",
+					Msg: "can't tell the size of the records in the segment; leaving it be",
 				})
+				return nil // skip
 			}
-			return nil // weird; skip
 		}
-		segmentInfos = append(segmentInfos, segmentInfo{a.String(), path, info.Size()})
+		segmentInfos = append(segmentInfos, segmentInfo{a.String(), path, size})
 		return nil
 	})
 	sort.Slice(segmentInfos, func(i, j int) bool { return segmentInfos[i].lowID < segmentInfos[j].lowID })
@@ -278,17 +346,8 @@ func (fl *fileLog) Trashable(oldestRecord time.Time) ([]ReadSegment, error) {
 		}
 		_, high, err := parseFilename(path)
 		if err != nil {
-			fl.reporter.ReportEvent(Event{
-				Op: "Trashable", File: path, Warning: err,
-				Msg: fmt.Sprintf("will remove apparently-bad data file of size %d", info.Size()),
-			})
 			// TODO(pb): re-parse and recover this file, async
-			if err := fl.filesys.Remove(path); err != nil {
-				fl.reporter.ReportEvent(Event{
-					Op: "Trashable", File: path, Warning: err,
-					Msg: "tried to remove apparently-bad data file, which failed",
-				})
-			}
+			fl.quarantine("Trashable", path, err)
 			return nil // weird; skip
 		}
 		if bytes.Compare(high[:], oldestID[:]) < 0 {
@@ -346,6 +405,58 @@ func (fl *fileLog) Purgeable(oldestModTime time.Time) ([]TrashSegment, error) {
 	return trashSegments, nil
 }
 
+func (fl *fileLog) Scrubbable(after string) (string, ReadSegment, error) {
+	// Find the next segment to scrub, by name.
+	var next, nextPath string
+	fl.filesys.Walk(fl.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil // descend
+		}
+		if filepath.Ext(path) != extFlushed {
+			return nil // skip
+		}
+		name := modifyExtension(filepath.Base(path), "")
+		if name > after && (next == "" || name < next) {
+			next, nextPath = name, path
+		}
+		return nil
+	})
+	if next == "" {
+		return "", nil, ErrNoSegmentsAvailable
+	}
+
+	readSegment, err := newFileReadSegment(fl.filesys, nextPath)
+	if err != nil {
+		return "", nil, err
+	}
+	return next, readSegment, nil
+}
+
+func (fl *fileLog) Inventory() ([]InventorySegment, error) {
+	var inventory []InventorySegment
+	err := fl.filesys.Walk(fl.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil // descend
+		}
+		if ext := filepath.Ext(path); !(ext == extFlushed || ext == extReading) {
+			return nil // skip
+		}
+		low, high, err := parseFilename(path)
+		if err != nil {
+			return nil // weird; leave it to the others
+		}
+		inventory = append(inventory, InventorySegment{Low: low, High: high, Size: info.Size()})
+		return nil
+	})
+	return inventory, err
+}
+
 func (fl *fileLog) Stats() (LogStats, error) {
 	var stats LogStats
 	fl.filesys.Walk(fl.root, func(path string, info os.FileInfo, err error) error {
@@ -368,6 +479,9 @@ func (fl *fileLog) Stats() (LogStats, error) {
 		case extTrashed:
 			stats.TrashedSegments++
 			stats.TrashedBytes += info.Size()
+		case extCorrupt:
+			stats.CorruptSegments++
+			stats.CorruptBytes += info.Size()
 		}
 		return nil
 	})
@@ -378,7 +492,7 @@ func (fl *fileLog) Close() error {
 	return fl.releaser.Release()
 }
 
-func recoverSegments(filesys fs.Filesystem, root string) error {
+func recoverSegments(filesys fs.Filesystem, root string, reporter EventReporter) error {
 	var toRename, toReprocess []string
 	filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -397,6 +511,16 @@ func recoverSegments(filesys fs.Filesystem, root string) error {
 	})
 
 	for _, path := range toReprocess {
+		// Only compaction writes compressed segments, and the segments it was
+		// compacting are still around, so we can just drop them. That's just as
+		// well, since the last block is likely torn.
+		if isCompressed(path) {
+			if err := filesys.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+
 		// mergeRecords has the side effect of extracting the low and high ULIDs
 		// from a segment file. We use it for that side effect. This is a little
 		// bit inefficient; that's OK.
@@ -406,6 +530,16 @@ func recoverSegments(filesys fs.Filesystem, root string) error {
 		}
 		lo, hi, _, err := mergeRecords(ioutil.Discard, f)
 		f.Close() // ignore error, for now
+		if isCorrupt(err) {
+			if qerr := quarantine(filesys, path); qerr != nil {
+				return qerr
+			}
+			reporter.ReportEvent(Event{
+				Op: "recoverSegments", File: path, Error: err,
+				Msg: fmt.Sprintf("quarantined corrupt segment as %s", modifyExtension(path, extCorrupt)),
+			})
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -472,6 +606,34 @@ func recordFilterBoundedRegex(from, to ulid.ULID, q *regexp.Regexp) recordFilter
 	}
 }
 
+func recordFilterBounded(from, to ulid.ULID, pass recordFilter) recordFilter {
+	fromBytes, _ := from.MarshalText()
+	fromBytes = fromBytes[:ulidTimeSize]
+	toBytes, _ := to.MarshalText()
+	toBytes = toBytes[:ulidTimeSize]
+	return func(b []byte) bool {
+		return len(b) > ulid.EncodedSize &&
+			bytes.Compare(b[:ulidTimeSize], fromBytes) >= 0 &&
+			bytes.Compare(b[:ulidTimeSize], toBytes) <= 0 &&
+			pass(b)
+	}
+}
+
+// recordFilterCursor passes records strictly after the after ULID, and
+// strictly before the before ULID, unless it's zero.
+func recordFilterCursor(after, before ulid.ULID) recordFilter {
+	var (
+		afterBytes, _  = after.MarshalText()
+		beforeBytes, _ = before.MarshalText()
+		unbounded      = before == (ulid.ULID{})
+	)
+	return func(b []byte) bool {
+		return len(b) > ulid.EncodedSize &&
+			bytes.Compare(b[:ulid.EncodedSize], afterBytes) > 0 &&
+			(unbounded || bytes.Compare(b[:ulid.EncodedSize], beforeBytes) < 0)
+	}
+}
+
 // queryMatchingSegments returns a sorted slice of all segment files that could
 // possibly have records in the provided time range. The caller is responsible
 // for closing the segments.
@@ -490,17 +652,8 @@ func (fl *fileLog) queryMatchingSegments(from, to ulid.ULID) (segments []readSeg
 		}
 		low, high, err := parseFilename(path)
 		if err != nil {
-			fl.reporter.ReportEvent(Event{
-				Op: "queryMatchingSegments", File: path, Warning: err,
-				Msg: fmt.Sprintf("will remove apparently-bad data file of size %d", info.Size()),
-			})
 			// TODO(pb): re-parse and recover this file, async
-			if err := fl.filesys.Remove(path); err != nil {
-				fl.reporter.ReportEvent(Event{
-					Op: "queryMatchingSegments", File: path, Warning: err,
-					Msg: "tried to remove apparently-bad data file, which failed",
-				})
-			}
+			fl.quarantine("queryMatchingSegments", path, err)
 			return nil // weird; skip
 		}
 		if !overlap(from, to, low, high) {
@@ -531,26 +684,59 @@ func (fl *fileLog) queryMatchingSegments(from, to ulid.ULID) (segments []readSeg
 }
 
 type fileWriteSegment struct {
-	fs fs.Filesystem
-	f  fs.File
+	fs       fs.Filesystem
+	f        fs.File
+	w        io.Writer    // f and sum, or bw
+	bw       *blockWriter // if compressed
+	sum      hash.Hash32  // of what's written to f
+	reporter EventReporter
 }
 
 func (w fileWriteSegment) Write(p []byte) (int, error) {
-	return w.f.Write(p)
+	return w.w.Write(p)
 }
 
 // Close the segment and make it available for query.
 func (w fileWriteSegment) Close(low, high ulid.ULID) error {
+	var compressed string
+	if w.bw != nil {
+		if err := w.bw.Close(); err != nil {
+			w.f.Close()
+			return err
+		}
+		compressed = extCompressed
+	}
 	if err := w.f.Close(); err != nil {
 		return err
 	}
 	oldname := w.f.Name()
 	oldpath := filepath.Dir(oldname)
-	newname := filepath.Join(oldpath, fmt.Sprintf("%s-%s%s", low.String(), high.String(), extFlushed))
+	newname := filepath.Join(oldpath, fmt.Sprintf("%s-%s%s%s", low.String(), high.String(), compressed, extFlushed))
 	if w.fs.Exists(newname) {
 		return errors.Errorf("file %s already exists", newname)
 	}
-	return w.fs.Rename(oldname, newname)
+	if err := w.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	// Recovery will write the sidecars again if we fail. The checksum is
+	// computed from the file then, so it's better if we don't.
+	if err := writeChecksum(w.fs, newname, w.sum.Sum32()); err != nil {
+		w.reporter.ReportEvent(Event{
+			Op: "Close", File: newname, Warning: err,
+			Msg: "failed to write checksum",
+		})
+	}
+
+	// The index and bloom filter only make queries faster, so the segment is
+	// good without them.
+	if err := writeSidecars(w.fs, newname); err != nil {
+		w.reporter.ReportEvent(Event{
+			Op: "Close", File: newname, Warning: err,
+			Msg: "failed to write index and bloom filter; the segment will be read whole",
+		})
+	}
+	return nil
 }
 
 // Delete the segment.
@@ -564,6 +750,7 @@ func (w fileWriteSegment) Delete() error {
 type fileReadSegment struct {
 	fs fs.Filesystem
 	f  fs.File
+	r  io.Reader // f, decompressed if need be
 }
 
 func newFileReadSegment(fs fs.Filesystem, path string) (fileReadSegment, error) {
@@ -579,11 +766,15 @@ func newFileReadSegment(fs fs.Filesystem, path string) (fileReadSegment, error)
 	if err != nil {
 		return fileReadSegment{}, err
 	}
-	return fileReadSegment{fs, f}, nil
+	r := verifySegment(fs, newpath, f, f.Size())
+	if isCompressed(newpath) {
+		r = newBlockReadCloser(r)
+	}
+	return fileReadSegment{fs, f, r}, nil
 }
 
 func (r fileReadSegment) Read(p []byte) (int, error) {
-	return r.f.Read(p)
+	return r.r.Read(p)
 }
 
 func (r fileReadSegment) Reset() error {
@@ -604,14 +795,27 @@ func (r fileReadSegment) Trash() error {
 	if err := r.fs.Rename(oldpath, newpath); err != nil {
 		return err
 	}
+	if err := removeSidecars(r.fs, oldpath); err != nil {
+		return err
+	}
 	return r.fs.Chtimes(newpath, time.Now(), time.Now())
 }
 
+func (r fileReadSegment) Quarantine() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	return quarantine(r.fs, r.f.Name())
+}
+
 func (r fileReadSegment) Purge() error {
 	if err := r.f.Close(); err != nil {
 		return err
 	}
-	return r.fs.Remove(r.f.Name())
+	if err := r.fs.Remove(r.f.Name()); err != nil {
+		return err
+	}
+	return removeSidecars(r.fs, r.f.Name())
 }
 
 type fileTrashSegment struct {
@@ -623,7 +827,10 @@ func (t fileTrashSegment) Purge() error {
 	if err := t.f.Close(); err != nil {
 		return err
 	}
-	return t.fs.Remove(t.f.Name())
+	if err := t.fs.Remove(t.f.Name()); err != nil {
+		return err
+	}
+	return removeSidecars(t.fs, t.f.Name()) // usually gone already, with Trash
 }
 
 // chooseFirstSequential segments that are small enough to compact together to
@@ -667,7 +874,7 @@ type segmentInfo struct {
 func basename(path string) string {
 	base := filepath.Base(path)
 	ext := filepath.Ext(path)
-	return base[:len(base)-len(ext)]
+	return strings.TrimSuffix(base[:len(base)-len(ext)], extCompressed)
 }
 
 func modifyExtension(filename, newExt string) string {
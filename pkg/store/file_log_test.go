@@ -3,9 +3,11 @@ package store
 import (
 	"fmt"
 	"math/rand"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -101,12 +103,21 @@ func TestRecoverSegments(t *testing.T) {
 	defer filelog.Close()
 
 	files := map[string]bool{ // file: expected
-		"01ARYZ6S41TSV4RRFFQ69G5FAV-01ARYZ6S41TSV4RRFFZZZZZZZZ" + extFlushed: true,
-		"FLUSHED" + extFlushed:                                               true,
-		"READING" + extFlushed:                                               true,
-		"TRASHED" + extTrashed:                                               true,
-		"IGNORED.ignored":                                                    true,
-		lockFile:                                                             true,
+		"01ARYZ6S41TSV4RRFFQ69G5FAV-01ARYZ6S41TSV4RRFFZZZZZZZZ" + extFlushed:  true,
+		"01ARYZ6S41TSV4RRFFQ69G5FAV-01ARYZ6S41TSV4RRFFZZZZZZZZ" + extIndex:    true,
+		"01ARYZ6S41TSV4RRFFQ69G5FAV-01ARYZ6S41TSV4RRFFZZZZZZZZ" + extBloom:    true,
+		"01ARYZ6S41TSV4RRFFQ69G5FAV-01ARYZ6S41TSV4RRFFZZZZZZZZ" + extChecksum: true,
+		"FLUSHED" + extFlushed:  true,
+		"FLUSHED" + extIndex:    true,
+		"FLUSHED" + extBloom:    true,
+		"FLUSHED" + extChecksum: true,
+		"READING" + extFlushed:  true,
+		"READING" + extIndex:    true,
+		"READING" + extBloom:    true,
+		"READING" + extChecksum: true,
+		"TRASHED" + extTrashed:  true,
+		"IGNORED.ignored":       true,
+		lockFile:                true,
 	}
 	filesys.Walk("", func(path string, info os.FileInfo, err error) error {
 		if _, ok := files[path]; ok {
@@ -206,3 +217,94 @@ func TestBadSegment(t *testing.T) {
 		t.Fatalf("%s wasn't deleted", badfile)
 	}
 }
+
+func TestQueryPages(t *testing.T) {
+	t.Parallel()
+
+	filelog, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	// Write two segments of five records each.
+	var (
+		t0      = time.Now().Add(-time.Minute)
+		entropy = rand.New(rand.NewSource(14))
+		ids     []string
+	)
+	for i := 0; i < 2; i++ {
+		segment, err := filelog.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lo, hi ulid.ULID
+		for j := 0; j < 5; j++ {
+			id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(5*i+j)*time.Second)), entropy)
+			if j == 0 {
+				lo = id
+			}
+			hi = id
+			ids = append(ids, id.String())
+			fmt.Fprintf(segment, "%s record %d\n", id, 5*i+j)
+		}
+		if err := segment.Close(lo, hi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, testcase := range []struct {
+		order  string
+		cursor string
+		want   []string
+	}{
+		{"asc", "after", ids},
+		{"desc", "before", reversed(ids)},
+	} {
+		// Page through, 3 at a time, following the cursor.
+		var (
+			have []string
+			next string
+		)
+		for page := 0; page < 5; page++ {
+			query := fmt.Sprintf("from=%s&to=%s&limit=3&order=%s", ids[0], ids[len(ids)-1], testcase.order)
+			if next != "" {
+				query += "&" + testcase.cursor + "=" + next
+			}
+			u, _ := url.Parse("/query?" + query)
+			var qp QueryParams
+			if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+				t.Fatal(err)
+			}
+			result, err := filelog.Query(qp, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf []byte
+			next, buf, err = readPage(result.Records, qp.Limit)
+			result.Records.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+				if line != "" {
+					have = append(have, line[:ulid.EncodedSize])
+				}
+			}
+			if next == "" {
+				break
+			}
+		}
+		if want := testcase.want; !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want %v, have %v", testcase.order, want, have)
+		}
+	}
+}
+
+func reversed(a []string) []string {
+	r := make([]string, len(a))
+	for i := range a {
+		r[len(a)-1-i] = a[i]
+	}
+	return r
+}
@@ -0,0 +1,345 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+// Each flushed segment has a sparse index in a sidecar file, which maps the
+// ULID of a record every indexStride bytes or so to its offset in the segment.
+// Records in a segment are in ULID order, so queries use it to read only the
+// part of the segment that can match their time range. Older segments may not
+// be, unless the Scrubber sorts them: their index is empty, so they're read
+// whole.
+//
+// The index is a text file, with one entry per line: the ULID, a space, the
+// offset in decimal, a space, and the CRC-32C of the segment from the offset
+// to the next entry's, or the end, in hex. Queries verify the parts they read
+// with them. The sidecar has the segment's name, with extIndex as its
+// extension, so it follows the segment through its states. Indexes without
+// checksums, from older versions, are invalid, so recovery rebuilds them.
+const (
+	extIndex    = ".index"
+	indexStride = 64 * 1024 // bytes
+)
+
+type indexEntry struct {
+	id     ulid.ULID
+	offset int64
+	sum    uint32 // of the segment from offset to the next entry's
+}
+
+type segmentIndex []indexEntry
+
+// bounds returns the part of the segment that can have records from from to
+// to, inclusive. Records before the last entry earlier than from, and after
+// the first entry later than to, can't be in range.
+func (idx segmentIndex) bounds(from, to ulid.ULID, size int64) (start, end int64) {
+	end = size
+	for _, e := range idx {
+		if e.id.Compare(from) < 0 {
+			start = e.offset
+		}
+		if e.id.Compare(to) > 0 {
+			end = e.offset
+			break
+		}
+	}
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// end returns where the part of a segment of size bytes that the i'th entry
+// maps ends.
+func (idx segmentIndex) end(i int, size int64) int64 {
+	if i+1 < len(idx) {
+		return idx[i+1].offset
+	}
+	return size
+}
+
+func indexPath(segmentPath string) string {
+	return modifyExtension(segmentPath, extIndex)
+}
+
+// buildSidecars scans the records of a segment of size bytes, building its
+// index and bloom filter. The index of a compressed segment has an entry for
+// every block, since that's where we can start to read. The index of a segment
+// whose records are out of order is empty.
+func buildSidecars(r io.Reader, size int64, compressed bool) (segmentIndex, *bloomFilter, error) {
+	var (
+		idx    segmentIndex
+		bloom  = newBloomFilter(size)
+		offset int64 // in the records
+		last   int64 = -indexStride
+		stride int64 = indexStride
+		id     ulid.ULID
+		prev   [ulidTimeSize]byte // encoded time of the previous record
+		sorted = true
+
+		// seek returns where to start to read, for the record at offset.
+		seek = func(offset int64) (int64, bool) { return offset, true }
+	)
+	if compressed {
+		// Compressed segments are written by compaction, so they're big, and
+		// we don't know how big until we're done: their bloom filters get the
+		// maximum size.
+		var (
+			blocks []blockOffset
+			br     = &blockReadCloser{src: ioutil.NopCloser(r), first: true}
+		)
+		br.block = func(b blockOffset) { blocks = append(blocks, b) }
+		r, bloom, stride = br, newBloomFilter(math.MaxInt64), 1
+		seek = func(offset int64) (int64, bool) {
+			for len(blocks) > 0 && blocks[0].raw < offset {
+				blocks = blocks[1:]
+			}
+			if len(blocks) > 0 && blocks[0].raw == offset {
+				return blocks[0].file, true
+			}
+			return 0, false
+		}
+	}
+
+	s := bufio.NewScanner(r)
+	s.Split(scanLinesPreserveNewline)
+	s.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	for s.Scan() {
+		record := s.Bytes()
+		if at, ok := seek(offset); ok && offset-last >= stride && len(record) >= ulid.EncodedSize {
+			if err := id.UnmarshalText(record[:ulid.EncodedSize]); err != nil {
+				return nil, nil, errors.Wrapf(err, "record at offset %d", offset)
+			}
+			idx = append(idx, indexEntry{id: id, offset: at})
+			last = offset
+		}
+		if len(record) > ulid.EncodedSize {
+			bloom.addGrams(record[ulid.EncodedSize+1:])
+		}
+		if len(record) >= ulidTimeSize {
+			// The encoded time sorts like the time itself.
+			if offset > 0 && bytes.Compare(record[:ulidTimeSize], prev[:]) < 0 {
+				sorted = false
+			}
+			copy(prev[:], record)
+		}
+		offset += int64(len(record))
+	}
+	if !sorted {
+		idx = nil
+	}
+	return idx, bloom, s.Err()
+}
+
+// writeSidecars builds the index and bloom filter of the segment at path, and
+// writes them.
+func writeSidecars(filesys fs.Filesystem, path string) error {
+	f, err := filesys.Open(path)
+	if err != nil {
+		return err
+	}
+	size := f.Size()
+	idx, bloom, err := buildSidecars(f, size, isCompressed(path))
+	f.Close()
+	if err != nil {
+		return errors.Wrap(err, "building index")
+	}
+	if err := checksumIndex(filesys, path, idx, size); err != nil {
+		return errors.Wrap(err, "checksumming index")
+	}
+
+	var buf bytes.Buffer
+	for _, e := range idx {
+		fmt.Fprintf(&buf, "%s %d %08x\n", e.id, e.offset, e.sum)
+	}
+	if err := writeFile(filesys, indexPath(path), buf.Bytes()); err != nil {
+		return err
+	}
+	data, _ := bloom.MarshalBinary()
+	return writeFile(filesys, bloomPath(path), data)
+}
+
+func writeFile(filesys fs.Filesystem, path string, data []byte) error {
+	f, err := filesys.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readIndex reads the index of the segment at path.
+func readIndex(filesys fs.Filesystem, path string) (segmentIndex, error) {
+	f, err := filesys.Open(indexPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		idx segmentIndex
+		s   = bufio.NewScanner(f)
+	)
+	for s.Scan() {
+		line := s.Text()
+		if len(line) <= ulid.EncodedSize+1 || line[ulid.EncodedSize] != ' ' {
+			return nil, errors.Errorf("invalid index entry %q", line)
+		}
+		id, err := ulid.Parse(line[:ulid.EncodedSize])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid index entry %q", line)
+		}
+		fields := strings.Fields(line[ulid.EncodedSize+1:])
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid index entry %q", line)
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid index entry %q", line)
+		}
+		sum, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid index entry %q", line)
+		}
+		idx = append(idx, indexEntry{id, offset, uint32(sum)})
+	}
+	return idx, s.Err()
+}
+
+// removeSidecars removes the index, bloom filter, and checksum of the segment
+// at path, if it has them.
+func removeSidecars(filesys fs.Filesystem, path string) error {
+	for _, p := range []string{indexPath(path), bloomPath(path), checksumPath(path)} {
+		if !filesys.Exists(p) {
+			continue
+		}
+		if err := filesys.Remove(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seekSegments narrows each segment to the part its index says can have
+// records from from to to, verifying the parts of it that are read. Segments
+// without a usable index are read whole, and verifySegments verifies them.
+func (fl *fileLog) seekSegments(segments []readSegment, from, to ulid.ULID) {
+	for i, segment := range segments {
+		idx, err := readIndex(fl.filesys, segment.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fl.reporter.ReportEvent(Event{
+					Op: "seekSegments", File: segment.path, Warning: err,
+					Msg: "reading the whole segment",
+				})
+			}
+			continue
+		}
+		if len(idx) <= 0 {
+			continue // out of order
+		}
+		ra, ok := segment.file.(io.ReaderAt)
+		if !ok {
+			continue
+		}
+		path := segment.path
+		ra = &verifyingReaderAt{
+			ra:       ra,
+			idx:      idx,
+			size:     segment.size,
+			verified: make([]bool, len(idx)),
+			corrupt:  func(err error) { fl.quarantine("Query", path, err) },
+		}
+		start, end := idx.bounds(from, to, segment.size)
+		segments[i].file = sectionReadCloser{io.NewSectionReader(ra, start, end-start), segment.file}
+		segments[i].size = end - start
+	}
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// recoverSidecars writes the index and bloom filter of every flushed segment
+// that doesn't have usable ones, and removes those whose segments are gone.
+// Segments without them are still queried, just less efficiently. Segments
+// without a checksum, e.g. from before we had them, get one, so that from now
+// on we notice if they're corrupted.
+func recoverSidecars(filesys fs.Filesystem, root string, reporter EventReporter) {
+	var (
+		segments = map[string]bool{}
+		sidecars []string
+	)
+	filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil // recurse
+		}
+		switch filepath.Ext(path) {
+		case extFlushed:
+			segments[path] = true
+		case extIndex, extBloom, extChecksum:
+			sidecars = append(sidecars, path)
+		}
+		return nil
+	})
+
+	for _, path := range sidecars {
+		if segments[modifyExtension(path, extFlushed)] {
+			continue
+		}
+		if err := filesys.Remove(path); err != nil {
+			reporter.ReportEvent(Event{
+				Op: "recoverSidecars", File: path, Warning: err,
+				Msg: "failed to remove sidecar of missing segment",
+			})
+		}
+	}
+
+	for path := range segments {
+		if !filesys.Exists(checksumPath(path)) {
+			sum, err := computeChecksum(filesys, path)
+			if err == nil {
+				err = writeChecksum(filesys, path, sum)
+			}
+			if err != nil {
+				reporter.ReportEvent(Event{
+					Op: "recoverSidecars", File: path, Warning: err,
+					Msg: "failed to write checksum; the segment won't be verified",
+				})
+			}
+		}
+		if _, err := readIndex(filesys, path); err == nil {
+			if _, err := readBloom(filesys, path); err == nil {
+				continue
+			}
+		}
+		if err := writeSidecars(filesys, path); err != nil {
+			reporter.ReportEvent(Event{
+				Op: "recoverSidecars", File: path, Warning: err,
+				Msg: "failed to rebuild index and bloom filter; the segment will be read whole",
+			})
+		}
+	}
+}
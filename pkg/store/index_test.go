@@ -0,0 +1,160 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestSegmentIndexBounds(t *testing.T) {
+	t.Parallel()
+
+	var (
+		id  = func(ms uint64) ulid.ULID { return ulid.MustNew(ms, nil) }
+		idx = segmentIndex{{id(100), 0, 0}, {id(200), 1000, 0}, {id(300), 2000, 0}, {id(400), 3000, 0}}
+	)
+	for _, testcase := range []struct {
+		from, to   uint64
+		start, end int64
+	}{
+		{0, 1000, 0, 4000},     // everything
+		{100, 400, 0, 4000},    // everything, exactly
+		{250, 260, 1000, 2000}, // between two entries
+		{200, 300, 0, 3000},    // from ties with an entry, which may have earlier records before it
+		{401, 500, 3000, 4000}, // after the last entry
+		{10, 50, 0, 0},         // before the first entry
+	} {
+		start, end := idx.bounds(id(testcase.from), id(testcase.to), 4000)
+		if start != testcase.start || end != testcase.end {
+			t.Errorf("%d-%d: want [%d, %d), have [%d, %d)", testcase.from, testcase.to, testcase.start, testcase.end, start, end)
+		}
+	}
+}
+
+func TestBuildSidecarsUnsorted(t *testing.T) {
+	t.Parallel()
+
+	// Records out of order, as consumers used to write them, over a few
+	// index strides.
+	var (
+		t0      = time.Now().Add(-time.Hour)
+		n       = 4 * indexStride / 64
+		records bytes.Buffer
+	)
+	for i := 0; i < n; i++ {
+		ms := i
+		if i == n-1 {
+			ms = 0 // the last one is the oldest
+		}
+		fmt.Fprintf(&records, "%s record %029d\n", ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(ms)*time.Millisecond)), nil), i)
+	}
+	size := int64(records.Len())
+	idx, _, err := buildSidecars(&records, size, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx) != 0 {
+		t.Errorf("want an empty index, so the segment is read whole, have %d entries", len(idx))
+	}
+}
+
+func TestQueryWithIndex(t *testing.T) {
+	t.Parallel()
+
+	filesys := fs.NewVirtualFilesystem()
+	filelog, err := NewFileLog(filesys, "/", 64*1024*1024, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a segment of a few index strides, a record per millisecond.
+	var (
+		t0      = time.Now().Add(-time.Hour)
+		entropy = rand.New(rand.NewSource(16))
+		n       = 8 * indexStride / 64
+		ids     = make([]ulid.ULID, n)
+	)
+	segment, err := filelog.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ids {
+		ids[i] = ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(i)*time.Millisecond)), entropy)
+		fmt.Fprintf(segment, "%s record %029d\n", ids[i], i) // 64 bytes
+	}
+	if err := segment.Close(ids[0], ids[n-1]); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/%s-%s%s", ids[0], ids[n-1], extFlushed)
+	idx, err := readIndex(filesys, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 8, len(idx); want != have {
+		t.Fatalf("index entries: want %d, have %d", want, have)
+	}
+
+	// A query for a few records in the middle reads much less than all of it.
+	for _, order := range []string{QueryOrderAsc, QueryOrderDesc} {
+		var (
+			lo, hi = n/2 + 10, n/2 + 20
+			from   = time.Unix(0, int64(ids[lo].Time())*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+			to     = time.Unix(0, int64(ids[hi].Time())*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+		)
+		u, _ := url.Parse(fmt.Sprintf("/query?from=%s&to=%s&q=record&order=%s", from, to, order))
+		var qp QueryParams
+		if err := qp.DecodeFrom(u, rangeRequired); err != nil {
+			t.Fatal(err)
+		}
+		result, err := filelog.Query(qp, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(result.Records)
+		result.Records.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := int64(2*indexStride), result.MaxDataSetSize; have > want {
+			t.Errorf("%s: read %d bytes, want at most %d", order, have, want)
+		}
+		lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+		if want, have := hi-lo+1, len(lines); want != have {
+			t.Fatalf("%s: want %d records, have %d", order, want, have)
+		}
+		first, last := ids[lo].String(), ids[hi].String()
+		if order == QueryOrderDesc {
+			first, last = last, first
+		}
+		if !strings.HasPrefix(lines[0], first) || !strings.HasPrefix(lines[len(lines)-1], last) {
+			t.Errorf("%s: want %s..%s, have %s..%s", order, first, last, lines[0][:ulid.EncodedSize], lines[len(lines)-1][:ulid.EncodedSize])
+		}
+	}
+
+	// Recovery rebuilds missing indexes, and removes orphans.
+	filelog.Close()
+	if err := filesys.Remove(indexPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	orphan, _ := filesys.Create("/ORPHAN" + extIndex)
+	orphan.Close()
+	if filelog, err = NewFileLog(filesys, "/", 64*1024*1024, 1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	if recovered, err := readIndex(filesys, path); err != nil || len(recovered) != len(idx) {
+		t.Errorf("recovered index: %d entries, %v", len(recovered), err)
+	}
+	if filesys.Exists("/ORPHAN" + extIndex) {
+		t.Errorf("orphan index wasn't removed")
+	}
+}
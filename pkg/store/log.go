@@ -13,6 +13,10 @@ type Log interface {
 	// Create a new segment for writes.
 	Create() (WriteSegment, error)
 
+	// CreateCompressed creates a new segment for writes, which is stored
+	// compressed. It's read just like any other.
+	CreateCompressed() (WriteSegment, error)
+
 	// Query written and closed segments.
 	Query(qp QueryParams, statsOnly bool) (QueryResult, error)
 
@@ -33,6 +37,14 @@ type Log interface {
 	// i.e. hard deleted.
 	Purgeable(oldestModTime time.Time) ([]TrashSegment, error)
 
+	// Scrubbable returns the first flushed segment whose name sorts after the
+	// given one, or the first of them all if it's empty, along with its name.
+	// The segment may be read whole and checked, i.e. scrubbed.
+	Scrubbable(after string) (name string, segment ReadSegment, err error)
+
+	// Inventory of the segments that may be queried.
+	Inventory() ([]InventorySegment, error)
+
 	// Stats of the current state of the store log.
 	Stats() (LogStats, error)
 
@@ -52,11 +64,13 @@ type WriteSegment interface {
 }
 
 // ReadSegment can be read from, reset (back to flushed state), trashed (made
-// unavailable for queries), or purged (hard deleted).
+// unavailable for queries), quarantined (set aside as corrupt), or purged
+// (hard deleted).
 type ReadSegment interface {
 	io.Reader
 	Reset() error
 	Trash() error
+	Quarantine() error
 	Purge() error
 }
 
@@ -65,6 +79,14 @@ type TrashSegment interface {
 	Purge() error
 }
 
+// InventorySegment describes a segment by the ULIDs of its first and last
+// records, and its size on disk.
+type InventorySegment struct {
+	Low  ulid.ULID `json:"low"`
+	High ulid.ULID `json:"high"`
+	Size int64     `json:"size"`
+}
+
 // LogStats describe the current state of the store log.
 type LogStats struct {
 	ActiveSegments  int64
@@ -75,4 +97,6 @@ type LogStats struct {
 	ReadingBytes    int64
 	TrashedSegments int64
 	TrashedBytes    int64
+	CorruptSegments int64
+	CorruptBytes    int64
 }
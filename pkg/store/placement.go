@@ -0,0 +1,78 @@
+package store
+
+import (
+	"time"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+)
+
+// Stores may be given a zone, like a rack or an availability zone, which is
+// gossiped through the cluster. Replicas are spread across as many zones as
+// possible, so that losing one zone doesn't lose every copy of a segment.
+// Stores without a zone are taken to be in a zone of their own.
+
+// spreadZones orders stores so that each one is, as far as possible, in a zone
+// that neither the stores in taken nor those before it are in. Once every zone
+// has been used, it starts over with those that remain. It keeps the order of
+// stores otherwise.
+func spreadZones(stores []string, zones map[string]string, taken []string) []string {
+	used := map[string]bool{}
+	for _, store := range taken {
+		if zone := zones[store]; zone != "" {
+			used[zone] = true
+		}
+	}
+	ordered := make([]string, 0, len(stores))
+	for rest := stores; len(rest) > 0; used = map[string]bool{} {
+		var next []string
+		for _, store := range rest {
+			zone := zones[store]
+			if zone != "" && used[zone] {
+				next = append(next, store)
+				continue
+			}
+			ordered = append(ordered, store)
+			if zone != "" {
+				used[zone] = true
+			}
+		}
+		rest = next
+	}
+	return ordered
+}
+
+// placement describes the replicas on the given stores, of those available.
+func placement(replicas, available []string, zones map[string]string) cluster.Placement {
+	p := cluster.Placement{
+		Time:   time.Now(),
+		Stores: make(map[string]string, len(replicas)),
+	}
+	for _, store := range replicas {
+		p.Stores[store] = zones[store]
+	}
+	p.Zones = countZones(replicas, zones)
+	possible := countZones(available, zones)
+	if possible > len(replicas) {
+		possible = len(replicas)
+	}
+	p.Spread = p.Zones >= possible
+	return p
+}
+
+// countZones counts the distinct zones of the stores, each of those without a
+// zone being one.
+func countZones(stores []string, zones map[string]string) int {
+	var (
+		n    int
+		seen = map[string]bool{}
+	)
+	for _, store := range stores {
+		zone := zones[store]
+		if zone != "" && seen[zone] {
+			continue
+		}
+		seen[zone] = true
+		n++
+	}
+	return n
+}
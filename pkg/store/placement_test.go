@@ -0,0 +1,63 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpreadZones(t *testing.T) {
+	t.Parallel()
+
+	zones := map[string]string{
+		"a1": "a", "a2": "a", "a3": "a",
+		"b1": "b", "b2": "b",
+		"c1": "c",
+		"x":  "", // no zone
+	}
+	for _, testcase := range []struct {
+		name   string
+		stores []string
+		taken  []string
+		want   []string
+	}{
+		{"empty", nil, nil, []string{}},
+		{"one zone", []string{"a1", "a2", "a3"}, nil, []string{"a1", "a2", "a3"}},
+		{"zones first", []string{"a1", "a2", "b1", "b2", "c1"}, nil, []string{"a1", "b1", "c1", "a2", "b2"}},
+		{"round robin", []string{"a1", "a2", "a3", "b1", "b2"}, nil, []string{"a1", "b1", "a2", "b2", "a3"}},
+		{"taken zones last", []string{"a2", "b1", "c1"}, []string{"a1"}, []string{"b1", "c1", "a2"}},
+		{"no zone", []string{"a1", "a2", "x"}, []string{"a3"}, []string{"x", "a1", "a2"}},
+	} {
+		if have := spreadZones(testcase.stores, zones, testcase.taken); !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("%s: want %v, have %v", testcase.name, testcase.want, have)
+		}
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	t.Parallel()
+
+	zones := map[string]string{"a1": "a", "a2": "a", "b1": "b", "x": ""}
+	for _, testcase := range []struct {
+		name      string
+		replicas  []string
+		available []string
+		zones     int
+		spread    bool
+	}{
+		{"spread", []string{"a1", "b1"}, []string{"a1", "a2", "b1"}, 2, true},
+		{"same zone", []string{"a1", "a2"}, []string{"a1", "a2", "b1"}, 1, false},
+		{"only one zone", []string{"a1", "a2"}, []string{"a1", "a2"}, 1, true},
+		{"no zone", []string{"a1", "x"}, []string{"a1", "a2", "x"}, 2, true},
+	} {
+		p := placement(testcase.replicas, testcase.available, zones)
+		if want, have := testcase.zones, p.Zones; want != have {
+			t.Errorf("%s: want %d zones, have %d", testcase.name, want, have)
+		}
+		if want, have := testcase.spread, p.Spread; want != have {
+			t.Errorf("%s: want spread %v, have %v", testcase.name, want, have)
+		}
+		if want, have := len(testcase.replicas), len(p.Stores); want != have {
+			t.Errorf("%s: want %d stores, have %d", testcase.name, want, have)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -22,8 +23,28 @@ type QueryParams struct {
 	To    ulidOrTime `json:"to"`
 	Q     string     `json:"q"`
 	Regex bool       `json:"regex"`
+	Lang  string     `json:"lang,omitempty"`
+
+	Where  []string `json:"where,omitempty"`  // field predicates, ANDed
+	Fields []string `json:"fields,omitempty"` // projection
+
+	Agg  string        `json:"agg,omitempty"`  // aggregation, instead of records
+	Step time.Duration `json:"step,omitempty"` // of the time series, for agg=count
+	By   string        `json:"by,omitempty"`   // field or regex:..., for agg=top
+	N    int           `json:"n,omitempty"`    // groups to return, for agg=top
+
+	Limit  int       `json:"limit,omitempty"` // records to return; 0 is all of them
+	Order  string    `json:"order,omitempty"` // asc (default) or desc
+	After  ulid.ULID `json:"after"`           // exclusive cursor, if not zero
+	Before ulid.ULID `json:"before"`          // exclusive cursor, if not zero
 }
 
+// Orders in which queries may return records.
+const (
+	QueryOrderAsc  = "asc"
+	QueryOrderDesc = "desc"
+)
+
 // DecodeFrom populates a QueryParams from a URL.
 func (qp *QueryParams) DecodeFrom(u *url.URL, rb rangeBehavior) error {
 	if err := qp.From.Parse(u.Query().Get("from")); err != nil && rb == rangeRequired {
@@ -34,6 +55,11 @@ func (qp *QueryParams) DecodeFrom(u *url.URL, rb rangeBehavior) error {
 	}
 	qp.Q = u.Query().Get("q")
 	_, qp.Regex = u.Query()["regex"]
+	qp.Lang = u.Query().Get("lang")
+	qp.Where = u.Query()["where"]
+	qp.Fields = parseFields(u.Query()["fields"])
+	qp.Agg = u.Query().Get("agg")
+	qp.Order = u.Query().Get("order")
 
 	if qp.Regex {
 		if _, err := regexp.Compile(qp.Q); err != nil {
@@ -41,9 +67,144 @@ func (qp *QueryParams) DecodeFrom(u *url.URL, rb rangeBehavior) error {
 		}
 	}
 
+	switch qp.Lang {
+	case "":
+	case QueryLangExpr:
+		if qp.Regex {
+			return errors.New("'regex' and 'lang' are mutually exclusive")
+		}
+		if _, err := compileExpr(qp.Q); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unsupported query language %q", qp.Lang)
+	}
+
+	for _, s := range qp.Where {
+		if _, err := parseFieldPredicate(s); err != nil {
+			return errors.Wrap(err, "parsing 'where'")
+		}
+	}
+
+	if limit := u.Query().Get("limit"); limit != "" {
+		var err error
+		if qp.Limit, err = strconv.Atoi(limit); err != nil {
+			return errors.Wrap(err, "parsing 'limit'")
+		}
+		if qp.Limit < 0 {
+			return errors.New("'limit' must not be negative")
+		}
+	}
+	switch qp.Order {
+	case "", QueryOrderAsc, QueryOrderDesc:
+	default:
+		return errors.Errorf("unsupported order %q", qp.Order)
+	}
+	for _, cursor := range []struct {
+		param string
+		id    *ulid.ULID
+	}{
+		{"after", &qp.After},
+		{"before", &qp.Before},
+	} {
+		if s := u.Query().Get(cursor.param); s != "" {
+			id, err := ulid.Parse(s)
+			if err != nil {
+				return errors.Wrapf(err, "parsing '%s'", cursor.param)
+			}
+			*cursor.id = id
+		}
+	}
+	if qp.Agg != "" && (qp.Limit > 0 || qp.Order != "" || qp.After != (ulid.ULID{}) || qp.Before != (ulid.ULID{})) {
+		return errors.New("'limit', 'order', 'after', and 'before' don't apply to 'agg'")
+	}
+
+	var (
+		step = u.Query().Get("step")
+		by   = u.Query().Get("by")
+		n    = u.Query().Get("n")
+	)
+	if qp.Agg != QueryAggCount && step != "" {
+		return errors.New("'step' requires 'agg=count'")
+	}
+	if qp.Agg != QueryAggTop && (by != "" || n != "") {
+		return errors.New("'by' and 'n' require 'agg=top'")
+	}
+	switch qp.Agg {
+	case "":
+	case QueryAggCount:
+		var err error
+		if qp.Step, err = time.ParseDuration(step); err != nil {
+			return errors.Wrap(err, "parsing 'step'")
+		}
+		if qp.Step < time.Millisecond {
+			return errors.Errorf("'step' must be at least %s", time.Millisecond)
+		}
+		if rb == rangeRequired {
+			if n := aggBuckets(qp.From.Time, qp.To.Time, qp.Step); n > maxAggBuckets {
+				return errors.Errorf("'step' of %s makes %d buckets; the maximum is %d", qp.Step, n, maxAggBuckets)
+			}
+		}
+	case QueryAggTop:
+		if _, err := parseGroupBy(by); err != nil {
+			return errors.Wrap(err, "parsing 'by'")
+		}
+		qp.By, qp.N = by, defaultAggTop
+		if n != "" {
+			var err error
+			if qp.N, err = strconv.Atoi(n); err != nil {
+				return errors.Wrap(err, "parsing 'n'")
+			}
+			if qp.N <= 0 || qp.N > maxAggGroups {
+				return errors.Errorf("'n' must be between 1 and %d", maxAggGroups)
+			}
+		}
+	default:
+		return errors.Errorf("unsupported aggregation %q", qp.Agg)
+	}
+
 	return nil
 }
 
+// recordFilter returns the filter for Q and the field predicates, without
+// time bounds. DecodeFrom validates them, so they will compile.
+func (qp QueryParams) recordFilter() recordFilter {
+	var pass recordFilter
+	switch {
+	case qp.Lang == QueryLangExpr:
+		var err error
+		if pass, err = compileExpr(qp.Q); err != nil {
+			panic(err)
+		}
+	case qp.Regex:
+		pass = recordFilterRegex(regexp.MustCompile(qp.Q))
+	default:
+		pass = recordFilterPlain([]byte(qp.Q))
+	}
+	if len(qp.Where) > 0 {
+		pass = recordFilterAll(pass, qp.fieldFilter())
+	}
+	return pass
+}
+
+// fieldFilter returns the filter for the field predicates.
+func (qp QueryParams) fieldFilter() recordFilter {
+	preds := make([]fieldPredicate, len(qp.Where))
+	for i, s := range qp.Where {
+		p, err := parseFieldPredicate(s)
+		if err != nil {
+			panic(err)
+		}
+		preds[i] = p
+	}
+	return recordFilterFields(preds)
+}
+
+// desc reports whether records should be returned newest first.
+func (qp QueryParams) desc() bool {
+	return qp.Order == QueryOrderDesc
+}
+
 type rangeBehavior int
 
 const (
@@ -88,31 +249,63 @@ type QueryResult struct {
 
 	NodesQueried    int    `json:"nodes_queried"`
 	SegmentsQueried int    `json:"segments_queried"`
+	SegmentsSkipped int    `json:"segments_skipped,omitempty"` // by their bloom filters
 	MaxDataSetSize  int64  `json:"max_data_set_size"`
 	ErrorCount      int    `json:"error_count,omitempty"`
 	Duration        string `json:"duration"`
 
-	Records io.ReadCloser // TODO(pb): audit to ensure closing is valid throughout
+	// Next is the cursor for the next page of a limited query: pass it as
+	// after, or before if the order is desc. It's empty on the last page.
+	Next string `json:"next,omitempty"`
+
+	Records   io.ReadCloser // TODO(pb): audit to ensure closing is valid throughout
+	Aggregate *Aggregate    // instead of Records, for aggregation queries
 }
 
 // EncodeTo encodes the QueryResult to the HTTP response writer.
+// An Aggregate is written as JSON; otherwise, records are copied.
 // It also closes the records ReadCloser.
 func (qr *QueryResult) EncodeTo(w http.ResponseWriter) {
 	w.Header().Set(httpHeaderFrom, qr.Params.From.Format(time.RFC3339))
 	w.Header().Set(httpHeaderTo, qr.Params.To.Format(time.RFC3339))
 	w.Header().Set(httpHeaderQ, qr.Params.Q)
 	w.Header().Set(httpHeaderRegex, fmt.Sprint(qr.Params.Regex))
+	w.Header().Set(httpHeaderLang, qr.Params.Lang)
+	switch qr.Params.Agg {
+	case QueryAggCount:
+		w.Header().Set(httpHeaderAgg, qr.Params.Agg)
+		w.Header().Set(httpHeaderStep, qr.Params.Step.String())
+	case QueryAggTop:
+		w.Header().Set(httpHeaderAgg, qr.Params.Agg)
+		w.Header().Set(httpHeaderBy, qr.Params.By)
+		w.Header().Set(httpHeaderN, strconv.Itoa(qr.Params.N))
+	}
 
 	w.Header().Set(httpHeaderNodesQueried, strconv.Itoa(qr.NodesQueried))
 	w.Header().Set(httpHeaderSegmentsQueried, strconv.Itoa(qr.SegmentsQueried))
+	w.Header().Set(httpHeaderSegmentsSkipped, strconv.Itoa(qr.SegmentsSkipped))
 	w.Header().Set(httpHeaderMaxDataSetSize, strconv.FormatInt(qr.MaxDataSetSize, 10))
 	w.Header().Set(httpHeaderErrorCount, strconv.Itoa(qr.ErrorCount))
 	w.Header().Set(httpHeaderDuration, qr.Duration)
+	if qr.Params.Limit > 0 {
+		w.Header().Set(httpHeaderLimit, strconv.Itoa(qr.Params.Limit))
+		w.Header().Set(httpHeaderOrder, qr.Params.Order)
+	}
+	if qr.Next != "" {
+		w.Header().Set(httpHeaderNext, qr.Next)
+	}
+	if qr.Aggregate != nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
 
 	if qr.ErrorCount > 0 {
 		w.WriteHeader(http.StatusPartialContent)
 	}
 
+	if qr.Aggregate != nil {
+		json.NewEncoder(w).Encode(qr.Aggregate)
+	}
+
 	if qr.Records != nil {
 		// CopyBuffer can be useful for complex query pipelines.
 		// TODO(pb): validate the 1MB buffer size with profiling
@@ -135,12 +328,29 @@ func (qr *QueryResult) DecodeFrom(resp *http.Response) error {
 	if qr.Params.Regex, err = strconv.ParseBool(resp.Header.Get(httpHeaderRegex)); err != nil {
 		return errors.Wrap(err, "regex")
 	}
+	qr.Params.Lang = resp.Header.Get(httpHeaderLang)
+	switch qr.Params.Agg = resp.Header.Get(httpHeaderAgg); qr.Params.Agg {
+	case QueryAggCount:
+		if qr.Params.Step, err = time.ParseDuration(resp.Header.Get(httpHeaderStep)); err != nil {
+			return errors.Wrap(err, "step")
+		}
+	case QueryAggTop:
+		qr.Params.By = resp.Header.Get(httpHeaderBy)
+		if qr.Params.N, err = strconv.Atoi(resp.Header.Get(httpHeaderN)); err != nil {
+			return errors.Wrap(err, "n")
+		}
+	}
 	if qr.NodesQueried, err = strconv.Atoi(resp.Header.Get(httpHeaderNodesQueried)); err != nil {
 		return errors.Wrap(err, "nodes queried")
 	}
 	if qr.SegmentsQueried, err = strconv.Atoi(resp.Header.Get(httpHeaderSegmentsQueried)); err != nil {
 		return errors.Wrap(err, "segments queried")
 	}
+	if skipped := resp.Header.Get(httpHeaderSegmentsSkipped); skipped != "" {
+		if qr.SegmentsSkipped, err = strconv.Atoi(skipped); err != nil {
+			return errors.Wrap(err, "segments skipped")
+		}
+	}
 	if qr.MaxDataSetSize, err = strconv.ParseInt(resp.Header.Get(httpHeaderMaxDataSetSize), 10, 64); err != nil {
 		return errors.Wrap(err, "max data set size")
 	}
@@ -148,6 +358,27 @@ func (qr *QueryResult) DecodeFrom(resp *http.Response) error {
 		return errors.Wrap(err, "error count")
 	}
 	qr.Duration = resp.Header.Get(httpHeaderDuration)
+	if limit := resp.Header.Get(httpHeaderLimit); limit != "" {
+		if qr.Params.Limit, err = strconv.Atoi(limit); err != nil {
+			return errors.Wrap(err, "limit")
+		}
+		qr.Params.Order = resp.Header.Get(httpHeaderOrder)
+	}
+	qr.Next = resp.Header.Get(httpHeaderNext)
+	if qr.Params.Agg != "" {
+		// The body is the aggregate, or empty if we asked for stats only.
+		defer resp.Body.Close()
+		var agg Aggregate
+		switch err := json.NewDecoder(resp.Body).Decode(&agg); err {
+		case nil:
+			qr.Aggregate = &agg
+		case io.EOF:
+		default:
+			return errors.Wrap(err, "aggregate")
+		}
+		qr.Records = ioutil.NopCloser(bytes.NewReader(nil))
+		return nil
+	}
 	qr.Records = resp.Body
 	return nil
 }
@@ -157,11 +388,20 @@ func (qr *QueryResult) Merge(other QueryResult) error {
 	// Union the simple integer types.
 	qr.NodesQueried += other.NodesQueried
 	qr.SegmentsQueried += other.SegmentsQueried
+	qr.SegmentsSkipped += other.SegmentsSkipped
 	if other.MaxDataSetSize > qr.MaxDataSetSize {
 		qr.MaxDataSetSize = other.MaxDataSetSize
 	}
 	qr.ErrorCount += other.ErrorCount
 
+	// Sum the aggregates.
+	if other.Aggregate != nil {
+		if qr.Aggregate == nil {
+			qr.Aggregate = &Aggregate{}
+		}
+		qr.Aggregate.merge(*other.Aggregate)
+	}
+
 	// Merge the record readers.
 	// Both mergeRecords and multiCloser can handle nils.
 	var buf bytes.Buffer
@@ -178,9 +418,18 @@ const (
 	httpHeaderTo              = "X-Oklog-To"
 	httpHeaderQ               = "X-Oklog-Q"
 	httpHeaderRegex           = "X-Oklog-Regex"
+	httpHeaderLang            = "X-Oklog-Lang"
+	httpHeaderAgg             = "X-Oklog-Agg"
+	httpHeaderStep            = "X-Oklog-Step"
+	httpHeaderBy              = "X-Oklog-By"
+	httpHeaderN               = "X-Oklog-N"
 	httpHeaderNodesQueried    = "X-Oklog-Nodes-Queried"
 	httpHeaderSegmentsQueried = "X-Oklog-Segments-Queried"
+	httpHeaderSegmentsSkipped = "X-Oklog-Segments-Skipped"
 	httpHeaderMaxDataSetSize  = "X-Oklog-Max-Data-Set-Size"
 	httpHeaderErrorCount      = "X-Oklog-Error-Count"
 	httpHeaderDuration        = "X-Oklog-Duration"
+	httpHeaderLimit           = "X-Oklog-Limit"
+	httpHeaderOrder           = "X-Oklog-Order"
+	httpHeaderNext            = "X-Oklog-Next"
 )
@@ -10,6 +10,15 @@ import (
 	"github.com/pkg/errors"
 )
 
+// streamSendTimeout is how long matching a record waits for a streaming query
+// whose chan is full. Replication is held up while it waits, so a query that
+// doesn't catch up by then is canceled, with errStreamTooSlow.
+const streamSendTimeout = time.Second
+
+// errStreamTooSlow is why a streaming query was canceled, if it didn't keep up
+// with the records being replicated.
+var errStreamTooSlow = errors.New("streaming query canceled: too slow to keep up with replication")
+
 // queryRegistry holds active streaming queries.
 type queryRegistry struct {
 	mtx     sync.RWMutex
@@ -23,6 +32,7 @@ type queryContext struct {
 	pass   recordFilter
 	done   <-chan struct{}
 	cancel func()
+	fail   func(error) // cancel, with a reason
 }
 
 func newQueryRegistry() *queryRegistry {
@@ -34,13 +44,15 @@ func newQueryRegistry() *queryRegistry {
 // Register a new query. If successful, range over the returned chan for
 // incoming records. If not successful, the returned chan will be nil.
 // Records on the returned chan will NOT have trailing newlines.
-func (qr *queryRegistry) Register(ctx context.Context, pass recordFilter) <-chan []byte {
+// Once the chan is closed, the returned func tells why the registry canceled
+// the query, or returns nil if it wasn't canceled for a failure.
+func (qr *queryRegistry) Register(ctx context.Context, pass recordFilter) (<-chan []byte, func() error) {
 	qr.mtx.Lock()
 	defer qr.mtx.Unlock()
 
 	// Don't accept new registrations if we're shutting down.
 	if qr.closing {
-		return nil
+		return nil, func() error { return nil }
 	}
 
 	// Queries are typically deregistered when the parent context is canceled.
@@ -49,10 +61,29 @@ func (qr *queryRegistry) Register(ctx context.Context, pass recordFilter) <-chan
 	// We need a side-channel way to cancel each registered query.
 	subctx, cancel := context.WithCancel(ctx)
 
+	// A query may also be canceled for a reason, which we keep for the user.
+	var (
+		errMtx sync.Mutex
+		err    error
+	)
+	fail := func(reason error) {
+		errMtx.Lock()
+		if err == nil {
+			err = reason
+		}
+		errMtx.Unlock()
+		cancel()
+	}
+	failed := func() error {
+		errMtx.Lock()
+		defer errMtx.Unlock()
+		return err
+	}
+
 	// Create the record chan, and register it.
 	// TODO(pb): validate the buffer size
 	c := make(chan []byte, 1024)
-	qr.reg[c] = queryContext{pass, subctx.Done(), cancel}
+	qr.reg[c] = queryContext{pass, subctx.Done(), cancel, fail}
 
 	// Canceling the context should deregister the query and close the chan.
 	// Spawn a cleanup goroutine to wait for the cancelation and do just that.
@@ -69,7 +100,7 @@ func (qr *queryRegistry) Register(ctx context.Context, pass recordFilter) <-chan
 	}()
 
 	// The user should range over this chan for matching records.
-	return c
+	return c, failed
 }
 
 func (qr *queryRegistry) Close() error {
@@ -108,9 +139,20 @@ func (qr *queryRegistry) Close() error {
 }
 
 // Match a segment of records against the set of registered queries.
-// The function may block if channel receivers are slow.
-// Perhaps best to run in a goroutine?
 func (qr *queryRegistry) Match(segment []byte) {
+	s := bufio.NewScanner(bytes.NewReader(segment))
+	s.Split(scanLinesPreserveNewline)
+	for s.Scan() {
+		qr.MatchRecord(s.Bytes())
+	}
+}
+
+// MatchRecord matches a single record, with its trailing newline, against the
+// set of registered queries. Records are matched as they're replicated, so if
+// a query's chan is full, it waits at most streamSendTimeout for the query to
+// catch up, and then cancels it. The record is copied before it's sent, so it
+// may be reused.
+func (qr *queryRegistry) MatchRecord(record []byte) {
 	qr.mtx.RLock()
 	defer qr.mtx.RUnlock()
 
@@ -124,26 +166,43 @@ func (qr *queryRegistry) Match(segment []byte) {
 		return
 	}
 
-	// Match each record in the segment against the registered queries.
 	// Send any matches immediately.
-	s := bufio.NewScanner(bytes.NewReader(segment))
-	s.Split(scanLinesPreserveNewline)
-	for s.Scan() {
-		for c, qc := range qr.reg {
-			if qc.pass(s.Bytes()) {
-				select {
-				case c <- []byte(s.Text()):
-					// We use s.Text to copy the record out of the Scanner.
-
-				case <-qc.done:
-					// We're canceled! The cancelation was also detected by the
-					// cleanup goroutine spawned by Register. That goroutine is
-					// in charge of deregistering the query and closing the
-					// chan. For our part, we should just stop sending records
-					// to this chan.
-					continue
-				}
-			}
+	for c, qc := range qr.reg {
+		if !qc.pass(record) {
+			continue
+		}
+		buf := append([]byte(nil), record...)
+		select {
+		case c <- buf:
+			continue
+		case <-qc.done:
+			// We're canceled! The cancelation was also detected by the
+			// cleanup goroutine spawned by Register. That goroutine is in
+			// charge of deregistering the query and closing the chan. For
+			// our part, we should just stop sending records to this chan.
+			continue
+		default:
 		}
+
+		// The receiver is behind. Give it a little while to catch up, but
+		// don't hold up replication, and every other query, for long.
+		timer := time.NewTimer(streamSendTimeout)
+		select {
+		case c <- buf:
+		case <-qc.done:
+		case <-timer.C:
+			qc.fail(errStreamTooSlow)
+		}
+		timer.Stop()
 	}
 }
+
+// matchWriter matches the records written to it against the registered
+// queries, as they're written. Each Write must be a single, whole record, as
+// teeRecords writes them.
+type matchWriter struct{ qr *queryRegistry }
+
+func (w matchWriter) Write(record []byte) (int, error) {
+	w.qr.MatchRecord(record)
+	return len(record), nil
+}
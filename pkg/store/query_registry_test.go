@@ -24,11 +24,11 @@ func TestQueryRegistry(t *testing.T) {
 
 	// Register a query for 'foo' records.
 	fooctx, foocancel := context.WithCancel(context.Background())
-	fooc := qr.Register(fooctx, recordFilterPlain([]byte("foo")))
+	fooc, _ := qr.Register(fooctx, recordFilterPlain([]byte("foo")))
 
 	// Register a query for 'bar' records.
 	barctx, barcancel := context.WithCancel(context.Background())
-	barc := qr.Register(barctx, recordFilterPlain([]byte("bar")))
+	barc, _ := qr.Register(barctx, recordFilterPlain([]byte("bar")))
 
 	// A helper function to generate segments.
 	nopulid := ulid.MustNew(0, nil).String()
@@ -91,7 +91,7 @@ func TestQueryRegistryClose(t *testing.T) {
 	t.Parallel()
 
 	qr := newQueryRegistry()
-	c := qr.Register(context.Background(), recordFilterPlain([]byte("")))
+	c, _ := qr.Register(context.Background(), recordFilterPlain([]byte("")))
 	qr.Close()
 	select {
 	case _, ok := <-c:
@@ -103,6 +103,47 @@ func TestQueryRegistryClose(t *testing.T) {
 	}
 }
 
+func TestQueryRegistrySlow(t *testing.T) {
+	t.Parallel()
+
+	qr := newQueryRegistry()
+	defer qr.Close()
+
+	var segment bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&segment, "%s record %d\n", ulid.MustNew(uint64(i), nil), i)
+	}
+
+	// A query that falls behind, but catches up, gets every record.
+	records, failed := qr.Register(context.Background(), recordFilterPlain([]byte("")))
+	go qr.Match(segment.Bytes())
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 2000; i++ {
+		select {
+		case <-records:
+		case <-time.After(time.Second):
+			t.Fatalf("record %d: timeout", i)
+		}
+	}
+	if err := failed(); err != nil {
+		t.Errorf("want no error, have %v", err)
+	}
+
+	// A query that doesn't catch up is canceled, and told why.
+	records, failed = qr.Register(context.Background(), recordFilterPlain([]byte("")))
+	qr.Match(segment.Bytes())
+	if want, have := errStreamTooSlow, failed(); want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	n := 0
+	for range records {
+		n++
+	}
+	if n >= 2000 {
+		t.Errorf("want fewer than %d records, have %d", 2000, n)
+	}
+}
+
 func TestQueryRegistryRaces(t *testing.T) {
 	t.Parallel()
 
@@ -132,7 +173,7 @@ func TestQueryRegistryRaces(t *testing.T) {
 	)
 	for i := 0; i < n; i++ {
 		ctx, cancel := context.WithCancel(context.Background())
-		records := qr.Register(ctx, recordFilterPlain([]byte("")))
+		records, _ := qr.Register(ctx, recordFilterPlain([]byte("")))
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
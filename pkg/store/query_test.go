@@ -1,6 +1,7 @@
 package store
 
 import (
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
@@ -48,3 +49,30 @@ func mustParseRFC3339(s string) time.Time {
 	}
 	return t
 }
+
+func TestQueryParamsPaging(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		query string
+		valid bool
+	}{
+		{"limit=10", true},
+		{"limit=10&order=desc", true},
+		{"limit=10&order=asc&after=01BB6RQR190000000000000000", true},
+		{"before=01BB6RQR190000000000000000", true},
+		{"limit=-1", false},
+		{"limit=ten", false},
+		{"order=desc", true},
+		{"limit=10&order=sideways", false},
+		{"after=yesterday", false},
+		{"limit=10&agg=count&step=1m", false},
+	} {
+		u, _ := url.Parse("/query?" + testcase.query)
+		var qp QueryParams
+		err := qp.DecodeFrom(u, rangeNotRequired)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s: want valid=%v, have error %v", testcase.query, want, err)
+		}
+	}
+}
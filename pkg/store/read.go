@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
 
 	"github.com/djherbis/buffer"
@@ -18,6 +19,17 @@ import (
 // ErrShortRead is returned when a read is unexpectedly shortened.
 var ErrShortRead = errors.New("short read")
 
+// segmentError is an error from one of the readers being merged, with its
+// index among those that aren't nil, so we can tell which segment it came from.
+type segmentError struct {
+	reader int
+	err    error
+}
+
+func (e segmentError) Error() string {
+	return fmt.Sprintf("reader %d: %v", e.reader, e.err)
+}
+
 // mergeRecords takes a set of io.Readers that contain ULID-prefixed records in
 // individually-sorted order, and writes the globally-sorted output to the
 // io.Writer.
@@ -52,11 +64,11 @@ func mergeRecords(w io.Writer, readers ...io.Reader) (low, high ulid.ULID, n int
 			// Something nice, like bytes.Fields, is too slow!
 			//id[i] = bytes.Fields(record[i])[0]
 			if len(record[i]) < ulid.EncodedSize {
-				panic("short record")
+				return segmentError{i, corruptf("short record %q", record[i])}
 			}
 			id[i] = record[i][:ulid.EncodedSize]
 		} else if err := scanner[i].Err(); err != nil && err != io.EOF {
-			return err
+			return segmentError{i, err}
 		}
 		return nil
 	}
@@ -121,9 +133,10 @@ func mergeRecords(w io.Writer, readers ...io.Reader) (low, high ulid.ULID, n int
 }
 
 // mergeRecordsToLog is a specialization of mergeRecords.
-// It enforces segmentTargetSize by creating WriteSegments as necessary.
+// It enforces segmentTargetSize by creating WriteSegments with create as
+// necessary.
 // It has best-effort semantics, e.g. it won't split large records.
-func mergeRecordsToLog(dst Log, segmentTargetSize int64, readers ...io.Reader) (n int64, err error) {
+func mergeRecordsToLog(create func() (WriteSegment, error), segmentTargetSize int64, readers ...io.Reader) (n int64, err error) {
 	// Optimization and safety.
 	if len(readers) == 0 {
 		return 0, nil
@@ -139,7 +152,7 @@ func mergeRecordsToLog(dst Log, segmentTargetSize int64, readers ...io.Reader) (
 	readers = notnil
 
 	// Per-segment state.
-	writeSegment, err := dst.Create()
+	writeSegment, err := create()
 	if err != nil {
 		return n, err
 	}
@@ -173,11 +186,11 @@ func mergeRecordsToLog(dst Log, segmentTargetSize int64, readers ...io.Reader) (
 			// Something nice, like bytes.Fields, is too slow!
 			//id[i] = bytes.Fields(record[i])[0]
 			if len(record[i]) < ulid.EncodedSize {
-				panic("short record")
+				return segmentError{i, corruptf("short record %q", record[i])}
 			}
 			id[i] = record[i][:ulid.EncodedSize]
 		} else if err := scanner[i].Err(); err != nil && err != io.EOF {
-			return err
+			return segmentError{i, err}
 		}
 		return nil
 	}
@@ -240,7 +253,7 @@ func mergeRecordsToLog(dst Log, segmentTargetSize int64, readers ...io.Reader) (
 			}
 
 			// Create a new segment, and reset our per-segment state.
-			writeSegment, err = dst.Create()
+			writeSegment, err = create()
 			if err != nil {
 				return n, err
 			}
@@ -415,21 +428,35 @@ type readSegment struct {
 
 // mergeReadCloser performs a K-way merge from multiple readers.
 type mergeReadCloser struct {
-	close   []io.Closer
-	scanner []*bufio.Scanner
-	ok      []bool
-	record  [][]byte
-	id      [][]byte
+	close     []io.Closer
+	scanner   []*bufio.Scanner
+	ok        []bool
+	record    [][]byte
+	id        [][]byte
+	out       []byte // the current record, partially yielded
+	desc      bool   // readers, and output, are newest first
+	remaining int    // records until EOF, if limited
+	limited   bool
 }
 
 func newMergeReadCloser(rcs []io.ReadCloser) (io.ReadCloser, error) {
+	return newLimitedMergeReadCloser(rcs, false, 0)
+}
+
+// newLimitedMergeReadCloser merges readers whose records are all in the same
+// order: oldest first, or newest first if desc is true. It yields at most
+// limit records, unless limit is zero.
+func newLimitedMergeReadCloser(rcs []io.ReadCloser, desc bool, limit int) (io.ReadCloser, error) {
 	// Initialize our state.
 	rc := &mergeReadCloser{
-		close:   make([]io.Closer, len(rcs)),
-		scanner: make([]*bufio.Scanner, len(rcs)),
-		ok:      make([]bool, len(rcs)),
-		record:  make([][]byte, len(rcs)),
-		id:      make([][]byte, len(rcs)),
+		close:     make([]io.Closer, len(rcs)),
+		scanner:   make([]*bufio.Scanner, len(rcs)),
+		ok:        make([]bool, len(rcs)),
+		record:    make([][]byte, len(rcs)),
+		id:        make([][]byte, len(rcs)),
+		desc:      desc,
+		remaining: limit,
+		limited:   limit > 0,
 	}
 
 	// Initialize all of the scanners and their first record.
@@ -452,17 +479,34 @@ func newMergeReadCloser(rcs []io.ReadCloser) (io.ReadCloser, error) {
 }
 
 func (rc *mergeReadCloser) Read(p []byte) (int, error) {
-	// Pick the source with the smallest ID.
+	// Finish the current record, if it didn't fit in the last read.
+	if len(rc.out) > 0 {
+		n := copy(p, rc.out)
+		rc.out = rc.out[n:]
+		return n, nil
+	}
+	if rc.limited && rc.remaining <= 0 {
+		return 0, io.EOF // we have enough
+	}
+
+	// Pick the source with the smallest ID, or largest, if descending.
 	// TODO(pb): could be improved with an e.g. tournament tree
 	smallest := -1 // index
 	for i := range rc.id {
 		if !rc.ok[i] {
 			continue // already drained
 		}
+		var cmp int
+		if smallest >= 0 {
+			cmp = bytes.Compare(rc.id[i], rc.id[smallest])
+			if rc.desc {
+				cmp = -cmp
+			}
+		}
 		switch {
-		case smallest < 0, bytes.Compare(rc.id[i], rc.id[smallest]) < 0:
+		case smallest < 0, cmp < 0:
 			smallest = i
-		case bytes.Compare(rc.id[i], rc.id[smallest]) == 0: // duplicate
+		case cmp == 0: // duplicate
 			if err := rc.advance(i); err != nil {
 				return 0, err
 			}
@@ -473,11 +517,13 @@ func (rc *mergeReadCloser) Read(p []byte) (int, error) {
 		return 0, io.EOF // everything is drained
 	}
 
-	// Copy the record over.
+	// Copy the record over. Whatever doesn't fit is kept for the next read,
+	// as the scanner reuses its buffer once it advances.
 	n := copy(p, rc.record[smallest])
 	if n < len(rc.record[smallest]) {
-		return n, ErrShortRead
+		rc.out = append(rc.out[:0], rc.record[smallest][n:]...)
 	}
+	rc.remaining--
 
 	// Advance the chosen source.
 	if err := rc.advance(smallest); err != nil {
@@ -577,3 +623,27 @@ func max(a, b string) string {
 	}
 	return b
 }
+
+// readPage reads a limited result. If it has limit records, there may be
+// more, so next is the ULID of the last one, where the next page starts.
+func readPage(r io.Reader, limit int) (next string, buf []byte, err error) {
+	if buf, err = ioutil.ReadAll(r); err != nil {
+		return "", nil, err
+	}
+	var (
+		n    int
+		last []byte
+	)
+	for rest := buf; len(rest) > 0; n++ {
+		last = rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			rest = rest[i+1:]
+		} else {
+			rest = nil
+		}
+	}
+	if n >= limit && len(last) >= ulid.EncodedSize {
+		next = string(last[:ulid.EncodedSize])
+	}
+	return next, buf, nil
+}
@@ -140,7 +140,7 @@ func TestMergeRecordsToLog(t *testing.T) {
 		}
 	)
 
-	n, err := mergeRecordsToLog(dst, segmentTargetSize, readers...)
+	n, err := mergeRecordsToLog(dst.Create, segmentTargetSize, readers...)
 	if err != nil {
 		t.Error(err)
 	}
@@ -200,7 +200,7 @@ func BenchmarkMergeRecordsToLog(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if n, err := mergeRecordsToLog(dst, segmentTargetSize, readers...); err != nil {
+		if n, err := mergeRecordsToLog(dst.Create, segmentTargetSize, readers...); err != nil {
 			b.Errorf("n=%d err=%v", n, err)
 		}
 	}
@@ -351,6 +351,79 @@ func TestMergeReadCloser(t *testing.T) {
 	}
 }
 
+func TestLimitedMergeReadCloser(t *testing.T) {
+	t.Parallel()
+
+	var (
+		u100 = ulid.MustNew(100, nil).String() + "\n"
+		u150 = ulid.MustNew(150, nil).String() + "\n"
+		u200 = ulid.MustNew(200, nil).String() + "\n"
+		u250 = ulid.MustNew(250, nil).String() + "\n"
+		u300 = ulid.MustNew(300, nil).String() + "\n"
+	)
+	for _, testcase := range []struct {
+		name  string
+		input [][]string
+		desc  bool
+		limit int
+		want  []string
+	}{
+		{"asc limited", [][]string{{u100, u200, u300}, {u150, u250}}, false, 3, []string{u100, u150, u200}},
+		{"asc under limit", [][]string{{u100}, {u150}}, false, 3, []string{u100, u150}},
+		{"desc", [][]string{{u300, u200, u100}, {u250, u150}}, true, 0, []string{u300, u250, u200, u150, u100}},
+		{"desc limited", [][]string{{u300, u200, u100}, {u250, u150}}, true, 2, []string{u300, u250}},
+		{"desc duplicates", [][]string{{u300, u200}, {u300, u250, u200}}, true, 3, []string{u300, u250, u200}},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			rcs := make([]io.ReadCloser, len(testcase.input))
+			for i, segment := range testcase.input {
+				rcs[i] = ioutil.NopCloser(strings.NewReader(strings.Join(segment, "")))
+			}
+			rc, err := newLimitedMergeReadCloser(rcs, testcase.desc, testcase.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have := []string{}
+			s := bufio.NewScanner(rc)
+			s.Split(scanLinesPreserveNewline)
+			for s.Scan() {
+				have = append(have, s.Text())
+			}
+			if want := testcase.want; !reflect.DeepEqual(want, have) {
+				t.Fatalf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	t.Parallel()
+
+	var (
+		u100 = ulid.MustNew(100, nil).String()
+		u200 = ulid.MustNew(200, nil).String()
+		page = u100 + " a\n" + u200 + " b\n"
+	)
+	for _, testcase := range []struct {
+		limit int
+		next  string
+	}{
+		{2, u200},
+		{3, ""},
+	} {
+		next, buf, err := readPage(strings.NewReader(page), testcase.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := testcase.next, next; want != have {
+			t.Errorf("limit %d: want next %q, have %q", testcase.limit, want, have)
+		}
+		if want, have := page, string(buf); want != have {
+			t.Errorf("limit %d: want %q, have %q", testcase.limit, want, have)
+		}
+	}
+}
+
 // NOTE(tsenart): Profiling the benchmark with already generated test data
 // yields more meaningful and easy to understand results.
 //
@@ -553,6 +626,10 @@ func (log *mockLog) Create() (WriteSegment, error) {
 	return &mockWriteSegment{log.Buffer}, nil
 }
 
+func (log *mockLog) CreateCompressed() (WriteSegment, error) {
+	return log.Create()
+}
+
 func (log *mockLog) Query(qp QueryParams, statsOnly bool) (QueryResult, error) {
 	return QueryResult{}, errors.New("not implemented")
 }
@@ -573,6 +650,14 @@ func (log *mockLog) Purgeable(oldestModTime time.Time) ([]TrashSegment, error) {
 	return nil, errors.New("not implemented")
 }
 
+func (log *mockLog) Scrubbable(after string) (string, ReadSegment, error) {
+	return "", nil, errors.New("not implemented")
+}
+
+func (log *mockLog) Inventory() ([]InventorySegment, error) {
+	return nil, errors.New("not implemented")
+}
+
 func (log *mockLog) Stats() (LogStats, error) {
 	return LogStats{}, errors.New("not implemented")
 }
@@ -0,0 +1,483 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+)
+
+// Stores serve inventories of their segments, and each store's Repairer
+// gathers them all, finds the records that fewer than the replication factor
+// of stores have, and replicates those it has again. So a store that loses its
+// disk is refilled by its peers.
+//
+// Inventories only have the time ranges of segments, so a store is taken to
+// have every record in the range of each of its segments. That's not always so,
+// as segments from different batches overlap, so repair is a backstop to the
+// replication done by the Consumers, not a substitute for it.
+//
+// With a ring, records belong on the stores that own them, so instead each
+// Repairer copies records to the owners that don't have them. That's how the
+// records move when stores join or leave, and the ring changes.
+
+// Inventory of the segments of a store, as served by its API.
+type Inventory struct {
+	Peer     string             `json:"peer"` // name in the cluster
+	Segments []InventorySegment `json:"segments"`
+}
+
+// Repairer periodically re-replicates the records of the log that are
+// under-replicated in the cluster.
+type Repairer struct {
+	peer              ClusterPeer
+	log               Log
+	client            Doer
+	segmentTargetSize int64
+	replicationFactor int
+	ring              *Ring
+	interval          time.Duration
+	retain            time.Duration
+	stop              chan chan struct{}
+	repairedSegments  prometheus.Counter
+	repairedBytes     prometheus.Counter
+	reporter          EventReporter
+}
+
+// NewRepairer creates a Repairer, which repairs every interval. It leaves the
+// records younger than interval to the Consumers, and those that are about to
+// fall out of the retention period alone. If ring isn't nil, it repairs the
+// placement of records in it, too. Don't forget to Run it.
+func NewRepairer(
+	peer ClusterPeer,
+	log Log,
+	client Doer,
+	segmentTargetSize int64,
+	replicationFactor int,
+	ring *Ring,
+	interval, retain time.Duration,
+	repairedSegments, repairedBytes prometheus.Counter,
+	reporter EventReporter,
+) *Repairer {
+	return &Repairer{
+		peer:              peer,
+		log:               log,
+		client:            client,
+		segmentTargetSize: segmentTargetSize,
+		replicationFactor: replicationFactor,
+		ring:              ring,
+		interval:          interval,
+		retain:            retain,
+		stop:              make(chan chan struct{}),
+		repairedSegments:  repairedSegments,
+		repairedBytes:     repairedBytes,
+		reporter:          reporter,
+	}
+}
+
+// Run repairs the log.
+// Run returns when Stop is invoked.
+func (r *Repairer) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.repair()
+
+		case q := <-r.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the repairer from repairing.
+func (r *Repairer) Stop() {
+	defer func(begin time.Time) {
+		r.reporter.ReportEvent(Event{
+			Debug: true, Op: "Stop",
+			Msg: fmt.Sprintf("shutdown took %s", time.Since(begin)),
+		})
+	}(time.Now())
+	q := make(chan struct{})
+	r.stop <- q
+	<-q
+}
+
+// repair replicates the under-replicated records of the log, where this store
+// is the one of their holders with the least name, so it's done just once.
+func (r *Repairer) repair() {
+	stores := r.peer.Current(cluster.PeerTypeStore)
+	inventories, err := r.gatherInventories(stores)
+	if err != nil {
+		// Without every inventory, records would seem to be missing.
+		r.reporter.ReportEvent(Event{
+			Op: "repair", Error: err,
+			Msg: "failed to gather inventories; will retry",
+		})
+		return
+	}
+
+	var (
+		self   = r.peer.Name()
+		zones  = r.peer.Zones(cluster.PeerTypeStore)
+		now    = ulid.Timestamp(time.Now())
+		newest = now - millis(r.interval)
+		oldest = uint64(0)
+		ranges []misplacedRange
+	)
+	if r.retain > 0 {
+		oldest = now - millis(r.retain) + millis(r.interval)
+	}
+	ring := r.ring.agreed(r.peer.RingBuckets(cluster.PeerTypeStore), stores, "repair", r.reporter)
+	if ring != nil {
+		ranges = misplaced(inventories, ring, stores, zones)
+	} else {
+		for _, rr := range underReplicated(inventories, r.replicationFactor) {
+			ranges = append(ranges, misplacedRange{rr, nil})
+		}
+	}
+	for _, mr := range ranges {
+		rr := mr.repairRange
+		repairer := rr.holders[0]
+		for _, holder := range rr.holders[1:] {
+			if inventories[holder].Peer < inventories[repairer].Peer {
+				repairer = holder
+			}
+		}
+		if inventories[repairer].Peer != self {
+			continue // someone else's
+		}
+		if rr.from < oldest {
+			rr.from = oldest
+		}
+		if rr.to > newest {
+			rr.to = newest
+		}
+		if rr.from > rr.to {
+			continue
+		}
+
+		targets := mr.targets
+		if ring == nil {
+			for _, i := range rand.Perm(len(stores)) {
+				if !contains(rr.holders, stores[i]) {
+					targets = append(targets, stores[i])
+				}
+			}
+			targets = spreadZones(targets, zones, rr.holders)
+			want := r.replicationFactor - len(rr.holders)
+			if len(targets) < want {
+				r.reporter.ReportEvent(Event{
+					Op: "repair", Warning: fmt.Errorf("want %d more copies, have %d stores without one", want, len(targets)),
+				})
+			} else {
+				targets = targets[:want]
+			}
+		}
+		if len(targets) <= 0 {
+			continue
+		}
+		if err := r.replicate(rr.from, rr.to, targets); err != nil {
+			r.reporter.ReportEvent(Event{
+				Op: "repair", Error: err,
+				Msg: fmt.Sprintf("failed to replicate records from %s to %s", msTime(rr.from), msTime(rr.to)),
+			})
+		}
+	}
+}
+
+// gatherInventories from every store. It fails if any of them does.
+func (r *Repairer) gatherInventories(stores []string) (map[string]Inventory, error) {
+	type response struct {
+		store     string
+		inventory Inventory
+		err       error
+	}
+	c := make(chan response, len(stores))
+	for _, store := range stores {
+		go func(store string) {
+			inventory, err := r.getInventory(store)
+			c <- response{store, inventory, err}
+		}(store)
+	}
+	var (
+		inventories = make(map[string]Inventory, len(stores))
+		firstErr    error
+	)
+	for range stores {
+		response := <-c
+		if response.err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(response.err, "store %s", response.store)
+		}
+		inventories[response.store] = response.inventory
+	}
+	return inventories, firstErr
+}
+
+func (r *Repairer) getInventory(store string) (Inventory, error) {
+	var inventory Inventory
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/store%s", store, APIPathInventory), nil)
+	if err != nil {
+		return inventory, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return inventory, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return inventory, errors.New(resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&inventory)
+	return inventory, err
+}
+
+// replicate the records of the log from and to the given milliseconds,
+// inclusive, to the targets, in segments of about the target size.
+func (r *Repairer) replicate(from, to uint64, targets []string) error {
+	var qp QueryParams
+	if err := qp.From.Parse(msULID(from).String()); err != nil {
+		return err
+	}
+	if err := qp.To.Parse(msULID(to).String()); err != nil {
+		return err
+	}
+	result, err := r.log.Query(qp, false)
+	if err != nil {
+		return err
+	}
+	defer result.Records.Close()
+
+	var (
+		br    = bufio.NewReader(result.Records)
+		batch bytes.Buffer
+	)
+	for {
+		record, err := br.ReadBytes('\n') // with the newline
+		batch.Write(record)
+		if batch.Len() >= int(r.segmentTargetSize) || (err == io.EOF && batch.Len() > 0) {
+			for _, target := range targets {
+				if err := r.post(target, batch.Bytes()); err != nil {
+					r.reporter.ReportEvent(Event{
+						Op: "repair", Error: err,
+						Msg: fmt.Sprintf("target %s, during %s", target, APIPathReplicate),
+					})
+					continue // the next round will try again
+				}
+				r.repairedSegments.Inc()
+				r.repairedBytes.Add(float64(batch.Len()))
+			}
+			batch.Reset()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Repairer) post(target string, segment []byte) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/store%s", target, APIPathReplicate), bytes.NewReader(segment))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/binary")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// repairRange is a range of time that some stores have the records of.
+type repairRange struct {
+	from, to uint64   // milliseconds, inclusive
+	holders  []string // stores, sorted
+}
+
+// underReplicated returns the ranges of time that fewer than factor stores,
+// but at least one, have the records of.
+func underReplicated(inventories map[string]Inventory, factor int) []repairRange {
+	var ranges []repairRange
+	for _, rr := range holdings(inventories, 0) {
+		if len(rr.holders) >= factor {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].to+1 == rr.from && equalStrings(ranges[n-1].holders, rr.holders) {
+			ranges[n-1].to = rr.to
+			continue
+		}
+		ranges = append(ranges, rr)
+	}
+	return ranges
+}
+
+// misplacedRange is a range of time that some owners in a ring don't have the
+// records of.
+type misplacedRange struct {
+	repairRange
+	targets []string // owners without the records, sorted
+}
+
+// misplaced returns the ranges of time that at least one store has the records
+// of, but not every one of their owners in the ring does.
+func misplaced(inventories map[string]Inventory, ring *Ring, stores []string, zones map[string]string) []misplacedRange {
+	var ranges []misplacedRange
+	for _, rr := range holdings(inventories, ring.width) {
+		var targets []string
+		for _, owner := range ring.owners(stores, zones, ring.bucket(rr.from)) {
+			if !contains(rr.holders, owner) {
+				targets = append(targets, owner)
+			}
+		}
+		if len(targets) <= 0 {
+			continue
+		}
+		sort.Strings(targets)
+		if n := len(ranges); n > 0 && ranges[n-1].to+1 == rr.from && equalStrings(ranges[n-1].holders, rr.holders) && equalStrings(ranges[n-1].targets, targets) {
+			ranges[n-1].to = rr.to
+			continue
+		}
+		ranges = append(ranges, misplacedRange{rr, targets})
+	}
+	return ranges
+}
+
+// holdings returns the ranges of time that some stores have the records of,
+// each with the stores that have all of it. The ranges are cut at multiples
+// of split milliseconds, if it's positive, and otherwise wherever the stores
+// that have them change. Consecutive ranges may have the same stores.
+func holdings(inventories map[string]Inventory, split uint64) []repairRange {
+	// Each store has the union of the ranges of its segments.
+	var (
+		stores   = make([]string, 0, len(inventories))
+		coverage = make(map[string][]msSpan, len(inventories))
+		points   []uint64
+	)
+	for store, inventory := range inventories {
+		stores = append(stores, store)
+		spans := make([]msSpan, 0, len(inventory.Segments))
+		for _, segment := range inventory.Segments {
+			from, to := segment.Low.Time(), segment.High.Time()
+			if from > to {
+				from, to = to, from // records of the same millisecond
+			}
+			spans = append(spans, msSpan{from, to})
+			points = append(points, from, to+1)
+		}
+		coverage[store] = mergeSpans(spans)
+	}
+	sort.Strings(stores)
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	if n := len(points); split > 0 && n > 0 {
+		for p := (points[0]/split + 1) * split; p < points[n-1]; p += split {
+			points = append(points, p)
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	}
+
+	// Between consecutive points, each store has all of the range, or none.
+	var (
+		ranges []repairRange
+		next   = make(map[string]int, len(stores)) // span of each store
+	)
+	for i := 0; i+1 < len(points); i++ {
+		if points[i] == points[i+1] {
+			continue
+		}
+		from, to := points[i], points[i+1]-1
+		var holders []string
+		for _, store := range stores {
+			spans, j := coverage[store], next[store]
+			for j < len(spans) && spans[j].to < from {
+				j++
+			}
+			next[store] = j
+			if j < len(spans) && spans[j].from <= from {
+				holders = append(holders, store)
+			}
+		}
+		if len(holders) <= 0 {
+			continue
+		}
+		ranges = append(ranges, repairRange{from, to, holders})
+	}
+	return ranges
+}
+
+// msSpan is a range of milliseconds, inclusive.
+type msSpan struct{ from, to uint64 }
+
+// mergeSpans sorts spans, and merges those that overlap or abut.
+func mergeSpans(spans []msSpan) []msSpan {
+	if len(spans) <= 0 {
+		return spans
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].from < spans[j].from })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if s.from > last.to+1 {
+			merged = append(merged, s)
+			continue
+		}
+		if s.to > last.to {
+			last.to = s.to
+		}
+	}
+	return merged
+}
+
+func millis(d time.Duration) uint64 {
+	return uint64(d / time.Millisecond)
+}
+
+func msULID(ms uint64) ulid.ULID {
+	var id ulid.ULID
+	id.SetTime(ms)
+	return id
+}
+
+func msTime(ms uint64) string {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+}
+
+func contains(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
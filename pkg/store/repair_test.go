@@ -0,0 +1,245 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/cluster"
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestUnderReplicated(t *testing.T) {
+	t.Parallel()
+
+	segment := func(from, to uint64) InventorySegment {
+		return InventorySegment{Low: msULID(from), High: msULID(to)}
+	}
+	for _, testcase := range []struct {
+		name        string
+		inventories map[string]Inventory
+		want        []repairRange
+	}{
+		{
+			name: "fully replicated",
+			inventories: map[string]Inventory{
+				"a": {Segments: []InventorySegment{segment(0, 9), segment(10, 19)}},
+				"b": {Segments: []InventorySegment{segment(0, 19)}},
+			},
+		},
+		{
+			name: "one copy of the middle",
+			inventories: map[string]Inventory{
+				"a": {Segments: []InventorySegment{segment(0, 29)}},
+				"b": {Segments: []InventorySegment{segment(0, 9), segment(20, 29)}},
+			},
+			want: []repairRange{{10, 19, []string{"a"}}},
+		},
+		{
+			name: "lost disk",
+			inventories: map[string]Inventory{
+				"a": {Segments: []InventorySegment{segment(0, 9), segment(5, 19)}},
+				"b": {Segments: []InventorySegment{segment(30, 39)}},
+				"c": {},
+			},
+			want: []repairRange{{0, 19, []string{"a"}}, {30, 39, []string{"b"}}},
+		},
+		{
+			name: "different holders",
+			inventories: map[string]Inventory{
+				"a": {Segments: []InventorySegment{segment(0, 9)}},
+				"b": {Segments: []InventorySegment{segment(10, 19)}},
+				"c": {},
+			},
+			want: []repairRange{{0, 9, []string{"a"}}, {10, 19, []string{"b"}}},
+		},
+	} {
+		if have := underReplicated(testcase.inventories, 2); !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("%s: want %v, have %v", testcase.name, testcase.want, have)
+		}
+	}
+}
+
+func TestMisplaced(t *testing.T) {
+	t.Parallel()
+
+	var (
+		stores = []string{"a", "b", "c"}
+		ring   = NewRing(time.Minute, 1)
+		minute = millis(time.Minute)
+	)
+	segment := func(from, to uint64) InventorySegment {
+		return InventorySegment{Low: msULID(from), High: msULID(to)}
+	}
+	owner := func(ms uint64) string {
+		return ring.owners(stores, nil, ring.bucket(ms))[0]
+	}
+
+	// Store a has the first two minutes, and b the third, wherever they belong.
+	inventories := map[string]Inventory{
+		"a": {Segments: []InventorySegment{segment(0, 2*minute-1)}},
+		"b": {Segments: []InventorySegment{segment(2*minute, 3*minute-1)}},
+		"c": {},
+	}
+	var want []misplacedRange
+	for m := uint64(0); m < 3; m++ {
+		holder := "a"
+		if m == 2 {
+			holder = "b"
+		}
+		if owner(m*minute) == holder {
+			continue
+		}
+		rr := misplacedRange{repairRange{m * minute, (m+1)*minute - 1, []string{holder}}, []string{owner(m * minute)}}
+		if n := len(want); n > 0 && want[n-1].to+1 == rr.from && equalStrings(want[n-1].holders, rr.holders) && equalStrings(want[n-1].targets, rr.targets) {
+			want[n-1].to = rr.to
+			continue
+		}
+		want = append(want, rr)
+	}
+	if have := misplaced(inventories, ring, stores, nil); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Once every owner has its records, nothing is misplaced.
+	for m := uint64(0); m < 3; m++ {
+		o := owner(m * minute)
+		inventory := inventories[o]
+		inventory.Segments = append(inventory.Segments, segment(m*minute, (m+1)*minute-1))
+		inventories[o] = inventory
+	}
+	if have := misplaced(inventories, ring, stores, nil); len(have) != 0 {
+		t.Errorf("want nothing misplaced, have %v", have)
+	}
+}
+
+func TestRepairer(t *testing.T) {
+	t.Parallel()
+
+	// Three stores, of which a has all the records, b some, and c none.
+	var (
+		names     = []string{"a", "b", "c"}
+		filelogs  = map[string]Log{}
+		stores    []string
+		t0        = time.Now().Add(-time.Hour)
+		duration  = prometheus.NewHistogramVec(prometheus.HistogramOpts{}, []string{"method", "path", "status_code"})
+		nopMetric = prometheus.NewCounter(prometheus.CounterOpts{})
+	)
+	for _, name := range names {
+		filelog, err := NewFileLog(fs.NewVirtualFilesystem(), "/", 64*1024*1024, 1024, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer filelog.Close()
+		api := NewAPI(&repairPeer{name, &stores, 0}, filelog, mockDoer{}, mockDoer{}, nil, nopMetric, nopMetric, duration, &eventRecorder{})
+		defer api.Close()
+		server := httptest.NewServer(http.StripPrefix("/store", api))
+		defer server.Close()
+		filelogs[name] = filelog
+		stores = append(stores, strings.TrimPrefix(server.URL, "http://"))
+	}
+	writeSegment := func(name string, from, to int) {
+		segment, err := filelogs[name].Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lo, hi ulid.ULID
+		for ms := from; ms <= to; ms++ {
+			id := ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(ms)*time.Millisecond)), nil)
+			fmt.Fprintf(segment, "%s record %d\n", id, ms)
+			if ms == from {
+				lo = id
+			}
+			hi = id
+		}
+		if err := segment.Close(lo, hi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSegment("a", 0, 9)
+	writeSegment("a", 10, 19)
+	writeSegment("b", 0, 9)
+
+	records := func(name string) int {
+		var qp QueryParams
+		qp.From.Parse(t0.Add(-time.Minute).Format(time.RFC3339))
+		qp.To.Parse(time.Now().Format(time.RFC3339))
+		result, err := filelogs[name].Query(qp, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer result.Records.Close()
+		buf, err := ioutil.ReadAll(result.Records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(buf), "\n")
+	}
+
+	// Only a has records 10-19, so only a repairs them, to b or c.
+	var repaired [3]*countingCounter
+	for i, name := range []string{"c", "b", "a"} {
+		repaired[i] = &countingCounter{}
+		r := NewRepairer(
+			&repairPeer{name, &stores, 0}, filelogs[name], http.DefaultClient,
+			64*1024*1024, 2, nil, time.Minute, 24*time.Hour,
+			repaired[i], nopMetric, &eventRecorder{},
+		)
+		r.repair()
+	}
+	if want, have := 1, repaired[0].n+repaired[1].n+repaired[2].n; want != have {
+		t.Fatalf("want %d segment repaired, have %d", want, have)
+	}
+	if want, have := 1, repaired[2].n; want != have {
+		t.Errorf("want %d segment repaired by a, have %d", want, have)
+	}
+	if want, have := 20, records("b")+records("c"); want != have {
+		t.Errorf("want %d records in b and c, have %d", want, have)
+	}
+
+	// Now it's fully replicated.
+	r := NewRepairer(
+		&repairPeer{"a", &stores, 0}, filelogs["a"], http.DefaultClient,
+		64*1024*1024, 2, nil, time.Minute, 24*time.Hour,
+		repaired[2], nopMetric, &eventRecorder{},
+	)
+	r.repair()
+	if want, have := 1, repaired[2].n; want != have {
+		t.Errorf("want %d segment repaired by a, have %d", want, have)
+	}
+
+	// Nothing is repaired if an inventory is missing.
+	stores = append(stores, "127.0.0.1:1")
+	writeSegment("a", 20, 29)
+	r.repair()
+	if want, have := 1, repaired[2].n; want != have {
+		t.Errorf("want %d segment repaired by a, have %d", want, have)
+	}
+}
+
+type repairPeer struct {
+	name   string
+	stores *[]string
+	ring   time.Duration // of every store
+}
+
+func (p *repairPeer) Current(cluster.PeerType) []string        { return *p.stores }
+func (p *repairPeer) Zones(cluster.PeerType) map[string]string { return map[string]string{} }
+func (p *repairPeer) RingBuckets(cluster.PeerType) map[string]time.Duration {
+	res := map[string]time.Duration{}
+	for _, store := range *p.stores {
+		res[store] = p.ring
+	}
+	return res
+}
+func (p *repairPeer) Name() string                   { return p.name }
+func (p *repairPeer) SetPlacement(cluster.Placement) {}
+func (p *repairPeer) State() map[string]interface{}  { return map[string]interface{}{} }
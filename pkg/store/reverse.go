@@ -0,0 +1,209 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// reverseBlockSize is how much of a segment file we read at a time, from the
+// end, when reading it backwards.
+const reverseBlockSize = 64 * 1024
+
+// newReverseQueryReadCloser is like newQueryReadCloser, but yields records
+// newest first. Segments are read backwards, and only on demand, newest batch
+// first, so a reader that stops early never touches the older segments.
+// Records of an unsorted segment, until the Scrubber sorts it, are yielded
+// backwards as they were written, so they may be out of order.
+func newReverseQueryReadCloser(segments []readSegment, pass recordFilter, reporter EventReporter) (rc io.ReadCloser, sz int64) {
+	var (
+		batches = batchSegments(segments)
+		rcs     = make([]io.ReadCloser, 0, len(batches))
+	)
+	for i := len(batches) - 1; i >= 0; i-- {
+		batch := batches[i]
+		for _, segment := range batch {
+			sz += segment.size
+		}
+		rcs = append(rcs, &lazyReadCloser{
+			segments: batch,
+			open: func() (io.ReadCloser, error) {
+				readers := make([]io.ReadCloser, len(batch))
+				for i, segment := range batch {
+					readers[i] = newReverseFilteringReadCloser(segment, pass)
+				}
+				if len(readers) == 1 {
+					return readers[0], nil // no need to merge
+				}
+				return newLimitedMergeReadCloser(readers, true, 0)
+			},
+			reporter: reporter,
+		})
+	}
+	return newMultiReadCloser(rcs...), sz
+}
+
+// lazyReadCloser opens its reader on the first read. If it's never read, the
+// segments are closed directly.
+type lazyReadCloser struct {
+	segments []readSegment
+	open     func() (io.ReadCloser, error)
+	rc       io.ReadCloser
+	reporter EventReporter
+}
+
+func (l *lazyReadCloser) Read(p []byte) (int, error) {
+	if l.rc == nil {
+		rc, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		l.rc = rc
+	}
+	return l.rc.Read(p)
+}
+
+func (l *lazyReadCloser) Close() error {
+	if l.rc != nil {
+		return l.rc.Close()
+	}
+	closers := make(multiCloser, len(l.segments))
+	for i, segment := range l.segments {
+		closers[i] = segment.file
+	}
+	if err := closers.Close(); err != nil {
+		l.reporter.ReportEvent(Event{
+			Op: "lazyReadCloser", Error: err,
+			Msg: fmt.Sprintf("Close of %d unread segment(s) failed", len(l.segments)),
+		})
+		return err
+	}
+	return nil
+}
+
+// newReverseFilteringReadCloser yields the records of the segment that pass
+// the filter, newest first. Segment files are written oldest first, so it
+// reads them backwards, a block at a time.
+func newReverseFilteringReadCloser(segment readSegment, pass recordFilter) io.ReadCloser {
+	return &reverseFilteringReadCloser{
+		src:  segment.file,
+		size: segment.size,
+		off:  segment.size,
+		pass: pass,
+	}
+}
+
+type reverseFilteringReadCloser struct {
+	src     io.ReadCloser
+	ra      io.ReaderAt // src, once we need it
+	size    int64
+	off     int64  // of the start of pending in the file
+	pending []byte // read, but not yet yielded
+	out     []byte // the current record, partially yielded
+	pass    recordFilter
+	err     error
+}
+
+func (r *reverseFilteringReadCloser) Read(p []byte) (int, error) {
+	for len(r.out) <= 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		record, err := r.prev()
+		if err != nil {
+			r.err = err
+			continue
+		}
+		if r.pass(record) {
+			r.out = record
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// prev returns the last record that hasn't been returned yet, with its
+// trailing newline.
+func (r *reverseFilteringReadCloser) prev() ([]byte, error) {
+	for {
+		// The record starts after the last newline but one, its own.
+		i := -1
+		if len(r.pending) > 1 {
+			i = bytes.LastIndexByte(r.pending[:len(r.pending)-1], '\n')
+		}
+		if i >= 0 {
+			record := r.pending[i+1:]
+			r.pending = r.pending[:i+1]
+			return record, nil
+		}
+		if r.off <= 0 {
+			if len(r.pending) > 0 {
+				record := r.pending
+				r.pending = nil
+				return record, nil
+			}
+			return nil, io.EOF
+		}
+		if err := r.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readBlock reads the block before pending, and prepends it.
+func (r *reverseFilteringReadCloser) readBlock() error {
+	if r.ra == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	n := int64(reverseBlockSize)
+	if n > r.off {
+		n = r.off
+	}
+	block := make([]byte, n, n+int64(len(r.pending)))
+	if err := r.readAt(block, r.off-n); err != nil {
+		return err
+	}
+	if r.off == r.size && n > 0 && block[n-1] != '\n' {
+		// The last record of a file may be missing its newline. We add it,
+		// lest the record run into the one that comes out after it.
+		block = append(block, '\n')
+	}
+	r.pending = append(block, r.pending...)
+	r.off -= n
+	return nil
+}
+
+// open the source for reading at offsets. If we can't, we read all of it up
+// front, the only way we can. Then its size is what we read: a compressed
+// segment's records are bigger than its file.
+func (r *reverseFilteringReadCloser) open() error {
+	if ra, ok := r.src.(io.ReaderAt); ok {
+		r.ra = ra
+		return nil
+	}
+	buf, err := ioutil.ReadAll(r.src)
+	if err != nil {
+		return err
+	}
+	r.ra = bytes.NewReader(buf)
+	r.size, r.off = int64(len(buf)), int64(len(buf))
+	return nil
+}
+
+func (r *reverseFilteringReadCloser) readAt(p []byte, off int64) error {
+	if n, err := r.ra.ReadAt(p, off); n < len(p) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF // the file is shorter than its size
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *reverseFilteringReadCloser) Close() error {
+	return r.src.Close()
+}
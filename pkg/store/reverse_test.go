@@ -0,0 +1,116 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/1046102779/ulid"
+)
+
+func TestReverseFilteringReadCloser(t *testing.T) {
+	t.Parallel()
+
+	// Enough records to span a few blocks.
+	var records []string
+	for i := 0; i < 3*reverseBlockSize/32; i++ {
+		records = append(records, fmt.Sprintf("%s record %d\n", ulid.MustNew(uint64(i), nil), i))
+	}
+	want := make([]string, len(records))
+	for i := range records {
+		want[len(records)-1-i] = records[i]
+	}
+	data := strings.Join(records, "")
+
+	for name, file := range map[string]io.ReadCloser{
+		"ReaderAt":      &countingReader{Reader: strings.NewReader(data)},
+		"Reader":        ioutil.NopCloser(onlyReader{strings.NewReader(data)}),
+		"no last '\\n'": &countingReader{Reader: strings.NewReader(strings.TrimSuffix(data, "\n"))},
+	} {
+		size := int64(len(data))
+		if name == "no last '\\n'" {
+			size--
+		}
+		rc := newReverseFilteringReadCloser(readSegment{file: file, size: size}, func([]byte) bool { return true })
+		if have := readLines(t, rc); !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: have %d records, want %d, or they're different", name, len(have), len(want))
+		}
+	}
+}
+
+func TestReverseQueryReadCloser(t *testing.T) {
+	t.Parallel()
+
+	// Two segments which don't overlap, and one that overlaps the newest.
+	var (
+		u = func(ms uint64) string { return ulid.MustNew(ms, nil).String() }
+		a = &countingReader{Reader: strings.NewReader(u(100) + " a\n" + u(200) + " b\n")}
+		b = &countingReader{Reader: strings.NewReader(u(300) + " c\n" + u(500) + " e\n")}
+		c = &countingReader{Reader: strings.NewReader(u(400) + " d\n" + u(600) + " f\n")}
+	)
+	segments := []readSegment{
+		{path: u(100) + "-" + u(200) + extFlushed, file: a, size: a.Size()},
+		{path: u(300) + "-" + u(500) + extFlushed, file: b, size: b.Size()},
+		{path: u(400) + "-" + u(600) + extFlushed, file: c, size: c.Size()},
+	}
+	rc, sz := newReverseQueryReadCloser(segments, func(b []byte) bool { return !bytes.Contains(b, []byte(" e")) }, nil)
+	if want, have := a.Size()+b.Size()+c.Size(), sz; want != have {
+		t.Errorf("size: want %d, have %d", want, have)
+	}
+
+	// The newest records come first, from the newest batch, merged.
+	limited, err := newLimitedMergeReadCloser([]io.ReadCloser{rc}, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{u(600) + " f\n", u(400) + " d\n"}, readLines(t, limited); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if a.reads > 0 {
+		t.Errorf("oldest segment was read %d time(s)", a.reads)
+	}
+	if err := limited.Close(); err != nil {
+		t.Error(err)
+	}
+	for i, r := range []*countingReader{a, b, c} {
+		if !r.closed {
+			t.Errorf("segment %d wasn't closed", i)
+		}
+	}
+}
+
+func readLines(t *testing.T, r io.Reader) []string {
+	var lines []string
+	s := bufio.NewScanner(r)
+	s.Split(scanLinesPreserveNewline)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+type onlyReader struct{ io.Reader }
+
+type countingReader struct {
+	*strings.Reader
+	reads  int
+	closed bool
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *countingReader) Close() error {
+	r.closed = true
+	return nil
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Records may be placed on stores by a consistent-hash ring, rather than on
+// any of them. Time is cut into buckets of a fixed width, and each bucket is
+// owned by as many stores as the replication factor: the first distinct ones
+// from the bucket's hash around the ring, spread across zones. Consumers split
+// segments by bucket, and replicate each part to the owners of its bucket, and
+// queries only go to the owners of the buckets in their range.
+//
+// The ring is derived from the current stores in the cluster, so it changes
+// as they join and leave. The Repairers then copy records to their new
+// owners; until they do, queries may miss some of them.
+//
+// Every store must cut time into buckets of the same width, or they'd place
+// and look for records in different places. Stores gossip their width, and
+// while any of them has another, or none yet, records are placed and queried
+// as if there were no ring.
+
+// ringTokensPerStore is the number of points each store has on the ring, so
+// buckets are spread about evenly among stores.
+const ringTokensPerStore = 64
+
+// Ring places time buckets of records on stores. It's safe for concurrent use.
+type Ring struct {
+	width    uint64 // of a bucket, in milliseconds
+	replicas int
+
+	mtx    sync.Mutex
+	stores []string // the ring is built for, sorted
+	tokens []ringToken
+}
+
+type ringToken struct {
+	hash  uint64
+	store string
+}
+
+// NewRing creates a ring of buckets of the given width, of at least a second,
+// each of which is owned by replicas stores.
+func NewRing(width time.Duration, replicas int) *Ring {
+	if width < time.Second {
+		width = time.Second
+	}
+	return &Ring{
+		width:    millis(width),
+		replicas: replicas,
+	}
+}
+
+// Width returns the width of a bucket, or 0 for a nil Ring.
+func (r *Ring) Width() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return time.Duration(r.width) * time.Millisecond
+}
+
+// agreed returns the ring, if all of the stores have buckets of its width,
+// going by the widths they gossip. Otherwise, it reports why not, and returns
+// nil, so the caller goes without. It's safe to call on a nil Ring.
+func (r *Ring) agreed(widths map[string]time.Duration, stores []string, op string, reporter EventReporter) *Ring {
+	if r == nil {
+		return nil
+	}
+	for _, store := range stores {
+		if width := widths[store]; width != r.Width() {
+			reporter.ReportEvent(Event{
+				Op: op, Warning: fmt.Errorf("store %s has ring buckets %s wide, not %s", store, width, r.Width()),
+				Msg: "going without the ring until the stores agree on it",
+			})
+			return nil
+		}
+	}
+	return r
+}
+
+// bucket returns the bucket of the millisecond.
+func (r *Ring) bucket(ms uint64) uint64 {
+	return ms / r.width
+}
+
+// owners returns the stores that own the bucket, of those given.
+func (r *Ring) owners(stores []string, zones map[string]string, bucket uint64) []string {
+	order := r.walk(stores, bucket)
+	order = spreadZones(order, zones, nil)
+	if len(order) > r.replicas {
+		order = order[:r.replicas]
+	}
+	return order
+}
+
+// ownersOf returns the stores that own any of the buckets from and to the
+// given milliseconds, inclusive, of those given, sorted.
+func (r *Ring) ownersOf(stores []string, zones map[string]string, from, to uint64) []string {
+	if from > to {
+		from, to = to, from
+	}
+	var (
+		owners = map[string]bool{}
+		res    []string
+	)
+	for b := r.bucket(from); b <= r.bucket(to) && len(owners) < len(stores); b++ {
+		for _, store := range r.owners(stores, zones, b) {
+			if !owners[store] {
+				owners[store] = true
+				res = append(res, store)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ringRange is a range of whole buckets, from and to the given milliseconds,
+// inclusive, and one of the stores that own all of them.
+type ringRange struct {
+	store    string
+	from, to uint64
+}
+
+// assign the buckets from and to the given milliseconds, inclusive, to one of
+// their owners each, of the stores given, so every record in the range is in
+// exactly one of the returned ranges. Consecutive buckets stay with the same
+// owner where they can, so there are as few ranges as possible.
+func (r *Ring) assign(stores []string, zones map[string]string, from, to uint64) []ringRange {
+	if from > to {
+		from, to = to, from
+	}
+	var res []ringRange
+	for b := r.bucket(from); b <= r.bucket(to); b++ {
+		owners := r.owners(stores, zones, b)
+		if len(owners) <= 0 {
+			return nil
+		}
+		lo, hi := b*r.width, (b+1)*r.width-1
+		if lo < from {
+			lo = from
+		}
+		if hi > to {
+			hi = to
+		}
+		if n := len(res); n > 0 && contains(owners, res[n-1].store) {
+			res[n-1].to = hi
+			continue
+		}
+		res = append(res, ringRange{owners[0], lo, hi})
+	}
+	return res
+}
+
+// walk returns the distinct stores in the order they're met going around the
+// ring from the bucket's hash.
+func (r *Ring) walk(stores []string, bucket uint64) []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.build(stores)
+
+	var (
+		h     = hashBucket(bucket)
+		start = sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i].hash >= h })
+		seen  = make(map[string]bool, len(r.stores))
+		order = make([]string, 0, len(r.stores))
+	)
+	for i := 0; i < len(r.tokens) && len(order) < len(r.stores); i++ {
+		token := r.tokens[(start+i)%len(r.tokens)]
+		if !seen[token.store] {
+			seen[token.store] = true
+			order = append(order, token.store)
+		}
+	}
+	return order
+}
+
+// build the ring for the stores, unless it's already built for them.
+// Clients must hold the lock.
+func (r *Ring) build(stores []string) {
+	sorted := append([]string(nil), stores...)
+	sort.Strings(sorted)
+	if equalStrings(sorted, r.stores) {
+		return
+	}
+	tokens := make([]ringToken, 0, len(sorted)*ringTokensPerStore)
+	for _, store := range sorted {
+		for i := 0; i < ringTokensPerStore; i++ {
+			h := fnv.New64a()
+			fmt.Fprintf(h, "%s-%d", store, i)
+			tokens = append(tokens, ringToken{mix(h.Sum64()), store})
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].hash != tokens[j].hash {
+			return tokens[i].hash < tokens[j].hash
+		}
+		return tokens[i].store < tokens[j].store
+	})
+	r.stores, r.tokens = sorted, tokens
+}
+
+func hashBucket(bucket uint64) uint64 {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], bucket)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return mix(h.Sum64())
+}
+
+// mix the bits of h, as FNV hashes of similar input, like consecutive buckets,
+// differ mostly in their low bits. It's the finalizer of SplitMix64.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	t.Parallel()
+
+	var (
+		stores  = []string{"s0", "s1", "s2", "s3", "s4"}
+		ring    = NewRing(time.Hour, 2)
+		buckets = 1000
+		owned   = map[string]int{}
+	)
+	for b := 0; b < buckets; b++ {
+		owners := ring.owners(stores, nil, uint64(b))
+		if want, have := 2, len(owners); want != have {
+			t.Fatalf("bucket %d: want %d owners, have %v", b, want, owners)
+		}
+		if owners[0] == owners[1] {
+			t.Fatalf("bucket %d: want distinct owners, have %v", b, owners)
+		}
+		if have := ring.owners([]string{"s4", "s3", "s2", "s1", "s0"}, nil, uint64(b)); !reflect.DeepEqual(owners, have) {
+			t.Fatalf("bucket %d: owners depend on the order of stores: %v, %v", b, owners, have)
+		}
+		for _, owner := range owners {
+			owned[owner]++
+		}
+	}
+	for _, store := range stores {
+		if n, fair := owned[store], 2*buckets/len(stores); n < fair/2 || n > 2*fair {
+			t.Errorf("%s owns %d buckets, want about %d", store, n, fair)
+		}
+	}
+
+	// With one owner per bucket, a store leaving only moves its own buckets.
+	var (
+		single = NewRing(time.Hour, 1)
+		before = map[int]string{}
+	)
+	for b := 0; b < buckets; b++ {
+		before[b] = single.owners(stores, nil, uint64(b))[0]
+	}
+	for b := 0; b < buckets; b++ {
+		if owner := single.owners(stores[:4], nil, uint64(b))[0]; before[b] != "s4" && owner != before[b] {
+			t.Errorf("bucket %d moved from %s to %s", b, before[b], owner)
+		}
+	}
+
+	// Owners are spread across zones.
+	zones := map[string]string{"s0": "a", "s1": "a", "s2": "a", "s3": "b", "s4": "b"}
+	for b := 0; b < buckets; b++ {
+		if owners := ring.owners(stores, zones, uint64(b)); zones[owners[0]] == zones[owners[1]] {
+			t.Fatalf("bucket %d: want owners in different zones, have %v", b, owners)
+		}
+	}
+}
+
+func TestRingOwnersOf(t *testing.T) {
+	t.Parallel()
+
+	var (
+		stores = []string{"s0", "s1", "s2", "s3", "s4"}
+		ring   = NewRing(time.Minute, 1)
+		minute = millis(time.Minute)
+	)
+	for _, testcase := range []struct {
+		from, to uint64
+	}{
+		{0, 0},
+		{10 * minute, 10*minute + 1},
+		{10*minute - 1, 10 * minute},
+		{3 * minute, 5*minute - 1},
+	} {
+		want := map[string]bool{}
+		for b := testcase.from / minute; b <= testcase.to/minute; b++ {
+			want[ring.owners(stores, nil, b)[0]] = true
+		}
+		have := ring.ownersOf(stores, nil, testcase.from, testcase.to)
+		if !sort.StringsAreSorted(have) || len(have) != len(want) {
+			t.Errorf("%d-%d: want %v, have %v", testcase.from, testcase.to, want, have)
+		}
+		for _, store := range have {
+			if !want[store] {
+				t.Errorf("%d-%d: %s doesn't own the range", testcase.from, testcase.to, store)
+			}
+		}
+	}
+
+	// A long range is owned by every store.
+	if want, have := len(stores), len(ring.ownersOf(stores, nil, 0, 24*60*minute)); want != have {
+		t.Errorf("want %d owners of a day, have %d", want, have)
+	}
+	if have := ring.ownersOf(nil, nil, 0, minute); len(have) != 0 {
+		t.Errorf("want no owners without stores, have %v", have)
+	}
+}
+
+func TestRingAssign(t *testing.T) {
+	t.Parallel()
+
+	var (
+		stores   = []string{"s0", "s1", "s2", "s3", "s4"}
+		ring     = NewRing(time.Minute, 2)
+		minute   = millis(time.Minute)
+		from, to = 3*minute + 7, 40*minute + 11
+		ranges   = ring.assign(stores, nil, from, to)
+	)
+
+	// The ranges cover every millisecond once, in order, and each is
+	// assigned to an owner of all of its buckets.
+	next := from
+	for _, rg := range ranges {
+		if rg.from != next || rg.to < rg.from {
+			t.Fatalf("%+v: want it to start at %d", rg, next)
+		}
+		for b := ring.bucket(rg.from); b <= ring.bucket(rg.to); b++ {
+			if owners := ring.owners(stores, nil, b); !contains(owners, rg.store) {
+				t.Errorf("%+v: %s doesn't own bucket %d, %v do", rg, rg.store, b, owners)
+			}
+		}
+		next = rg.to + 1
+	}
+	if want, have := to+1, next; want != have {
+		t.Errorf("ranges end at %d, want %d", have-1, want-1)
+	}
+	if buckets := int(ring.bucket(to) - ring.bucket(from) + 1); len(ranges) >= buckets {
+		t.Errorf("%d ranges for %d buckets; consecutive buckets should share an owner", len(ranges), buckets)
+	}
+
+	// With as many replicas as stores, one store has it all.
+	if ranges := NewRing(time.Minute, len(stores)).assign(stores, nil, from, to); len(ranges) != 1 {
+		t.Errorf("want 1 range, have %+v", ranges)
+	}
+}
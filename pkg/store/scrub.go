@@ -0,0 +1,352 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// scrubRetry is how long the Scrubber waits after failing to get a segment.
+	scrubRetry = time.Minute
+
+	// scrubSortBuffer is how many bytes of records the Scrubber sorts in
+	// memory at once, when it sorts an unsorted segment.
+	scrubSortBuffer = 16 * 1024 * 1024
+)
+
+// errUnsorted is returned by scrubRecords for a segment whose records are
+// whole, but out of order, or outside of the bounds of its name. Segments
+// written before consumers merged what they gathered may be like that. They're
+// not corrupt, but queries that seek or read backwards need them sorted.
+var errUnsorted = errors.New("unsorted segment")
+
+// Scrubber reads every flushed segment in turn, in the background, and checks
+// it, so that corrupt segments are found before queries and compactions stumble
+// over them. Segments that are only unsorted are reported, or sorted. It reads
+// at a limited rate, and waits between passes.
+type Scrubber struct {
+	log              Log
+	rate             int64         // bytes per second
+	interval         time.Duration // between passes
+	quarantine       bool
+	sort             bool
+	sortBuffer       int64 // bytes
+	stop             chan chan struct{}
+	scrubbedSegments prometheus.Counter
+	failedSegments   prometheus.Counter
+	reporter         EventReporter
+}
+
+// NewScrubber creates a Scrubber, which reads rate bytes per second, or as fast
+// as it can if rate isn't positive, and starts another pass over the segments
+// interval after each one. If quarantine is true, the segments that fail are
+// quarantined; otherwise they're only reported. If sortUnsorted is true, the
+// segments that are only unsorted are rewritten in order; otherwise they're
+// only reported. Don't forget to Run it.
+func NewScrubber(
+	log Log,
+	rate int64, interval time.Duration, quarantine, sortUnsorted bool,
+	scrubbedSegments, failedSegments prometheus.Counter,
+	reporter EventReporter,
+) *Scrubber {
+	return &Scrubber{
+		log:              log,
+		rate:             rate,
+		interval:         interval,
+		quarantine:       quarantine,
+		sort:             sortUnsorted,
+		sortBuffer:       scrubSortBuffer,
+		stop:             make(chan chan struct{}),
+		scrubbedSegments: scrubbedSegments,
+		failedSegments:   failedSegments,
+		reporter:         reporter,
+	}
+}
+
+// Run scrubs segments.
+// Run returns when Stop is invoked.
+func (s *Scrubber) Run() {
+	var after string // the last segment scrubbed in this pass
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			var wait time.Duration
+			after, wait = s.scrubNext(after)
+			timer.Reset(wait)
+
+		case q := <-s.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the scrubber from scrubbing.
+func (s *Scrubber) Stop() {
+	defer func(begin time.Time) {
+		s.reporter.ReportEvent(Event{
+			Debug: true, Op: "Stop",
+			Msg: fmt.Sprintf("shutdown took %s", time.Since(begin)),
+		})
+	}(time.Now())
+	q := make(chan struct{})
+	s.stop <- q
+	<-q
+}
+
+// scrubNext scrubs the segment after the named one. It returns the name of the
+// segment to scrub after, which is empty to start the next pass, and how long
+// to wait until then.
+func (s *Scrubber) scrubNext(after string) (string, time.Duration) {
+	name, segment, err := s.log.Scrubbable(after)
+	if err == ErrNoSegmentsAvailable {
+		return "", s.interval // this pass is done
+	}
+	if err != nil {
+		s.reporter.ReportEvent(Event{
+			Op: "scrub", Error: err,
+			Msg: "scrub failed to get a segment; will retry",
+		})
+		return after, scrubRetry
+	}
+
+	s.scrubbedSegments.Inc()
+	n, err := s.scrub(name, segment)
+	var wait time.Duration
+	if s.rate > 0 {
+		wait = time.Duration(n) * time.Second / time.Duration(s.rate)
+	}
+	switch {
+	case err == nil:
+		if err := segment.Reset(); err != nil {
+			s.reporter.ReportEvent(Event{
+				Op: "scrub", File: name, Error: err,
+				Msg: "scrub failed to Reset a read segment",
+			})
+		}
+
+	case errors.Cause(err) == errUnsorted && !s.sort:
+		if err := segment.Reset(); err != nil {
+			s.reporter.ReportEvent(Event{
+				Op: "scrub", File: name, Error: err,
+				Msg: "scrub failed to Reset a read segment",
+			})
+		}
+		s.reporter.ReportEvent(Event{
+			Op: "scrub", File: name, Warning: err,
+			Msg: "scrub found an unsorted segment; it's read whole, and out of order",
+		})
+
+	case errors.Cause(err) == errUnsorted:
+		if err := segment.Reset(); err != nil {
+			s.reporter.ReportEvent(Event{
+				Op: "scrub", File: name, Error: err,
+				Msg: "scrub failed to Reset a read segment",
+			})
+			return name, wait
+		}
+		if serr := s.sortSegment(after, name); serr != nil {
+			s.reporter.ReportEvent(Event{
+				Op: "scrub", File: name, Error: serr,
+				Msg: fmt.Sprintf("scrub failed to sort an unsorted segment (%v); will retry next pass", err),
+			})
+			return name, wait
+		}
+		s.reporter.ReportEvent(Event{
+			Op: "scrub", File: name, Warning: err,
+			Msg: "scrub sorted an unsorted segment",
+		})
+
+	case isCorrupt(err) && s.quarantine:
+		s.failedSegments.Inc()
+		if qerr := segment.Quarantine(); qerr != nil {
+			s.reporter.ReportEvent(Event{
+				Op: "scrub", File: name, Error: qerr,
+				Msg: fmt.Sprintf("scrub failed to Quarantine a corrupt read segment (%v)", err),
+			})
+			return name, wait
+		}
+		s.reporter.ReportEvent(Event{
+			Op: "scrub", File: name, Error: err,
+			Msg: "scrub quarantined a corrupt read segment",
+		})
+
+	default:
+		if isCorrupt(err) {
+			s.failedSegments.Inc()
+		}
+		s.reporter.ReportEvent(Event{
+			Op: "scrub", File: name, Error: err,
+			Msg: "scrub failed to read a segment",
+		})
+		if err := segment.Reset(); err != nil {
+			s.reporter.ReportEvent(Event{
+				Op: "scrub", File: name, Error: err,
+				Msg: "scrub failed to Reset a read segment",
+			})
+		}
+	}
+	return name, wait
+}
+
+// sortSegment rewrites the named segment with its records in order, and
+// purges it. It takes the segment again as the first one after the given name,
+// as it was when it was scrubbed. To bound the memory it takes, the records are
+// sorted sortBuffer bytes at a time, each run written as a segment of its own:
+// the Compacter merges those, as they overlap.
+func (s *Scrubber) sortSegment(after, name string) error {
+	again, segment, err := s.log.Scrubbable(after)
+	if err != nil {
+		return err
+	}
+	if again != name {
+		segment.Reset()
+		return errors.Errorf("%s was scrubbed next instead", again)
+	}
+	var (
+		br      = bufio.NewReader(segment)
+		records [][]byte
+		size    int64
+	)
+	for i := 0; ; i++ {
+		record, err := br.ReadBytes('\n')
+		if err == io.EOF && len(record) == 0 {
+			break
+		}
+		if err != nil {
+			segment.Reset()
+			return err
+		}
+		if len(record) <= ulid.EncodedSize || !validULID(record[:ulid.EncodedSize]) {
+			segment.Reset()
+			return corruptf("record %d: malformed %q", i, record)
+		}
+		records = append(records, record)
+		size += int64(len(record))
+		if size >= s.sortBuffer {
+			if err := s.writeSorted(records); err != nil {
+				segment.Reset()
+				return err
+			}
+			records, size = records[:0], 0
+		}
+	}
+	if err := s.writeSorted(records); err != nil {
+		segment.Reset()
+		return err
+	}
+	return segment.Purge()
+}
+
+// writeSorted sorts the records, and writes them as a new segment.
+func (s *Scrubber) writeSorted(records [][]byte) error {
+	if len(records) <= 0 {
+		return nil
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return bytes.Compare(records[i][:ulid.EncodedSize], records[j][:ulid.EncodedSize]) < 0
+	})
+	w, err := s.log.Create()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, err := w.Write(record); err != nil {
+			w.Delete()
+			return err
+		}
+	}
+	var (
+		low  = ulid.MustParse(string(records[0][:ulid.EncodedSize]))
+		high = ulid.MustParse(string(records[len(records)-1][:ulid.EncodedSize]))
+	)
+	if err := w.Close(low, high); err != nil {
+		w.Delete()
+		return err
+	}
+	return nil
+}
+
+// scrub reads the named segment whole, and checks it. It returns the number of
+// bytes read.
+func (s *Scrubber) scrub(name string, segment ReadSegment) (int64, error) {
+	low, high, err := parseFilename(name)
+	if err != nil {
+		return 0, corruptf("%v", err)
+	}
+	return scrubRecords(segment, low, high)
+}
+
+// scrubRecords reads records until EOF, and checks that they're whole, in
+// order, and within the bounds of their segment's name. It returns the number
+// of bytes read. Records that aren't whole make the segment corrupt; if they're
+// only out of order or out of bounds, the error is errUnsorted, once they've
+// all been checked.
+//
+// Records are only ordered by time: those of the same millisecond may be in
+// any order, as they were written, and so may the bounds of the segment.
+func scrubRecords(r io.Reader, low, high ulid.ULID) (n int64, err error) {
+	var (
+		br       = bufio.NewReader(r)
+		id       ulid.ULID
+		prev     uint64 // time
+		unsorted error
+	)
+	for i := 0; ; i++ {
+		record, err := br.ReadBytes('\n')
+		n += int64(len(record))
+		switch {
+		case err == io.EOF && len(record) == 0:
+			return n, unsorted
+		case err == io.EOF:
+			return n, corruptf("record %d: no trailing newline", i)
+		case err != nil:
+			return n, err
+		}
+		if len(record) < ulid.EncodedSize+2 || record[ulid.EncodedSize] != ' ' {
+			return n, corruptf("record %d: malformed %q", i, record)
+		}
+		if err := id.UnmarshalText(record[:ulid.EncodedSize]); err != nil {
+			return n, corruptf("record %d: %v", i, err)
+		}
+		if !validULID(record[:ulid.EncodedSize]) {
+			return n, corruptf("record %d: invalid ULID %q", i, record[:ulid.EncodedSize])
+		}
+		switch {
+		case unsorted != nil:
+		case i > 0 && id.Time() < prev:
+			unsorted = errors.Wrapf(errUnsorted, "record %d: %s is out of order, after %d", i, id, prev)
+		case id.Time() < low.Time() || id.Time() > high.Time():
+			unsorted = errors.Wrapf(errUnsorted, "record %d: %s is outside of %s-%s", i, id, low, high)
+		}
+		prev = id.Time()
+	}
+}
+
+// ulidEncoding is the alphabet of encoded ULIDs, Crockford's base32.
+const ulidEncoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// validULID reports whether the encoded ULID has only characters of its
+// alphabet, and fits in 128 bits. Decoding alone doesn't check either.
+func validULID(encoded []byte) bool {
+	if len(encoded) != ulid.EncodedSize || encoded[0] > '7' {
+		return false
+	}
+	for _, c := range encoded {
+		if strings.IndexByte(ulidEncoding, c) < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1046102779/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/1046102779/oklog/pkg/fs"
+)
+
+func TestScrubRecords(t *testing.T) {
+	t.Parallel()
+
+	var (
+		t0 = time.Now()
+		id = func(ms int, entropy byte) string {
+			return ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(ms)*time.Millisecond)), bytes.NewReader(bytes.Repeat([]byte{entropy}, 10))).String()
+		}
+		low, high = ulid.MustParse(id(0, 0)), ulid.MustParse(id(9, 0))
+	)
+	for _, testcase := range []struct {
+		name     string
+		records  string
+		corrupt  bool
+		unsorted bool
+	}{
+		{"empty", "", false, false},
+		{"ordered", id(0, 0) + " a\n" + id(1, 0) + " b\n" + id(9, 0) + " c\n", false, false},
+		{"same millisecond", id(1, 9) + " a\n" + id(1, 1) + " b\n", false, false},
+		{"empty record", id(1, 0) + " \n", false, false},
+		{"no trailing newline", id(1, 0) + " a\n" + id(2, 0) + " b", true, false},
+		{"no space", id(1, 0) + "a\n", true, false},
+		{"short", "short\n", true, false},
+		{"bad ULID", strings.Repeat("!", ulid.EncodedSize) + " a\n", true, false},
+		{"out of order", id(2, 0) + " a\n" + id(1, 0) + " b\n", false, true},
+		{"too early", id(-1, 0) + " a\n", false, true},
+		{"too late", id(10, 0) + " a\n", false, true},
+		{"out of order, then short", id(2, 0) + " a\n" + id(1, 0) + " b\nshort\n", true, false},
+	} {
+		n, err := scrubRecords(strings.NewReader(testcase.records), low, high)
+		if want, have := testcase.corrupt, isCorrupt(err); want != have {
+			t.Errorf("%s: want corrupt %v, have %v (%v)", testcase.name, want, have, err)
+		}
+		if want, have := testcase.unsorted, errors.Cause(err) == errUnsorted; want != have {
+			t.Errorf("%s: want unsorted %v, have %v (%v)", testcase.name, want, have, err)
+		}
+		if !testcase.corrupt && n != int64(len(testcase.records)) {
+			t.Errorf("%s: want %d bytes, have %d", testcase.name, len(testcase.records), n)
+		}
+	}
+}
+
+func TestScrubber(t *testing.T) {
+	t.Parallel()
+
+	var (
+		filesys  = fs.NewVirtualFilesystem()
+		reporter = &eventRecorder{}
+	)
+	filelog, err := NewFileLog(filesys, "/", 64*1024*1024, 1024, reporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	// Three segments: a good one, one that's corrupt on disk, and one whose
+	// records are out of order, as consumers used to write them.
+	var (
+		t0    = time.Now().Add(-time.Hour)
+		paths []string
+	)
+	for i, order := range [][]int{{0, 1, 2}, {3, 4, 5}, {8, 6, 7}} {
+		segment, err := filelog.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]ulid.ULID, len(order))
+		for j, ms := range order {
+			ids[j] = ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(ms)*time.Millisecond)), nil)
+			fmt.Fprintf(segment, "%s segment %d\n", ids[j], i)
+		}
+		if err := segment.Close(ids[0], ids[len(ids)-1]); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, fmt.Sprintf("/%s-%s%s", ids[0], ids[len(ids)-1], extFlushed))
+	}
+	corruptFile(t, filesys, paths[1], func(data []byte) { data[len(data)-2] ^= 1 })
+
+	scrubbed, failed := &countingCounter{}, &countingCounter{}
+	s := NewScrubber(filelog, 1024, time.Hour, true, true, scrubbed, failed, reporter)
+	s.sortBuffer = 64 // two records at a time
+	var (
+		after string
+		waits []time.Duration
+	)
+	for {
+		name, wait := s.scrubNext(after)
+		waits = append(waits, wait)
+		if name == "" {
+			break
+		}
+		after = name
+	}
+
+	if waits[0] <= 0 || waits[0] >= time.Second {
+		t.Errorf("want about 100ms to read the first segment at 1KB/s, have %s", waits[0])
+	}
+	if want, have := time.Hour, waits[len(waits)-1]; want != have {
+		t.Errorf("want %s after the pass, have %s", want, have)
+	}
+	if want, have := 3, scrubbed.n; want != have {
+		t.Errorf("want %d scrubbed segments, have %d", want, have)
+	}
+	if want, have := 1, failed.n; want != have {
+		t.Errorf("want %d failed segment, have %d", want, have)
+	}
+	if !filesys.Exists(paths[0]) {
+		t.Errorf("%s wasn't reset", paths[0])
+	}
+	checkQuarantined(t, filesys, paths[1])
+
+	// The unsorted segment isn't quarantined, but replaced by sorted ones,
+	// sorted a buffer at a time.
+	if filesys.Exists(paths[2]) {
+		t.Errorf("%s wasn't replaced", paths[2])
+	}
+	var sorted []string
+	filesys.Walk("/", func(path string, info os.FileInfo, err error) error {
+		if filepath.Ext(path) == extFlushed && path != paths[0] {
+			sorted = append(sorted, path)
+		}
+		return nil
+	})
+	if len(sorted) != 2 {
+		t.Fatalf("want two sorted segments, have %v", sorted)
+	}
+	var records int64
+	for _, path := range sorted {
+		low, high, _ := parseFilename(path)
+		f, err := filesys.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := scrubRecords(f, low, high); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		records += f.Size() / int64(len(fmt.Sprintf("%s segment 2\n", ulid.ULID{})))
+		f.Close()
+	}
+	if want, have := int64(3), records; want != have {
+		t.Errorf("want %d sorted records, have %d", want, have)
+	}
+
+	// Without sorting, unsorted segments are only reported.
+	segment, err := filelog.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []ulid.ULID
+	for _, ms := range []int{12, 10, 11} {
+		ids = append(ids, ulid.MustNew(ulid.Timestamp(t0.Add(time.Duration(ms)*time.Millisecond)), nil))
+		fmt.Fprintf(segment, "%s segment 3\n", ids[len(ids)-1])
+	}
+	if err := segment.Close(ids[0], ids[len(ids)-1]); err != nil {
+		t.Fatal(err)
+	}
+	unsorted := fmt.Sprintf("/%s-%s%s", ids[0], ids[len(ids)-1], extFlushed)
+	s = NewScrubber(filelog, 0, time.Hour, true, false, scrubbed, failed, reporter)
+	for after = ""; ; {
+		if after, _ = s.scrubNext(after); after == "" {
+			break
+		}
+	}
+	if !filesys.Exists(unsorted) {
+		t.Errorf("%s wasn't reset", unsorted)
+	}
+	if name := modifyExtension(unsorted[1:], ""); reporter.count(name) != 1 {
+		t.Errorf("want an event for %s, have %d", name, reporter.count(name))
+	}
+
+	// Without quarantine, corrupt ones are only reported.
+	s = NewScrubber(filelog, 0, time.Hour, false, false, scrubbed, failed, reporter)
+	corruptFile(t, filesys, paths[0], func(data []byte) { data[0] ^= 1 })
+	if name, wait := s.scrubNext(""); name == "" || wait != 0 {
+		t.Errorf("want a segment scrubbed without waiting, have %q, %s", name, wait)
+	}
+	if want, have := 2, failed.n; want != have {
+		t.Errorf("want %d failed segments, have %d", want, have)
+	}
+	if !filesys.Exists(paths[0]) {
+		t.Errorf("%s wasn't reset", paths[0])
+	}
+}
+
+// countingCounter counts how many times it's incremented.
+type countingCounter struct {
+	prometheus.Counter
+	n int
+}
+
+func (c *countingCounter) Inc() { c.n++ }